@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"time"
+)
+
+// adminTimeout is the time allowed for a RFID-unit state-machine to answer a
+// request from the admin API, in addition to the time allowed for the
+// RFID-unit to respond to vendor commands.
+const adminTimeout = 5 * time.Second
+
+var (
+	errUnitBusy     = errors.New("RFID-unit is busy; reset it first")
+	errUnitTimeout  = errors.New("RFID-unit didn't respond in time")
+	errUnitStopped  = errors.New("RFID-unit state-machine has shut down")
+	errNoSuchUnit   = errors.New("no such workstation, or its RFID-unit is not connected")
+	errEmptyCommand = errors.New("empty command")
+	errUnitReset    = errors.New("RFID-unit was reset")
+)
+
+// connInfo describes a UI connection, as listed by the admin API.
+type connInfo struct {
+	Workstation string
+	IP          string
+	Staff       string `json:",omitempty"` // Koha user, if authenticated
+	Observer    bool
+	Connected   time.Time
+	Unit        *unitInfo `json:",omitempty"` // nil if the RFID-unit is not connected
+}
+
+// unitInfo describes the state of a RFID-unit state-machine.
+type unitInfo struct {
+	Addr     string
+	Vendor   string
+	State    string
+	Branch   string
+	Patron   string
+	Items    int       // Number of items processed in the current session
+	LastRFID time.Time // When the last message from the RFID-unit was received; zero if none
+}
+
+// Requests from the admin API to a RFID-unit state-machine:
+const (
+	adminInfo    = iota // Describe the state-machine
+	adminReset          // End scanning, and go idle with an empty session
+	adminCommand        // Send a vendor command to the RFID-unit, and return the response
+)
+
+// adminReq is a request from the admin API to a RFID-unit state-machine. It
+// is answered on reply, which must be buffered.
+type adminReq struct {
+	cmd   int
+	data  []byte // adminCommand: the vendor command
+	reply chan adminResp
+}
+
+type adminResp struct {
+	info unitInfo
+	resp []byte // adminCommand: the response from the RFID-unit
+	err  error
+}
+
+// handleAdmin handles a request from the admin API. It is called by the
+// state-machine, and returns true if the state-machine is waiting for the
+// RFID-unit.
+func (u *RFIDUnit) handleAdmin(req adminReq) bool {
+	switch req.cmd {
+	case adminInfo:
+		req.reply <- adminResp{info: unitInfo{
+			Addr:     u.addr,
+			Vendor:   u.vendorName,
+			State:    u.state.String(),
+			Branch:   u.dept,
+			Patron:   u.patron,
+			Items:    len(u.items),
+			LastRFID: u.lastRFID,
+		}}
+		return false
+	case adminReset:
+		log.Printf("WARN: [%v] state-machine reset from admin API in state %v", u.addr, u.state)
+		if u.state == UNITAdminCommand {
+			// Not waiting for the response any more:
+			u.adminCommandDone(nil, errUnitReset)
+		}
+		u.record("interrupted")
+		u.reset()
+		u.patron = ""
+		u.patronName = ""
+		u.ToUI <- UIMsg{Action: "RESET"}
+		u.state = UNITWaitForEndOK
+		log.Printf("[%v] UNITWaitForEndOK", u.addr)
+		u.ToRFID <- u.vendor.GenerateRFIDReq(RFIDReq{Cmd: cmdEndScan})
+		req.reply <- adminResp{}
+		return true
+	case adminCommand:
+		if u.state != UNITIdle {
+			req.reply <- adminResp{err: errUnitBusy}
+			return false
+		}
+		data := req.data
+		if !bytes.HasSuffix(data, []byte("\r")) {
+			data = append(data, '\r')
+		}
+		log.Printf("WARN: [%v] sending %q from admin API", u.addr, data)
+		u.adminReply = req.reply
+		u.state = UNITAdminCommand
+		log.Printf("[%v] UNITAdminCommand", u.addr)
+		u.ToRFID <- data
+		return true
+	}
+	return false
+}
+
+// adminCommandDone answers the pending vendor command from the admin API with
+// the response from the RFID-unit, or the error, and goes idle.
+func (u *RFIDUnit) adminCommandDone(resp []byte, err error) {
+	u.adminReply <- adminResp{resp: resp, err: err}
+	u.adminReply = nil
+	u.state = UNITIdle
+	log.Printf("[%v] UNITIdle", u.addr)
+}
+
+// admin sends a request to the state-machine, and waits for the answer.
+func (u *RFIDUnit) admin(req adminReq) adminResp {
+	req.reply = make(chan adminResp, 1)
+	wait := adminTimeout
+	if req.cmd == adminCommand {
+		// The state-machine gives up after the RFID-unit timeout:
+		wait += u.cfg.rfidTimeout(UNITAdminCommand)
+	}
+	deadline := time.After(wait)
+	select {
+	case u.Admin <- req:
+	case <-u.closed:
+		return adminResp{err: errUnitStopped}
+	case <-deadline:
+		return adminResp{err: errUnitTimeout}
+	}
+	select {
+	case resp := <-req.reply:
+		return resp
+	case <-u.closed:
+		return adminResp{err: errUnitStopped}
+	case <-deadline:
+		return adminResp{err: errUnitTimeout}
+	}
+}
+
+// adminConn is a UI connection and its RFID-unit state-machine, as seen by
+// the Hub.
+type adminConn struct {
+	c    *uiConn
+	unit *RFIDUnit
+}
+
+// connections returns the UI connections of the Hub.
+func (h *Hub) connections() []adminConn {
+	reply := make(chan []adminConn, 1)
+	select {
+	case h.adminList <- reply:
+	case <-h.closed:
+		return nil
+	}
+	return <-reply
+}
+
+// controller returns the controlling UI connection of the workstation, or
+// false if there is none.
+func (h *Hub) controller(workstation string) (adminConn, bool) {
+	for _, ac := range h.connections() {
+		if ac.c.workstation == workstation && !ac.c.observer {
+			return ac, true
+		}
+	}
+	return adminConn{}, false
+}
+
+// info describes the UI connection, with the state of its RFID-unit.
+func (ac adminConn) info() connInfo {
+	ci := connInfo{
+		Workstation: ac.c.workstation,
+		IP:          ac.c.ip,
+		Staff:       ac.c.staff.User,
+		Observer:    ac.c.observer,
+		Connected:   ac.c.connected,
+	}
+	if ac.unit != nil {
+		if resp := ac.unit.admin(adminReq{cmd: adminInfo}); resp.err == nil {
+			ci.Unit = &resp.info
+		}
+	}
+	return ci
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const testAdminToken = "0123456789abcdef"
+
+// adminDo sends a request to the admin API, and returns the status code and
+// body of the response.
+func adminDo(t *testing.T, method, url, token, body string) (int, string) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	r, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Body.Close()
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r.StatusCode, string(b)
+}
+
+func getConnections(t *testing.T, srvURL string) []connInfo {
+	code, body := adminDo(t, "GET", srvURL+"/admin/connections", testAdminToken, "")
+	if code != http.StatusOK {
+		t.Fatalf("GET /admin/connections => %d %s; want 200 OK", code, body)
+	}
+	var res []connInfo
+	if err := json.Unmarshal([]byte(body), &res); err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+// waitUnitState polls /admin/connections until the RFID-unit of the only
+// connection is in the given state.
+func waitUnitState(t *testing.T, srvURL, state string) {
+	var conns []connInfo
+	for i := 0; i < 100; i++ {
+		conns = getConnections(t, srvURL)
+		if len(conns) == 1 && conns[0].Unit != nil && conns[0].Unit.State == state {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("GET /admin/connections => %+v; want RFID-unit in %v", conns, state)
+}
+
+// The receive helpers below fail the test, instead of hanging, when nothing
+// is received within a second.
+
+func recvUI(t *testing.T, c chan UIMsg) UIMsg {
+	select {
+	case msg := <-c:
+		return msg
+	case <-time.After(time.Second):
+		t.Fatal("UI got no message")
+	}
+	return UIMsg{}
+}
+
+func recvRFID(t *testing.T, c chan []byte) []byte {
+	select {
+	case msg := <-c:
+		return msg
+	case <-time.After(time.Second):
+		t.Fatal("RFID-unit got no message")
+	}
+	return nil
+}
+
+func recvCode(t *testing.T, c chan int) int {
+	select {
+	case code := <-c:
+		return code
+	case <-time.After(time.Second):
+		t.Fatal("admin request got no response")
+	}
+	return 0
+}
+
+func TestAdminAPI(t *testing.T) {
+	// Setup: ->
+
+	uiChan := make(chan UIMsg)
+	sipSrv := newSIPTestServer()
+	defer sipSrv.Close()
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	d := newDummyRFIDReader()
+	defer d.Close()
+
+	hub = newHub(config{
+		HTTPPort:          port(srv.URL),
+		SIPServer:         sipSrv.Addr(),
+		TCPPort:           port(d.addr()),
+		NumSIPConnections: 1,
+		AdminToken:        testAdminToken,
+	})
+	go hub.run()
+	defer hub.Close()
+
+	url := fmt.Sprintf("ws://localhost:%s/ws?workstation=desk1", port(srv.URL))
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &dummyUIAgent{c: ws, msg: uiChan}
+	go a.run()
+	defer a.c.Close()
+
+	// <- end setup
+
+	<-d.incoming
+	d.outgoing <- []byte("OK\r")
+	<-uiChan // CONNECT
+
+	// The admin API requires the token
+	for _, token := range []string{"", "fedcba9876543210"} {
+		if code, _ := adminDo(t, "GET", srv.URL+"/admin/connections", token, ""); code != http.StatusUnauthorized {
+			t.Errorf("GET /admin/connections with token %q => %d; want 401 Unauthorized", token, code)
+		}
+	}
+
+	err = a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKIN","Branch":"hutl"}`))
+	if err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	<-d.incoming // BEG
+	d.outgoing <- []byte("OK\r")
+
+	conns := getConnections(t, srv.URL)
+	if len(conns) != 1 || conns[0].Unit == nil {
+		t.Fatalf("GET /admin/connections => %+v; want desk1 with its RFID-unit", conns)
+	}
+	c := conns[0]
+	if c.Workstation != "desk1" || c.IP != "127.0.0.1" || c.Observer || c.Connected.IsZero() {
+		t.Errorf("GET /admin/connections => %+v; want controlling connection of desk1 from 127.0.0.1", c)
+	}
+	if u := c.Unit; u.State != "UNITCheckin" || u.Branch != "hutl" || u.Vendor != "deichman" || u.LastRFID.IsZero() {
+		t.Errorf("GET /admin/connections => unit %+v; want checkin at hutl with deichman", u)
+	}
+
+	// Vendor commands are only sent when the RFID-unit is idle
+	cmdURL := srv.URL + "/admin/command?workstation=desk1"
+	if code, body := adminDo(t, "POST", cmdURL, testAdminToken, "VER2.00"); code != http.StatusConflict {
+		t.Errorf("POST /admin/command while scanning => %d %s; want 409 Conflict", code, body)
+	}
+
+	// Reset ends scanning, and tells the UI
+	done := make(chan int)
+	go func() {
+		code, _ := adminDo(t, "POST", srv.URL+"/admin/reset?workstation=desk1", testAdminToken, "")
+		done <- code
+	}()
+	if msg := recvUI(t, uiChan); msg.Action != "RESET" {
+		t.Errorf("UI got %+v; want RESET", msg)
+	}
+	if msg := recvRFID(t, d.incoming); string(msg) != "END\r" {
+		t.Errorf("RFID-unit got %q; want END", msg)
+	}
+	if code := recvCode(t, done); code != http.StatusNoContent {
+		t.Errorf("POST /admin/reset => %d; want 204 No Content", code)
+	}
+	d.outgoing <- []byte("OK\r")
+	waitUnitState(t, srv.URL, "UNITIdle")
+
+	// Vendor commands are sent as is, and the response returned
+	go func() {
+		code, body := adminDo(t, "POST", cmdURL, testAdminToken, "VER2.00")
+		if code != http.StatusOK || body != `{"Response":"OK"}` {
+			t.Errorf("POST /admin/command => %d %s; want 200 OK with response", code, body)
+		}
+		done <- code
+	}()
+	if msg := recvRFID(t, d.incoming); string(msg) != "VER2.00\r" {
+		t.Errorf("RFID-unit got %q; want VER2.00", msg)
+	}
+	d.outgoing <- []byte("OK\r")
+	recvCode(t, done)
+	if conns := getConnections(t, srv.URL); len(conns) != 1 || conns[0].Unit.State != "UNITIdle" {
+		t.Errorf("GET /admin/connections after command => %+v; want idle RFID-unit", conns)
+	}
+
+	// Reset answers a pending command
+	go func() {
+		code, _ := adminDo(t, "POST", cmdURL, testAdminToken, "VER2.00")
+		done <- code
+	}()
+	recvRFID(t, d.incoming) // VER2.00, not answered
+	go func() {
+		adminDo(t, "POST", srv.URL+"/admin/reset?workstation=desk1", testAdminToken, "")
+	}()
+	if code := recvCode(t, done); code != http.StatusConflict {
+		t.Errorf("POST /admin/command interrupted by reset => %d; want 409 Conflict", code)
+	}
+	recvUI(t, uiChan) // RESET
+	if msg := recvRFID(t, d.incoming); string(msg) != "END\r" {
+		t.Errorf("RFID-unit got %q; want END", msg)
+	}
+	d.outgoing <- []byte("OK\r")
+
+	// Unknown workstations, and wrong methods, are refused
+	if code, _ := adminDo(t, "POST", srv.URL+"/admin/reset?workstation=desk2", testAdminToken, ""); code != http.StatusNotFound {
+		t.Errorf("POST /admin/reset of unknown workstation => %d; want 404 Not Found", code)
+	}
+	if code, _ := adminDo(t, "GET", srv.URL+"/admin/disconnect?workstation=desk1", testAdminToken, ""); code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /admin/disconnect => %d; want 405 Method Not Allowed", code)
+	}
+
+	// Disconnect closes the UI connection
+	if code, _ := adminDo(t, "POST", srv.URL+"/admin/disconnect?workstation=desk1", testAdminToken, ""); code != http.StatusNoContent {
+		t.Errorf("POST /admin/disconnect => %d; want 204 No Content", code)
+	}
+	for i := 0; len(conns) > 0; i++ {
+		if i == 100 {
+			t.Fatalf("GET /admin/connections after disconnect => %+v; want none", conns)
+		}
+		time.Sleep(10 * time.Millisecond)
+		conns = getConnections(t, srv.URL)
+	}
+}
+
+func TestAdminAPIDisabled(t *testing.T) {
+	hub = newHub(config{NumSIPConnections: 1})
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/admin/connections", nil)
+	r.Header.Set("Authorization", "Bearer ")
+	adminConnectionsHandler(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("GET /admin/connections without AdminToken => %d; want 404 Not Found", w.Code)
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// auditEntry is a record of a checkin, checkout or renewal transaction, as
+// written to the audit log.
+type auditEntry struct {
+	Time        time.Time
+	Action      string // CHECKIN/CHECKOUT/RENEW/RENEW-ALL/RETRY-ALARM-ON/RETRY-ALARM-OFF/OFFLINE-CHECKIN
+	Workstation string
+	IP          string // IP-address of the UI
+	Staff       string `json:",omitempty"` // Koha user of the UI, if authenticated
+	Branch      string
+	Patron      string `json:",omitempty"`
+	Barcode     string
+	Tag         string
+	SIP         string `json:",omitempty"` // ok/failed/unknown/incomplete/sip-error/queued
+	SIPError    string `json:",omitempty"` // error from the SIP-call, if SIP is sip-error
+	Alarm       string `json:",omitempty"` // on/off/unchanged, suffixed with -failed
+	Item        item   // as sent to the UI
+}
+
+// auditMaxEntries is the most entries returned by a query of the audit log.
+const auditMaxEntries = 1000
+
+// auditQuery selects entries from the audit log. Empty fields and zero times
+// match all entries.
+type auditQuery struct {
+	Barcode string
+	Patron  string
+	From    time.Time // inclusive
+	To      time.Time // exclusive
+
+	Offset int // number of matching entries to skip
+	Limit  int // most entries to return; 0 or above auditMaxEntries: auditMaxEntries
+}
+
+func (q auditQuery) match(e auditEntry) bool {
+	if q.Barcode != "" && q.Barcode != e.Barcode {
+		return false
+	}
+	if q.Patron != "" && q.Patron != e.Patron {
+		return false
+	}
+	if !q.From.IsZero() && e.Time.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && !e.Time.Before(q.To) {
+		return false
+	}
+	return true
+}
+
+// auditLog is an append-only journal of transactions, stored as one JSON
+// object per line. When the file grows beyond maxSize bytes, it is rotated:
+// path is renamed to path.1, path.1 to path.2 and so on, keeping at most
+// backups old files.
+//
+// A nil *auditLog is a disabled audit log, where Record does nothing.
+type auditLog struct {
+	path    string
+	maxSize int64 // 0: never rotate
+	backups int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// openAuditLog opens the audit log at the given path, creating it if it
+// doesn't exist.
+func openAuditLog(path string, maxSize int64, backups int) (*auditLog, error) {
+	l := &auditLog{path: path, maxSize: maxSize, backups: backups}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *auditLog) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.f = f
+	l.size = fi.Size()
+	return l.endLine()
+}
+
+// endLine ends the last line of the current file with a newline, if it was
+// cut short, eg. by a crash, so that the next entry is not appended to it.
+func (l *auditLog) endLine() error {
+	if l.size == 0 {
+		return nil
+	}
+	f, err := os.Open(l.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	b := make([]byte, 1)
+	if _, err := f.ReadAt(b, l.size-1); err != nil {
+		return err
+	}
+	if b[0] == '\n' {
+		return nil
+	}
+	n, err := l.f.Write([]byte{'\n'})
+	l.size += int64(n)
+	return err
+}
+
+// backup returns the path of the n'th rotated file; n=0 is the current file.
+func (l *auditLog) backup(n int) string {
+	if n == 0 {
+		return l.path
+	}
+	return fmt.Sprintf("%s.%d", l.path, n)
+}
+
+func (l *auditLog) rotate() error {
+	if err := l.f.Close(); err != nil {
+		return err
+	}
+	if l.backups == 0 {
+		if err := os.Remove(l.path); err != nil {
+			return err
+		}
+	}
+	for n := l.backups; n > 0; n-- {
+		err := os.Rename(l.backup(n-1), l.backup(n))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return l.open()
+}
+
+// Record appends an entry to the audit log.
+func (l *auditLog) Record(e auditEntry) error {
+	if l == nil {
+		return nil
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return fmt.Errorf("audit log %v is closed", l.path)
+	}
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(b)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := l.f.Write(b)
+	l.size += int64(n)
+	return err
+}
+
+// auditFile is a file of the audit log, opened for reading.
+type auditFile struct {
+	name string
+	f    *os.File
+	r    io.Reader
+}
+
+// snapshot opens the rotated files, oldest first, and the current one. The
+// lock is only held while opening them, so that reading them doesn't hold up
+// Record. The current file is read up to its present size only, so that an
+// entry being written is not seen half-way.
+func (l *auditLog) snapshot() ([]auditFile, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return nil, fmt.Errorf("audit log %v is closed", l.path)
+	}
+
+	var files []auditFile
+	for n := l.backups; n >= 0; n-- {
+		name := l.backup(n)
+		f, err := os.Open(name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			for _, af := range files {
+				af.f.Close()
+			}
+			return nil, err
+		}
+		var r io.Reader = f
+		if n == 0 {
+			r = io.LimitReader(f, l.size)
+		}
+		files = append(files, auditFile{name: name, f: f, r: r})
+	}
+	return files, nil
+}
+
+// Query returns the entries matching q, oldest first, searching the rotated
+// files as well as the current one. At most q.Limit entries are returned;
+// more is true if there are more matching entries after them. Lines which
+// cannot be decoded, eg. one cut short by a crash, are skipped and logged.
+func (l *auditLog) Query(q auditQuery) (entries []auditEntry, more bool, err error) {
+	files, err := l.snapshot()
+	if err != nil {
+		return nil, false, err
+	}
+	defer func() {
+		for _, af := range files {
+			af.f.Close()
+		}
+	}()
+
+	limit := q.Limit
+	if limit <= 0 || limit > auditMaxEntries {
+		limit = auditMaxEntries
+	}
+	skip := q.Offset
+	res := []auditEntry{}
+	for _, af := range files {
+		s := bufio.NewScanner(af.r)
+		s.Buffer(nil, 1024*1024)
+		line, bad := 0, 0
+		for s.Scan() {
+			line++
+			var e auditEntry
+			if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+				bad++
+				continue
+			}
+			if !q.match(e) {
+				continue
+			}
+			if skip > 0 {
+				skip--
+				continue
+			}
+			if len(res) == limit {
+				return res, true, nil
+			}
+			res = append(res, e)
+		}
+		if bad > 0 {
+			log.Printf("WARN: audit log %v: skipped %d lines which could not be decoded", af.name, bad)
+		}
+		if err := s.Err(); err != nil {
+			log.Printf("WARN: audit log %v: skipped the lines after line %d: %v", af.name, line, err)
+		}
+	}
+	return res, false, nil
+}
+
+// Close closes the audit log file.
+func (l *auditLog) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Close()
+	l.f = nil
+	return err
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestAuditLogRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rfidhub-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	// Room for two entries in each file. Only the current file and 2
+	// backups are kept.
+	b, _ := json.Marshal(auditEntry{Action: "CHECKIN", Barcode: "0"})
+	size := int64(2 * (len(b) + 1))
+	l, err := openAuditLog(path, size, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	for i := 0; i < 8; i++ {
+		if err := l.Record(auditEntry{Action: "CHECKIN", Barcode: fmt.Sprintf("%d", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		if _, err := os.Stat(name); err != nil {
+			t.Errorf("%v missing after rotation: %v", name, err)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("%v.3 exists; want at most 2 backups", path)
+	}
+
+	entries, _, err := l.Query(auditQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, e := range entries {
+		got = append(got, e.Barcode)
+	}
+	if want := []string{"2", "3", "4", "5", "6", "7"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Query() barcodes => %v; want %v", got, want)
+	}
+
+	// Reopening appends to the current file:
+	l.Close()
+	l, err = openAuditLog(path, size, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, _, err = l.Query(auditQuery{Barcode: "7"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("Query(Barcode: 7) after reopen => %d entries; want 1", len(entries))
+	}
+}
+
+func TestAuditLogPages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rfidhub-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	l, err := openAuditLog(path, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	for i := 0; i < 3; i++ {
+		if err := l.Record(auditEntry{Action: "CHECKIN", Barcode: fmt.Sprintf("%d", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A line cut short by a crash is skipped, and the next entry is written
+	// on a line of its own:
+	l.Close()
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"Time":"2014-03-24T14:02:00+01:00","Action":"CHE`)
+	f.Close()
+	if l, err = openAuditLog(path, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	for i := 3; i < 5; i++ {
+		if err := l.Record(auditEntry{Action: "CHECKIN", Barcode: fmt.Sprintf("%d", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var tests = []struct {
+		offset, limit int
+		want          []string
+		more          bool
+	}{
+		{0, 0, []string{"0", "1", "2", "3", "4"}, false},
+		{0, 2, []string{"0", "1"}, true},
+		{2, 2, []string{"2", "3"}, true},
+		{4, 2, []string{"4"}, false},
+		{5, 2, nil, false},
+	}
+	for _, tt := range tests {
+		entries, more, err := l.Query(auditQuery{Offset: tt.offset, Limit: tt.limit})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, e := range entries {
+			got = append(got, e.Barcode)
+		}
+		if !reflect.DeepEqual(got, tt.want) || more != tt.more {
+			t.Errorf("Query(Offset: %d, Limit: %d) => %v, %v; want %v, %v", tt.offset, tt.limit, got, more, tt.want, tt.more)
+		}
+	}
+}
+
+func TestAuditQuery(t *testing.T) {
+	at := func(s string) time.Time {
+		tm, err := time.ParseInLocation("2006-01-02 15:04", s, time.Local)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+	e := auditEntry{Time: at("2014-03-24 14:02"), Barcode: "03010824124004", Patron: "2"}
+
+	to, _ := parseAuditTime("2014-03-24", true)
+	from, _ := parseAuditTime("2014-03-24", false)
+
+	var tests = []struct {
+		q    auditQuery
+		want bool
+	}{
+		{auditQuery{}, true},
+		{auditQuery{Barcode: "03010824124004"}, true},
+		{auditQuery{Barcode: "1234"}, false},
+		{auditQuery{Patron: "2", Barcode: "03010824124004"}, true},
+		{auditQuery{Patron: "3"}, false},
+		{auditQuery{From: from, To: to}, true},
+		{auditQuery{From: at("2014-03-24 14:03")}, false},
+		{auditQuery{To: at("2014-03-24 14:02")}, false},
+		{auditQuery{To: from}, false},
+	}
+
+	for _, tt := range tests {
+		if got := tt.q.match(e); got != tt.want {
+			t.Errorf("%+v.match(%+v) => %v; want %v", tt.q, e, got, tt.want)
+		}
+	}
+
+	if _, err := parseAuditTime("24.03.2014", false); err == nil {
+		t.Error("parseAuditTime(\"24.03.2014\") => no error; want an error")
+	}
+}
+
+func TestCheckinAudit(t *testing.T) {
+	// Setup: ->
+
+	dir, err := ioutil.TempDir("", "rfidhub-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	uiChan := make(chan UIMsg)
+	sipSrv := newSIPTestServer()
+	defer sipSrv.Close()
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	d := newDummyRFIDReader()
+	defer d.Close()
+
+	hub = newHub(config{
+		HTTPPort:          port(srv.URL),
+		SIPServer:         sipSrv.Addr(),
+		TCPPort:           port(d.addr()),
+		NumSIPConnections: 1,
+		AuditLog:          filepath.Join(dir, "audit.log"),
+		AdminToken:        testAdminToken,
+	})
+	go hub.run()
+	defer hub.Close()
+
+	a := newDummyUIAgent(uiChan, port(srv.URL))
+	defer a.c.Close()
+
+	// <- end setup
+
+	<-d.incoming
+	d.outgoing <- []byte("OK\r")
+	<-uiChan // CONNECT
+
+	err = a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKIN","Branch":"fmaj"}`))
+	if err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	<-d.incoming // BEG
+	d.outgoing <- []byte("OK\r")
+
+	sipSrv.Respond("101YNN20140226    161239AO|AB03010824124004|AQfhol|AJHeavy metal in Baghdad|CTfbol|AA2|CS927.8|\r")
+	d.outgoing <- []byte("RDT1003010824124004:NO:02030000|0\r")
+	<-d.incoming // OK1
+	d.outgoing <- []byte("OK\r")
+	<-uiChan
+
+	url := fmt.Sprintf("%s/audit?barcode=03010824124004&from=%s", srv.URL, time.Now().Format("2006-01-02"))
+	if code, _ := adminDo(t, "GET", url, "", ""); code != http.StatusUnauthorized {
+		t.Errorf("GET /audit without token => %d; want 401 Unauthorized", code)
+	}
+	code, body := adminDo(t, "GET", url, testAdminToken, "")
+	if code != http.StatusOK {
+		t.Fatalf("GET /audit => %d %s; want 200 OK", code, body)
+	}
+	var entries []auditEntry
+	if err := json.Unmarshal([]byte(body), &entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("GET /audit => %d entries; want 1", len(entries))
+	}
+	got := entries[0]
+	if got.Time.IsZero() || got.IP == "" || got.Workstation != got.IP {
+		t.Errorf("audit entry missing time, IP or workstation: %+v", got)
+	}
+	got.Time = time.Time{}
+	got.IP, got.Workstation = "", ""
+	want := auditEntry{
+		Action:  "CHECKIN",
+		Branch:  "fmaj",
+		Barcode: "03010824124004",
+		Tag:     "1003010824124004:NO:02030000",
+		SIP:     "ok",
+		Alarm:   "on",
+		Item: item{
+			Label:    "Heavy metal in Baghdad",
+			Barcode:  "03010824124004",
+			Date:     "26/02/2014",
+			Transfer: "fbol",
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %+v; want %+v", got, want)
+	}
+
+	if code, _ := adminDo(t, "GET", url+"&limit=-1", testAdminToken, ""); code != http.StatusBadRequest {
+		t.Errorf("GET /audit?limit=-1 => %d; want 400 Bad Request", code)
+	}
+}
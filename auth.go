@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// tokenLeeway is the clock skew allowed between Koha and the hub when checking
+// the expiry of a token.
+const tokenLeeway = 30 * time.Second
+
+var (
+	errTokenMissing   = errors.New("token missing")
+	errTokenMalformed = errors.New("token malformed")
+	errTokenSignature = errors.New("token signature invalid")
+	errTokenExpired   = errors.New("token expired")
+
+	errWorkstationNotAllowed = errors.New("workstation not allowed by token")
+)
+
+// staff is the authenticated staff user of a UI connection, as given by the
+// token issued by Koha.
+type staff struct {
+	User        string    // Koha user
+	Branch      string    // Branchcode the user is logged in at; empty for all branches
+	Workstation string    // Workstation the token is for; empty for the IP-address of the UI
+	Expires     time.Time // The token, and the UI connection, is not valid after this
+}
+
+// tokenClaims are the claims of a token, which is a JWT signed with HS256:
+//
+//	{"sub": "staffuser", "branch": "hutl", "workstation": "desk1", "exp": 1393843356}
+type tokenClaims struct {
+	Subject     string `json:"sub"`
+	Branch      string `json:"branch"`
+	Workstation string `json:"workstation"`
+	Expires     int64  `json:"exp"` // Unix time
+}
+
+// parseToken verifies the signature and expiry of the token, and returns the
+// staff user it was issued for.
+func parseToken(secret []byte, token string, now time.Time) (staff, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return staff{}, errTokenMalformed
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeTokenPart(parts[0], &header); err != nil {
+		return staff{}, err
+	}
+	if header.Alg != "HS256" {
+		return staff{}, errTokenMalformed
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return staff{}, errTokenMalformed
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return staff{}, errTokenSignature
+	}
+
+	var claims tokenClaims
+	if err := decodeTokenPart(parts[1], &claims); err != nil {
+		return staff{}, err
+	}
+	if claims.Subject == "" || claims.Expires == 0 {
+		return staff{}, errTokenMalformed
+	}
+	s := staff{
+		User:        claims.Subject,
+		Branch:      claims.Branch,
+		Workstation: claims.Workstation,
+		Expires:     time.Unix(claims.Expires, 0),
+	}
+	if now.After(s.Expires.Add(tokenLeeway)) {
+		return staff{}, errTokenExpired
+	}
+	return s, nil
+}
+
+func decodeTokenPart(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return errTokenMalformed
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return errTokenMalformed
+	}
+	return nil
+}
+
+// requestToken returns the token of a websocket handshake, given by the token
+// query parameter, or as a bearer token in the Authorization header.
+func requestToken(r *http.Request) string {
+	if t := r.URL.Query().Get("token"); t != "" {
+		return t
+	}
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		return strings.TrimPrefix(h, "Bearer ")
+	}
+	return ""
+}
+
+// authenticate returns the staff user of a websocket handshake. If no secret
+// is configured, authentication is disabled, and an empty staff user is
+// returned.
+func authenticate(cfg config, r *http.Request, now time.Time) (staff, error) {
+	if cfg.AuthSecret == "" {
+		return staff{}, nil
+	}
+	token := requestToken(r)
+	if token == "" {
+		return staff{}, errTokenMissing
+	}
+	return parseToken([]byte(cfg.AuthSecret), token, now)
+}
+
+// authorizeWorkstation returns the workstation a UI connection from the given
+// IP-address controls, given the workstation it asked for, if any. Without
+// authentication, the UI can name any workstation. Otherwise it is the
+// workstation of the token, or the IP-address of the UI if the token has
+// none, and asking for another workstation is refused.
+func authorizeWorkstation(cfg config, user staff, requested, ip string) (string, error) {
+	if cfg.AuthSecret == "" {
+		if requested == "" {
+			return ip, nil
+		}
+		return requested, nil
+	}
+	workstation := user.Workstation
+	if workstation == "" {
+		workstation = ip
+	}
+	if requested != "" && requested != workstation {
+		return "", errWorkstationNotAllowed
+	}
+	return workstation, nil
+}
+
+// allowedOrigin returns true if the Origin header of the websocket handshake
+// is in the allow-list. All origins are allowed if the list is empty.
+func allowedOrigin(cfg config, r *http.Request) bool {
+	if len(cfg.AllowedOrigins) == 0 {
+		return true
+	}
+	origin := r.Header.Get("Origin")
+	for _, o := range cfg.AllowedOrigins {
+		if origin == o {
+			return true
+		}
+	}
+	return false
+}
+
+// adminAuthorized returns true if the request has the admin token as a bearer
+// token in the Authorization header. The token is not accepted as a query
+// parameter, so that it doesn't end up in access logs.
+func adminAuthorized(cfg config, r *http.Request) bool {
+	h := r.Header.Get("Authorization")
+	if cfg.AdminToken == "" || !strings.HasPrefix(h, "Bearer ") {
+		return false
+	}
+	token := strings.TrimPrefix(h, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(cfg.AdminToken)) == 1
+}
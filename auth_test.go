@@ -0,0 +1,207 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const testSecret = "0123456789abcdef"
+
+// signToken returns a token for the staff user, signed with the secret, as
+// Koha would make it.
+func signToken(secret string, s staff) string {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+	b, _ := json.Marshal(tokenClaims{Subject: s.User, Branch: s.Branch, Workstation: s.Workstation,
+		Expires: s.Expires.Unix()})
+	claims := base64.RawURLEncoding.EncodeToString(b)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(header + "." + claims))
+	return header + "." + claims + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestParseToken(t *testing.T) {
+	now := time.Unix(1393843356, 0)
+	valid := staff{User: "kari", Branch: "hutl", Workstation: "desk1", Expires: now.Add(time.Hour)}
+	token := signToken(testSecret, valid)
+	parts := strings.Split(token, ".")
+	none := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`))
+
+	tests := []struct {
+		token string
+		want  staff
+		err   error
+	}{
+		{token, valid, nil},
+		{signToken("another secret!!", valid), staff{}, errTokenSignature},
+		{parts[0] + "." + parts[1] + ".", staff{}, errTokenSignature},
+		{none + "." + parts[1] + "." + parts[2], staff{}, errTokenMalformed},
+		{parts[0] + "." + parts[1], staff{}, errTokenMalformed},
+		{"not a token", staff{}, errTokenMalformed},
+		{signToken(testSecret, staff{Branch: "hutl", Expires: valid.Expires}), staff{}, errTokenMalformed},
+		{signToken(testSecret, staff{User: "kari", Expires: now.Add(-time.Hour)}), staff{}, errTokenExpired},
+		// Within the leeway:
+		{signToken(testSecret, staff{User: "kari", Expires: now.Add(-time.Second)}),
+			staff{User: "kari", Expires: now.Add(-time.Second)}, nil},
+	}
+	for _, tt := range tests {
+		got, err := parseToken([]byte(testSecret), tt.token, now)
+		if err != tt.err || got != tt.want {
+			t.Errorf("parseToken(%q) => %+v, %v; want %+v, %v", tt.token, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestAuthorizeWorkstation(t *testing.T) {
+	open := config{}
+	auth := config{AuthSecret: testSecret}
+	tests := []struct {
+		cfg       config
+		user      staff
+		requested string
+		want      string
+		err       error
+	}{
+		{open, staff{}, "", "10.0.0.1", nil},
+		{open, staff{}, "desk2", "desk2", nil},
+		{auth, staff{User: "kari"}, "", "10.0.0.1", nil},
+		{auth, staff{User: "kari"}, "10.0.0.1", "10.0.0.1", nil},
+		{auth, staff{User: "kari"}, "desk2", "", errWorkstationNotAllowed},
+		{auth, staff{User: "kari", Workstation: "desk1"}, "", "desk1", nil},
+		{auth, staff{User: "kari", Workstation: "desk1"}, "desk1", "desk1", nil},
+		{auth, staff{User: "kari", Workstation: "desk1"}, "desk2", "", errWorkstationNotAllowed},
+	}
+	for _, tt := range tests {
+		got, err := authorizeWorkstation(tt.cfg, tt.user, tt.requested, "10.0.0.1")
+		if got != tt.want || err != tt.err {
+			t.Errorf("authorizeWorkstation(%+v, %q) => %q, %v; want %q, %v", tt.user, tt.requested, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestWebsocketAuth(t *testing.T) {
+	// Setup: ->
+
+	dir, err := ioutil.TempDir("", "rfidhub-auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	uiChan := make(chan UIMsg)
+	sipSrv := newSIPTestServer()
+	defer sipSrv.Close()
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	d := newDummyRFIDReader()
+	defer d.Close()
+
+	hub = newHub(config{
+		HTTPPort:          port(srv.URL),
+		SIPServer:         sipSrv.Addr(),
+		TCPPort:           port(d.addr()),
+		NumSIPConnections: 1,
+		AuditLog:          filepath.Join(dir, "audit.log"),
+		AuthSecret:        testSecret,
+		AllowedOrigins:    []string{"https://koha.example.org"},
+	})
+	go hub.run()
+	defer hub.Close()
+
+	url := fmt.Sprintf("ws://localhost:%s/ws", port(srv.URL))
+	origin := http.Header{"Origin": {"https://koha.example.org"}}
+	token := signToken(testSecret, staff{User: "kari", Branch: "hutl", Expires: time.Now().Add(time.Hour)})
+	expired := signToken(testSecret, staff{User: "kari", Expires: time.Now().Add(-time.Hour)})
+
+	// <- end setup
+
+	// Handshakes without a valid token, or from other origins, are refused
+	refused := []struct {
+		url    string
+		header http.Header
+		status int
+	}{
+		{url, origin, http.StatusUnauthorized},
+		{url + "?token=" + expired, origin, http.StatusUnauthorized},
+		{url + "?token=" + token, nil, http.StatusForbidden},
+		{url + "?token=" + token, http.Header{"Origin": {"https://evil.example.org"}}, http.StatusForbidden},
+		// The token is not for that workstation:
+		{url + "?workstation=desk2&token=" + token, origin, http.StatusForbidden},
+	}
+	for _, tt := range refused {
+		_, resp, err := websocket.DefaultDialer.Dial(tt.url, tt.header)
+		if err == nil || resp == nil || resp.StatusCode != tt.status {
+			t.Errorf("Dial(%q, %v) => %v, %v; want status %d", tt.url, tt.header, resp, err, tt.status)
+		}
+	}
+
+	// The token can also be given in the Authorization header
+	header := http.Header{"Origin": {"https://koha.example.org"}, "Authorization": {"Bearer " + token}}
+	ws, _, err := websocket.DefaultDialer.Dial(url, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &dummyUIAgent{c: ws, msg: uiChan}
+	go a.run()
+	defer a.c.Close()
+
+	<-d.incoming
+	d.outgoing <- []byte("OK\r")
+	<-uiChan // CONNECT
+
+	// Another staff user cannot take over the workstation while it is in use
+	other := signToken(testSecret, staff{User: "ola", Expires: time.Now().Add(time.Hour)})
+	if _, resp, err := websocket.DefaultDialer.Dial(url+"?token="+other, origin); err == nil || resp == nil || resp.StatusCode != http.StatusConflict {
+		t.Errorf("Dial as another staff user => %v, %v; want status %d", resp, err, http.StatusConflict)
+	}
+
+	// Staff can only work at the branch of the token
+	err = a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKIN","Branch":"fmaj"}`))
+	if err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	uiMsg := <-uiChan
+	if !uiMsg.UserError || uiMsg.ErrorCode != msgBranchNotAllowed {
+		t.Errorf("Got %+v; want UserError with ErrorCode %v", uiMsg, msgBranchNotAllowed)
+	}
+
+	// The branch of the token is used if none is given, and the staff user
+	// is recorded in the audit log
+	err = a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKIN"}`))
+	if err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	<-d.incoming // BEG
+	d.outgoing <- []byte("OK\r")
+
+	sipSrv.Respond("101YNN20140226    161239AO|AB03010824124004|AQhutl|AJHeavy metal in Baghdad|AA2|CS927.8|\r")
+	d.outgoing <- []byte("RDT1003010824124004:NO:02030000|0\r")
+	<-d.incoming // OK1
+	d.outgoing <- []byte("OK\r")
+	<-uiChan
+
+	if reqs := sipSrv.Requests(); len(reqs) == 0 || !strings.Contains(reqs[len(reqs)-1], "|AOhutl|") {
+		t.Errorf("SIP-server got %q; want checkin at branch hutl", reqs)
+	}
+	entries, _, err := audit.Query(auditQuery{Barcode: "03010824124004"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Staff != "kari" || entries[0].Branch != "hutl" {
+		t.Errorf("Got audit entries %+v; want checkin by kari at hutl", entries)
+	}
+}
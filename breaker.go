@@ -0,0 +1,172 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// errSIPUnavailable is returned by DoSIPCall without contacting the SIP-server,
+// while the circuit breaker is open.
+var errSIPUnavailable = errors.New("SIP-server unavailable")
+
+// breakerState is the state of a circuitBreaker.
+type breakerState uint8
+
+const (
+	breakerClosed   breakerState = iota // requests are let through
+	breakerOpen                         // requests fail fast
+	breakerHalfOpen                     // requests fail fast, while probing
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerClosed:
+		return "closed"
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// circuitBreaker guards the SIP-server against requests while it is
+// unavailable. It trips (opens) after threshold consecutive failed requests.
+// While open, requests fail fast with errSIPUnavailable. After cooldown, it
+// goes half-open and calls probe; if the probe succeeds, the breaker closes,
+// otherwise it opens again for another cooldown.
+//
+// changed is signalled, without blocking, whenever the breaker trips or closes.
+//
+// A nil *circuitBreaker is a disabled circuit breaker, which lets all
+// requests through.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	probe     func() error
+	changed   chan struct{}
+	stop      chan struct{}
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int // consecutive failures while closed
+}
+
+// newCircuitBreaker returns a closed circuit breaker.
+func newCircuitBreaker(threshold int, cooldown time.Duration, probe func() error) *circuitBreaker {
+	return &circuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		probe:     probe,
+		changed:   make(chan struct{}, 1),
+		stop:      make(chan struct{}),
+	}
+}
+
+// Allow returns errSIPUnavailable if requests should not be attempted.
+func (b *circuitBreaker) Allow() error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state != breakerClosed {
+		return errSIPUnavailable
+	}
+	return nil
+}
+
+// Done reports the outcome of a request let through by Allow.
+func (b *circuitBreaker) Done(err error) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state != breakerClosed {
+		// Request started before the breaker tripped
+		return
+	}
+	if err == nil {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures < b.threshold {
+		return
+	}
+	log.Printf("WARN: SIP circuit breaker open after %d failed requests", b.failures)
+	b.state = breakerOpen
+	b.failures = 0
+	status.SIPCircuitTrips.Inc(1)
+	b.notify()
+	go b.recover()
+}
+
+// recover waits for the cooldown and probes the SIP-server, until it
+// responds or the breaker is closed down.
+func (b *circuitBreaker) recover() {
+	for {
+		select {
+		case <-time.After(b.cooldown):
+		case <-b.stop:
+			return
+		}
+
+		b.mu.Lock()
+		b.state = breakerHalfOpen
+		b.mu.Unlock()
+
+		err := b.probe()
+
+		b.mu.Lock()
+		if err == nil {
+			log.Println("SIP circuit breaker closed; SIP-server available again")
+			b.state = breakerClosed
+			b.notify()
+			b.mu.Unlock()
+			return
+		}
+		log.Printf("WARN: SIP circuit breaker probe failed: %v", err)
+		b.state = breakerOpen
+		b.mu.Unlock()
+	}
+}
+
+// notify signals a change of availability, unless a signal is allready
+// pending. The caller must hold b.mu.
+func (b *circuitBreaker) notify() {
+	select {
+	case b.changed <- struct{}{}:
+	default:
+	}
+}
+
+// State returns the current state of the breaker.
+func (b *circuitBreaker) State() breakerState {
+	if b == nil {
+		return breakerClosed
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// Changed returns a channel which is signalled when the breaker trips or
+// closes. It is nil, and thus never signalled, for a disabled breaker.
+func (b *circuitBreaker) Changed() <-chan struct{} {
+	if b == nil {
+		return nil
+	}
+	return b.changed
+}
+
+// Close stops any probing of the SIP-server.
+func (b *circuitBreaker) Close() {
+	if b == nil {
+		return
+	}
+	close(b.stop)
+}
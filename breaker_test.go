@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	var mu sync.Mutex
+	probeErr := errors.New("connection refused")
+	probe := func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		return probeErr
+	}
+	b := newCircuitBreaker(2, 10*time.Millisecond, probe)
+	defer b.Close()
+
+	failed := errors.New("EOF")
+
+	// Successful requests resets the count of failures:
+	b.Done(failed)
+	b.Done(nil)
+	b.Done(failed)
+	if got := b.State(); got != breakerClosed {
+		t.Fatalf("after non-consecutive failures: State() => %v; want closed", got)
+	}
+	if err := b.Allow(); err != nil {
+		t.Fatalf("closed breaker: Allow() => %v; want nil", err)
+	}
+
+	// Trips on the second consecutive failure:
+	b.Done(failed)
+	if got := b.State(); got != breakerOpen {
+		t.Fatalf("after 2 failures: State() => %v; want open", got)
+	}
+	if err := b.Allow(); err != errSIPUnavailable {
+		t.Errorf("open breaker: Allow() => %v; want %v", err, errSIPUnavailable)
+	}
+	select {
+	case <-b.Changed():
+	case <-time.After(time.Second):
+		t.Fatal("breaker didn't signal when tripped")
+	}
+
+	// Stays open while the probe fails:
+	time.Sleep(50 * time.Millisecond)
+	if got := b.State(); got == breakerClosed {
+		t.Fatalf("failing probe: State() => %v; want open or half-open", got)
+	}
+
+	// Closes when the probe succeeds:
+	mu.Lock()
+	probeErr = nil
+	mu.Unlock()
+	select {
+	case <-b.Changed():
+	case <-time.After(time.Second):
+		t.Fatal("breaker didn't signal when closed")
+	}
+	if got := b.State(); got != breakerClosed {
+		t.Fatalf("after successful probe: State() => %v; want closed", got)
+	}
+	if err := b.Allow(); err != nil {
+		t.Errorf("closed breaker: Allow() => %v; want nil", err)
+	}
+
+	// A nil breaker is disabled:
+	var disabled *circuitBreaker
+	disabled.Done(failed)
+	if err := disabled.Allow(); err != nil {
+		t.Errorf("disabled breaker: Allow() => %v; want nil", err)
+	}
+}
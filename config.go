@@ -1,21 +1,884 @@
 package main
 
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// config holds the configuration of the RFID-hub. It is read from a JSON file,
+// where the keys are the field names below. Settings can be overridden by
+// environment variables, see loadEnv.
 type config struct {
 	// Port which RFID-unit is listening on
 	// TODO rename
 	TCPPort string
 
+	// Interval between attempts to (re)connect to a RFID-unit. It is doubled
+	// after each failed attempt, up to the maximum.
+	RFIDReconnectMin duration
+	RFIDReconnectMax duration
+
+	// Time to wait for the RFID-unit to respond to a command, before giving
+	// up and trying to recover the RFID-unit. It can be overridden for
+	// individual states of the RFID-unit state-machine, eg.
+	// {"UNITWriting": "1m"}. A timeout of 0 waits forever.
+	RFIDTimeout  duration
+	RFIDTimeouts map[string]duration
+
 	// Listening Port of the HTTP and WebSocket server
 	HTTPPort string
 
+	// Serve HTTPS and secure websockets (wss) at HTTPPort, with the
+	// certificate and key (PEM) in HTTPTLSCert and HTTPTLSKey. The files are
+	// checked for changes at most every HTTPTLSReload, and reloaded when
+	// changed (0: never). Plain HTTP requests to HTTPRedirectPort are
+	// redirected to HTTPS, if given.
+	HTTPTLSCert      string
+	HTTPTLSKey       string
+	HTTPTLSReload    duration
+	HTTPRedirectPort string
+
+	// Use the X-Forwarded-For header to find the IP-address of websocket
+	// clients. Only enable this when the hub is behind a trusted reverse proxy.
+	TrustForwardedFor bool
+
+	// Default language of the statuses sent to the UI, eg. "nb" or "en". The
+	// UI can choose another with the lang query parameter, or in CONNECT.
+	Language string
+
+	// Secret shared with Koha, for verifying the tokens which the UI must
+	// give when connecting to /ws. Anyone can connect if empty.
+	AuthSecret string
+
+	// Origins allowed to connect to /ws, eg. "https://koha.example.org". All
+	// origins are allowed if empty.
+	AllowedOrigins []string
+
+	// IP-addresses allowed to connect to /ws as observers, with the
+	// workstation each of them can follow, or "*" for all workstations, eg.
+	// {"10.172.2.40": "desk1"}. Observers are refused if empty.
+	Observers map[string]string
+
+	// Time to keep the session of a workstation after its last request, so
+	// that the UI can restore it with RESUME when the page is reloaded (0:
+	// sessions are not kept).
+	SessionExpiry duration
+
+	// RFID-units, keyed by workstation identifier or IP-address. Workstations
+	// not listed are assumed to have a RFID-unit on the same IP-address as
+	// the websocket connection, listening on TCPPort.
+	Units map[string]unitConfig
+
+	// Name of the RFID-vendor to use for RFID-units which doesn't specify one
+	Vendor string
+
+	// Library parameters to use when writing RFID-tags, for branches which
+	// doesn't specify their own
+	TagParams tagParams
+
+	// Templates for receipts and slips, for branches which doesn't specify
+	// their own
+	Templates templateFiles
+
+	// Branch specific settings, keyed by branchcode
+	Branches map[string]branchConfig
+
 	// Adress (host:port) of SIP-server
 	SIPServer string
 
+	// Connect to the SIP-server with TLS. The server certificate is verified
+	// against the CA bundle (PEM) in SIPTLSCA, or the system roots if empty,
+	// and must be valid for SIPTLSServerName, or the host of SIPServer if
+	// empty. A client certificate and key (PEM) can be given for SIP-servers
+	// which require one.
+	SIPTLS           bool
+	SIPTLSCA         string
+	SIPTLSCert       string
+	SIPTLSKey        string
+	SIPTLSServerName string
+
 	// Credentials for SIP user to use in rfid-hub
 	SIPUser string
 	SIPPass string
 	SIPDept string
 
-	// Number of SIP-connections to keep in the pool
+	// Maximum and minimum number of idle SIP-connections to keep in the pool
 	NumSIPConnections int
+	SIPConnsMin       int
+
+	// Interval between health checks of the idle SIP-connections, where
+	// they are probed with a SC Status request, and dead connections are
+	// replaced (0: never). Connections idle for longer than SIPIdleTimeout
+	// are closed, as long as at least SIPConnsMin are kept (0: never).
+	SIPKeepalive   duration
+	SIPIdleTimeout duration
+
+	// Time allowed for connecting and logging in to the SIP-server, and for
+	// each read and write on a SIP-connection. A timeout of 0 waits forever.
+	SIPConnectTimeout duration
+	SIPReadTimeout    duration
+	SIPWriteTimeout   duration
+
+	// Use SIP2 error detection: send sequence numbers and checksums with all
+	// requests, and verify the checksums of the responses.
+	SIPErrorDetection bool
+
+	// Number of consecutive failed SIP requests before requests are suspended
+	// (0: never), and the time to wait before probing the SIP-server with a
+	// SC Status request, to see if requests can be resumed.
+	SIPBreakerThreshold int
+	SIPBreakerCooldown  duration
+
+	// Path of the offline queue, where checkins are stored while the
+	// SIP-server is unavailable, and the interval between attempts to send
+	// them to Koha. Checkins fail while the SIP-server is unavailable if
+	// empty.
+	OfflineQueue          string
+	OfflineReplayInterval duration
+
+	// Path of the audit log, where all checkins and checkouts are recorded.
+	// The audit log is disabled if empty.
+	AuditLog string
+
+	// Size in megabytes at which the audit log is rotated (0: never), and
+	// the number of rotated files to keep.
+	AuditLogMaxSize int
+	AuditLogBackups int
+
+	// Token which must be given as "Authorization: Bearer <token>" to use the
+	// admin API, like /audit. The admin API is disabled if empty.
+	AdminToken string
+}
+
+// duration is a time.Duration which is read from the configuration file as a
+// string, eg. "1m30s".
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
+func (d duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// defaultConfig returns the configuration used for settings not given in the
+// configuration file or environment.
+func defaultConfig() config {
+	return config{
+		TCPPort:          "6005",
+		RFIDReconnectMin: duration{time.Second},
+		RFIDReconnectMax: duration{time.Minute},
+		RFIDTimeout:      duration{10 * time.Second},
+		RFIDTimeouts: map[string]duration{
+			"UNITWriting": {30 * time.Second},
+		},
+		HTTPPort:              "8899",
+		HTTPTLSReload:         duration{time.Minute},
+		Language:              defaultLanguage,
+		SessionExpiry:         duration{10 * time.Minute},
+		Vendor:                "deichman",
+		SIPServer:             "localhost:6001",
+		SIPUser:               "autouser",
+		SIPPass:               "autopass",
+		NumSIPConnections:     3,
+		SIPConnsMin:           1,
+		SIPKeepalive:          duration{time.Minute},
+		SIPIdleTimeout:        duration{10 * time.Minute},
+		SIPConnectTimeout:     duration{5 * time.Second},
+		SIPReadTimeout:        duration{10 * time.Second},
+		SIPWriteTimeout:       duration{5 * time.Second},
+		SIPBreakerThreshold:   5,
+		SIPBreakerCooldown:    duration{30 * time.Second},
+		OfflineReplayInterval: duration{time.Minute},
+		AuditLogMaxSize:       100,
+		AuditLogBackups:       10,
+	}
+}
+
+// loadConfig returns the default configuration, overridden by the settings in
+// the given JSON file (if path is not empty) and then by environment
+// variables. The resulting configuration is validated.
+func loadConfig(path string) (config, error) {
+	cfg := defaultConfig()
+
+	if path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return cfg, err
+		}
+		defer f.Close()
+		dec := json.NewDecoder(f)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&cfg); err != nil {
+			return cfg, fmt.Errorf("cannot parse configuration file %v: %v", path, err)
+		}
+	}
+
+	if err := cfg.loadEnv(); err != nil {
+		return cfg, err
+	}
+
+	return cfg, cfg.validate()
+}
+
+// loadEnv overrides the configuration with environment variables:
+//
+//	TCP_PORT, RFID_RECONNECT_MIN, RFID_RECONNECT_MAX, RFID_TIMEOUT,
+//	HTTP_PORT, HTTP_TLS_CERT, HTTP_TLS_KEY, HTTP_TLS_RELOAD,
+//	HTTP_REDIRECT_PORT, TRUST_FORWARDED_FOR, LANGUAGE, AUTH_SECRET,
+//	ALLOWED_ORIGINS, OBSERVERS, SESSION_EXPIRY, RFID_UNITS, RFID_PRINTERS,
+//	RFID_VENDOR, TAG_LIBRARY_NUMBER, TAG_COUNTRY_CODE,
+//	BRANCH_LIBRARY_NUMBERS, RECEIPT_TEMPLATE, RECEIPT_TEMPLATE_HTML,
+//	HOLD_SLIP_TEMPLATE, HOLD_SLIP_TEMPLATE_HTML, TRANSIT_SLIP_TEMPLATE,
+//	TRANSIT_SLIP_TEMPLATE_HTML, SIP_SERVER, SIP_TLS, SIP_TLS_CA,
+//	SIP_TLS_CERT, SIP_TLS_KEY, SIP_TLS_SERVER_NAME, SIP_USER, SIP_PASS,
+//	SIP_DEPT, SIP_CONNS, SIP_CONNS_MIN, SIP_KEEPALIVE, SIP_IDLE_TIMEOUT,
+//	SIP_CONNECT_TIMEOUT, SIP_READ_TIMEOUT, SIP_WRITE_TIMEOUT,
+//	SIP_ERROR_DETECTION, SIP_BREAKER_THRESHOLD, SIP_BREAKER_COOLDOWN,
+//	OFFLINE_QUEUE, OFFLINE_REPLAY_INTERVAL, AUDIT_LOG,
+//	AUDIT_LOG_MAX_SIZE, AUDIT_LOG_BACKUPS, ADMIN_TOKEN
+func (cfg *config) loadEnv() error {
+	var err error
+	str := func(name string, dst *string) {
+		if v := os.Getenv(name); v != "" {
+			*dst = v
+		}
+	}
+	dur := func(name string, dst *duration) {
+		if v := os.Getenv(name); v != "" && err == nil {
+			if dst.Duration, err = time.ParseDuration(v); err != nil {
+				err = fmt.Errorf("%v: %v", name, err)
+			}
+		}
+	}
+	num := func(name string, dst *int) {
+		if v := os.Getenv(name); v != "" && err == nil {
+			if *dst, err = strconv.Atoi(v); err != nil {
+				err = fmt.Errorf("%v: %v", name, err)
+			}
+		}
+	}
+
+	str("TCP_PORT", &cfg.TCPPort)
+	dur("RFID_RECONNECT_MIN", &cfg.RFIDReconnectMin)
+	dur("RFID_RECONNECT_MAX", &cfg.RFIDReconnectMax)
+	dur("RFID_TIMEOUT", &cfg.RFIDTimeout)
+	str("HTTP_PORT", &cfg.HTTPPort)
+	str("HTTP_TLS_CERT", &cfg.HTTPTLSCert)
+	str("HTTP_TLS_KEY", &cfg.HTTPTLSKey)
+	dur("HTTP_TLS_RELOAD", &cfg.HTTPTLSReload)
+	str("HTTP_REDIRECT_PORT", &cfg.HTTPRedirectPort)
+	str("LANGUAGE", &cfg.Language)
+	str("AUTH_SECRET", &cfg.AuthSecret)
+	dur("SESSION_EXPIRY", &cfg.SessionExpiry)
+	str("RFID_VENDOR", &cfg.Vendor)
+	str("TAG_LIBRARY_NUMBER", &cfg.TagParams.LibraryNumber)
+	str("TAG_COUNTRY_CODE", &cfg.TagParams.CountryCode)
+	str("RECEIPT_TEMPLATE", &cfg.Templates.Receipt)
+	str("RECEIPT_TEMPLATE_HTML", &cfg.Templates.ReceiptHTML)
+	str("HOLD_SLIP_TEMPLATE", &cfg.Templates.HoldSlip)
+	str("HOLD_SLIP_TEMPLATE_HTML", &cfg.Templates.HoldSlipHTML)
+	str("TRANSIT_SLIP_TEMPLATE", &cfg.Templates.TransitSlip)
+	str("TRANSIT_SLIP_TEMPLATE_HTML", &cfg.Templates.TransitSlipHTML)
+	str("SIP_SERVER", &cfg.SIPServer)
+	str("SIP_TLS_CA", &cfg.SIPTLSCA)
+	str("SIP_TLS_CERT", &cfg.SIPTLSCert)
+	str("SIP_TLS_KEY", &cfg.SIPTLSKey)
+	str("SIP_TLS_SERVER_NAME", &cfg.SIPTLSServerName)
+	str("SIP_USER", &cfg.SIPUser)
+	str("SIP_PASS", &cfg.SIPPass)
+	str("SIP_DEPT", &cfg.SIPDept)
+	num("SIP_CONNS", &cfg.NumSIPConnections)
+	num("SIP_CONNS_MIN", &cfg.SIPConnsMin)
+	dur("SIP_KEEPALIVE", &cfg.SIPKeepalive)
+	dur("SIP_IDLE_TIMEOUT", &cfg.SIPIdleTimeout)
+	dur("SIP_CONNECT_TIMEOUT", &cfg.SIPConnectTimeout)
+	dur("SIP_READ_TIMEOUT", &cfg.SIPReadTimeout)
+	dur("SIP_WRITE_TIMEOUT", &cfg.SIPWriteTimeout)
+	num("SIP_BREAKER_THRESHOLD", &cfg.SIPBreakerThreshold)
+	dur("SIP_BREAKER_COOLDOWN", &cfg.SIPBreakerCooldown)
+	str("OFFLINE_QUEUE", &cfg.OfflineQueue)
+	dur("OFFLINE_REPLAY_INTERVAL", &cfg.OfflineReplayInterval)
+	str("AUDIT_LOG", &cfg.AuditLog)
+	num("AUDIT_LOG_MAX_SIZE", &cfg.AuditLogMaxSize)
+	num("AUDIT_LOG_BACKUPS", &cfg.AuditLogBackups)
+	str("ADMIN_TOKEN", &cfg.AdminToken)
+	if err != nil {
+		return err
+	}
+
+	if v := os.Getenv("TRUST_FORWARDED_FOR"); v != "" {
+		if cfg.TrustForwardedFor, err = strconv.ParseBool(v); err != nil {
+			return fmt.Errorf("TRUST_FORWARDED_FOR: %v", err)
+		}
+	}
+	if v := os.Getenv("ALLOWED_ORIGINS"); v != "" {
+		cfg.AllowedOrigins = strings.Split(v, ",")
+	}
+	if v := os.Getenv("OBSERVERS"); v != "" {
+		if cfg.Observers, err = parseKeyValues(v); err != nil {
+			return fmt.Errorf("OBSERVERS: %v", err)
+		}
+	}
+	if v := os.Getenv("SIP_TLS"); v != "" {
+		if cfg.SIPTLS, err = strconv.ParseBool(v); err != nil {
+			return fmt.Errorf("SIP_TLS: %v", err)
+		}
+	}
+	if v := os.Getenv("SIP_ERROR_DETECTION"); v != "" {
+		if cfg.SIPErrorDetection, err = strconv.ParseBool(v); err != nil {
+			return fmt.Errorf("SIP_ERROR_DETECTION: %v", err)
+		}
+	}
+	if v := os.Getenv("RFID_UNITS"); v != "" {
+		units, err := parseUnits(v)
+		if err != nil {
+			return fmt.Errorf("RFID_UNITS: %v", err)
+		}
+		if cfg.Units == nil {
+			cfg.Units = make(map[string]unitConfig)
+		}
+		for k, u := range units {
+			cfg.Units[k] = u
+		}
+	}
+	if v := os.Getenv("BRANCH_LIBRARY_NUMBERS"); v != "" {
+		lbns, err := parseKeyValues(v)
+		if err != nil {
+			return fmt.Errorf("BRANCH_LIBRARY_NUMBERS: %v", err)
+		}
+		if cfg.Branches == nil {
+			cfg.Branches = make(map[string]branchConfig)
+		}
+		for branch, lbn := range lbns {
+			b := cfg.Branches[branch]
+			b.TagParams.LibraryNumber = lbn
+			cfg.Branches[branch] = b
+		}
+	}
+	if v := os.Getenv("RFID_PRINTERS"); v != "" {
+		printers, err := parseKeyValues(v)
+		if err != nil {
+			return fmt.Errorf("RFID_PRINTERS: %v", err)
+		}
+		if cfg.Units == nil {
+			cfg.Units = make(map[string]unitConfig)
+		}
+		for k, addr := range printers {
+			u := cfg.Units[k]
+			u.Printer = addr
+			cfg.Units[k] = u
+		}
+	}
+	return nil
+}
+
+// validate checks the configuration, and returns an error listing all
+// problems found.
+func (cfg config) validate() error {
+	var errs []string
+	fail := func(format string, a ...interface{}) {
+		errs = append(errs, fmt.Sprintf(format, a...))
+	}
+
+	if !validPort(cfg.TCPPort) {
+		fail("TCPPort: invalid port %q", cfg.TCPPort)
+	}
+	if !validPort(cfg.HTTPPort) {
+		fail("HTTPPort: invalid port %q", cfg.HTTPPort)
+	}
+	if (cfg.HTTPTLSCert == "") != (cfg.HTTPTLSKey == "") {
+		fail("HTTPTLSCert, HTTPTLSKey: both or none must be given")
+	} else if cfg.HTTPTLSCert != "" {
+		if _, err := tls.LoadX509KeyPair(cfg.HTTPTLSCert, cfg.HTTPTLSKey); err != nil {
+			fail("HTTPTLSCert: %v", err)
+		}
+	}
+	if cfg.HTTPTLSReload.Duration < 0 {
+		fail("HTTPTLSReload: must not be negative, got %v", cfg.HTTPTLSReload)
+	}
+	if cfg.HTTPRedirectPort != "" {
+		if !validPort(cfg.HTTPRedirectPort) || cfg.HTTPRedirectPort == cfg.HTTPPort {
+			fail("HTTPRedirectPort: invalid port %q", cfg.HTTPRedirectPort)
+		} else if cfg.HTTPTLSCert == "" {
+			fail("HTTPRedirectPort: HTTPTLSCert must be given")
+		}
+	}
+	if !validLanguage(cfg.Language) {
+		fail("Language: no messages for %q", cfg.Language)
+	}
+	if cfg.AuthSecret != "" && len(cfg.AuthSecret) < 16 {
+		fail("AuthSecret: must be at least 16 characters")
+	}
+	if cfg.SessionExpiry.Duration < 0 {
+		fail("SessionExpiry: must not be negative, got %v", cfg.SessionExpiry)
+	}
+	for _, o := range cfg.AllowedOrigins {
+		if !validOrigin(o) {
+			fail("AllowedOrigins: invalid origin %q, must be scheme://host[:port]", o)
+		}
+	}
+	for ip := range cfg.Observers {
+		if net.ParseIP(ip) == nil {
+			fail("Observers: invalid IP-address %q", ip)
+		}
+	}
+	if cfg.RFIDReconnectMin.Duration <= 0 {
+		fail("RFIDReconnectMin: must be positive, got %v", cfg.RFIDReconnectMin)
+	}
+	if cfg.RFIDReconnectMax.Duration < cfg.RFIDReconnectMin.Duration {
+		fail("RFIDReconnectMax: must not be less than RFIDReconnectMin, got %v", cfg.RFIDReconnectMax)
+	}
+	if cfg.RFIDTimeout.Duration < 0 {
+		fail("RFIDTimeout: must not be negative, got %v", cfg.RFIDTimeout)
+	}
+	for k, d := range cfg.RFIDTimeouts {
+		if !validUnitState(k) {
+			fail("RFIDTimeouts[%v]: unknown state", k)
+		} else if d.Duration < 0 {
+			fail("RFIDTimeouts[%v]: must not be negative, got %v", k, d)
+		}
+	}
+	if err := cfg.checkVendors(); err != nil {
+		fail("Vendor: %v", err)
+	}
+	for k, u := range cfg.Units {
+		if !validAddr(u.Addr) {
+			fail("Units[%v]: invalid adress %q", k, u.Addr)
+		}
+		if !validAddr(u.Printer) {
+			fail("Units[%v].Printer: invalid adress %q", k, u.Printer)
+		}
+	}
+	if err := cfg.TagParams.validate(); err != nil {
+		fail("TagParams: %v", err)
+	}
+	for k, b := range cfg.Branches {
+		if err := b.TagParams.validate(); err != nil {
+			fail("Branches[%v].TagParams: %v", k, err)
+		}
+		if err := b.Templates.validate(); err != nil {
+			fail("Branches[%v].Templates: %v", k, err)
+		}
+	}
+	if err := cfg.Templates.validate(); err != nil {
+		fail("Templates: %v", err)
+	}
+	if _, port, err := net.SplitHostPort(cfg.SIPServer); err != nil || !validPort(port) {
+		fail("SIPServer: invalid adress %q, must be host:port", cfg.SIPServer)
+	}
+	if cfg.SIPTLS {
+		if (cfg.SIPTLSCert == "") != (cfg.SIPTLSKey == "") {
+			fail("SIPTLSCert, SIPTLSKey: both or none must be given")
+		} else if _, err := sipTLSConfig(cfg); err != nil {
+			fail("SIPTLS: %v", err)
+		}
+	} else if cfg.SIPTLSCA != "" || cfg.SIPTLSCert != "" || cfg.SIPTLSKey != "" ||
+		cfg.SIPTLSServerName != "" {
+		fail("SIPTLS: must be true when TLS settings are given")
+	}
+	if cfg.SIPUser == "" {
+		fail("SIPUser: missing")
+	}
+	if cfg.NumSIPConnections < 1 {
+		fail("NumSIPConnections: must be at least 1, got %d", cfg.NumSIPConnections)
+	}
+	if cfg.SIPConnsMin < 0 || cfg.SIPConnsMin > cfg.NumSIPConnections {
+		fail("SIPConnsMin: must be between 0 and NumSIPConnections, got %d", cfg.SIPConnsMin)
+	}
+	if cfg.SIPKeepalive.Duration < 0 {
+		fail("SIPKeepalive: must not be negative, got %v", cfg.SIPKeepalive)
+	}
+	if cfg.SIPIdleTimeout.Duration < 0 {
+		fail("SIPIdleTimeout: must not be negative, got %v", cfg.SIPIdleTimeout)
+	}
+	if cfg.SIPConnectTimeout.Duration < 0 {
+		fail("SIPConnectTimeout: must not be negative, got %v", cfg.SIPConnectTimeout)
+	}
+	if cfg.SIPReadTimeout.Duration < 0 {
+		fail("SIPReadTimeout: must not be negative, got %v", cfg.SIPReadTimeout)
+	}
+	if cfg.SIPWriteTimeout.Duration < 0 {
+		fail("SIPWriteTimeout: must not be negative, got %v", cfg.SIPWriteTimeout)
+	}
+	if cfg.SIPBreakerThreshold < 0 {
+		fail("SIPBreakerThreshold: must not be negative, got %d", cfg.SIPBreakerThreshold)
+	}
+	if cfg.SIPBreakerThreshold > 0 && cfg.SIPBreakerCooldown.Duration <= 0 {
+		fail("SIPBreakerCooldown: must be positive, got %v", cfg.SIPBreakerCooldown)
+	}
+	if cfg.OfflineQueue != "" && cfg.OfflineReplayInterval.Duration <= 0 {
+		fail("OfflineReplayInterval: must be positive, got %v", cfg.OfflineReplayInterval)
+	}
+	if cfg.AuditLogMaxSize < 0 {
+		fail("AuditLogMaxSize: must not be negative, got %d", cfg.AuditLogMaxSize)
+	}
+	if cfg.AuditLogBackups < 0 {
+		fail("AuditLogBackups: must not be negative, got %d", cfg.AuditLogBackups)
+	}
+	if cfg.AdminToken != "" && len(cfg.AdminToken) < 16 {
+		fail("AdminToken: must be at least 16 characters")
+	}
+
+	if len(errs) > 0 {
+		return errors.New("invalid configuration:\n\t" + strings.Join(errs, "\n\t"))
+	}
+	return nil
+}
+
+// validPort returns true if s is a valid TCP port number.
+func validPort(s string) bool {
+	n, err := strconv.Atoi(s)
+	return err == nil && n > 0 && n < 65536
+}
+
+// validAddr returns true if s is empty, or a valid host or host:port adress.
+func validAddr(s string) bool {
+	if host, port, err := net.SplitHostPort(s); err == nil {
+		return host != "" && validPort(port)
+	}
+	return !strings.Contains(s, ":")
+}
+
+// validOrigin returns true if s is an origin as sent by browsers in the
+// Origin header, eg. "https://koha.example.org:8080".
+func validOrigin(s string) bool {
+	u, err := url.Parse(s)
+	if err != nil {
+		return false
+	}
+	return (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" &&
+		u.Path == "" && u.RawQuery == "" && u.User == nil
+}
+
+// redacted returns the configuration with secrets masked, for logging.
+func (cfg config) redacted() config {
+	if cfg.SIPPass != "" {
+		cfg.SIPPass = "***"
+	}
+	if cfg.AuthSecret != "" {
+		cfg.AuthSecret = "***"
+	}
+	if cfg.AdminToken != "" {
+		cfg.AdminToken = "***"
+	}
+	return cfg
+}
+
+// checkVendors verifies that all configured RFID-vendors are registered.
+func (cfg config) checkVendors() error {
+	if _, err := newVendor(cfg.Vendor); err != nil {
+		return err
+	}
+	for k, u := range cfg.Units {
+		if u.Vendor == "" {
+			continue
+		}
+		if _, err := newVendor(u.Vendor); err != nil {
+			return fmt.Errorf("RFID-unit %v: %v", k, err)
+		}
+	}
+	return nil
+}
+
+// rfidTimeout returns the time to wait for the RFID-unit to respond in the
+// given state, or 0 if there is no limit. The states where the RFID-unit is
+// scanning for tags have no limit, as they wait for items and not for a
+// response.
+func (cfg config) rfidTimeout(s UnitState) time.Duration {
+	switch s {
+	case UNITIdle, UNITCheckin, UNITCheckout, UNITRenew, UNITOff:
+		return 0
+	}
+	if d, ok := cfg.RFIDTimeouts[s.String()]; ok {
+		return d.Duration
+	}
+	return cfg.RFIDTimeout.Duration
+}
+
+// validUnitState returns true if name is the name of a UnitState.
+func validUnitState(name string) bool {
+	for _, s := range unitStateNames {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
+
+// unitConfig holds the configuration of a single RFID-unit.
+type unitConfig struct {
+	// Adress (host or host:port) of the RFID-unit. TCPPort is used if no port
+	// is given. If empty, the IP-address of the websocket connection is used.
+	Addr string
+
+	// Name of the RFID-vendor; overrides the default vendor if set
+	Vendor string
+
+	// Adress (host or host:port) of a network receipt printer, which
+	// receives ESC/POS over raw TCP, on port 9100 if no port is given.
+	// Receipts are only returned to the UI if empty.
+	Printer string
+}
+
+// unit returns the configuration of the RFID-unit belonging to the given
+// workstation. A workstation identifier takes precedence over the IP-address
+// when looking up configured RFID-units.
+func (cfg config) unit(workstation, ip string) unitConfig {
+	if u, ok := cfg.Units[workstation]; ok {
+		return u
+	}
+	return cfg.Units[ip]
+}
+
+// observerAllowed returns true if the UI at the given IP-address may follow the
+// workstation as an observer.
+func (cfg config) observerAllowed(ip, workstation string) bool {
+	w, ok := cfg.Observers[ip]
+	return ok && (w == "*" || w == workstation)
+}
+
+// rfidAddr returns the adress (host:port) of the RFID-unit belonging to the
+// given workstation.
+func (cfg config) rfidAddr(workstation, ip string) string {
+	if u := cfg.unit(workstation, ip); u.Addr != "" {
+		if _, _, err := net.SplitHostPort(u.Addr); err == nil {
+			return u.Addr
+		}
+		return net.JoinHostPort(u.Addr, cfg.TCPPort)
+	}
+	return net.JoinHostPort(ip, cfg.TCPPort)
+}
+
+// printerAddr returns the adress (host:port) of the receipt printer belonging
+// to the given workstation, or an empty string if it has none.
+func (cfg config) printerAddr(workstation, ip string) string {
+	u := cfg.unit(workstation, ip)
+	if u.Printer == "" {
+		return ""
+	}
+	if _, _, err := net.SplitHostPort(u.Printer); err == nil {
+		return u.Printer
+	}
+	return net.JoinHostPort(u.Printer, printerPort)
+}
+
+// vendorName returns the name of the RFID-vendor of the RFID-unit belonging to
+// the given workstation.
+func (cfg config) vendorName(workstation, ip string) string {
+	if u := cfg.unit(workstation, ip); u.Vendor != "" {
+		return u.Vendor
+	}
+	return cfg.Vendor
+}
+
+// branchConfig holds the configuration of a single branch.
+type branchConfig struct {
+	// Library parameters to use when writing RFID-tags
+	TagParams tagParams
+
+	// Templates for receipts and slips
+	Templates templateFiles
+}
+
+// tagParams are the library parameters set on the RFID-unit before writing
+// RFID-tags (ISO 28560). Empty fields fall back to the default parameters.
+type tagParams struct {
+	LibraryNumber string // LBN: library number (ISIL), eg. 02030000
+	CountryCode   string // LBC: library country code, eg. NO
+	DataModel     string // DTM: data model, eg. DS24 (Danish Standard)
+	SecurityBit   string // SSB: set security bit when writing (0/1)
+	CheckRead     string // CRD: check read after write (0/1)
+	WaitTime      string // WTM: time to wait for all tags in set, in ms
+	SetStatus     string // RSS: set status for 1-tag-only sets (0/1/2)
+}
+
+// defaultTagParams are used when no library parameters are configured.
+var defaultTagParams = tagParams{
+	LibraryNumber: "02030000",
+	CountryCode:   "NO",
+	DataModel:     "DS24",
+	SecurityBit:   "0",
+	CheckRead:     "1",
+	WaitTime:      "5000",
+	SetStatus:     "1",
+}
+
+// validate checks the values of the parameters which are given.
+func (p tagParams) validate() error {
+	check := func(name, v string, valid ...string) error {
+		if v == "" {
+			return nil
+		}
+		for _, ok := range valid {
+			if v == ok {
+				return nil
+			}
+		}
+		return fmt.Errorf("%v: invalid value %q, must be one of %v", name, v, valid)
+	}
+	if err := check("SecurityBit", p.SecurityBit, "0", "1"); err != nil {
+		return err
+	}
+	if err := check("CheckRead", p.CheckRead, "0", "1"); err != nil {
+		return err
+	}
+	if err := check("SetStatus", p.SetStatus, "0", "1", "2"); err != nil {
+		return err
+	}
+	if p.WaitTime != "" {
+		if n, err := strconv.Atoi(p.WaitTime); err != nil || n < 0 {
+			return fmt.Errorf("WaitTime: invalid value %q, must be milliseconds", p.WaitTime)
+		}
+	}
+	return nil
+}
+
+// merge returns the parameters, with empty fields taken from other.
+func (p tagParams) merge(other tagParams) tagParams {
+	if p.LibraryNumber == "" {
+		p.LibraryNumber = other.LibraryNumber
+	}
+	if p.CountryCode == "" {
+		p.CountryCode = other.CountryCode
+	}
+	if p.DataModel == "" {
+		p.DataModel = other.DataModel
+	}
+	if p.SecurityBit == "" {
+		p.SecurityBit = other.SecurityBit
+	}
+	if p.CheckRead == "" {
+		p.CheckRead = other.CheckRead
+	}
+	if p.WaitTime == "" {
+		p.WaitTime = other.WaitTime
+	}
+	if p.SetStatus == "" {
+		p.SetStatus = other.SetStatus
+	}
+	return p
+}
+
+// tagParams returns the library parameters to use when writing RFID-tags at
+// the given branch.
+func (cfg config) tagParams(branch string) tagParams {
+	return cfg.Branches[branch].TagParams.merge(cfg.TagParams).merge(defaultTagParams)
+}
+
+// templateFiles are the paths of the templates used for receipts, and for hold
+// and transit slips. The text templates are used both for plain text and
+// ESC/POS. Empty fields fall back to the default templates, and the built-in
+// templates are used for those not given at all.
+type templateFiles struct {
+	Receipt         string // text/template
+	ReceiptHTML     string // html/template
+	HoldSlip        string
+	HoldSlipHTML    string
+	TransitSlip     string
+	TransitSlipHTML string
+}
+
+// validate checks that the templates which are given can be parsed.
+func (t templateFiles) validate() error {
+	for _, f := range []struct{ name, path string }{
+		{"Receipt", t.Receipt},
+		{"HoldSlip", t.HoldSlip},
+		{"TransitSlip", t.TransitSlip},
+	} {
+		if _, err := loadTextTemplate(f.path, ""); err != nil {
+			return fmt.Errorf("%v: %v", f.name, err)
+		}
+	}
+	for _, f := range []struct{ name, path string }{
+		{"ReceiptHTML", t.ReceiptHTML},
+		{"HoldSlipHTML", t.HoldSlipHTML},
+		{"TransitSlipHTML", t.TransitSlipHTML},
+	} {
+		if _, err := loadHTMLTemplate(f.path, ""); err != nil {
+			return fmt.Errorf("%v: %v", f.name, err)
+		}
+	}
+	return nil
+}
+
+// merge returns the templates, with empty fields taken from other.
+func (t templateFiles) merge(other templateFiles) templateFiles {
+	if t.Receipt == "" {
+		t.Receipt = other.Receipt
+	}
+	if t.ReceiptHTML == "" {
+		t.ReceiptHTML = other.ReceiptHTML
+	}
+	if t.HoldSlip == "" {
+		t.HoldSlip = other.HoldSlip
+	}
+	if t.HoldSlipHTML == "" {
+		t.HoldSlipHTML = other.HoldSlipHTML
+	}
+	if t.TransitSlip == "" {
+		t.TransitSlip = other.TransitSlip
+	}
+	if t.TransitSlipHTML == "" {
+		t.TransitSlipHTML = other.TransitSlipHTML
+	}
+	return t
+}
+
+// templates returns the templates to use at the given branch.
+func (cfg config) templates(branch string) templateFiles {
+	return cfg.Branches[branch].Templates.merge(cfg.Templates)
+}
+
+// parseKeyValues parses a list on the form "key1=value1,key2=value2".
+func parseKeyValues(s string) (map[string]string, error) {
+	kvs := make(map[string]string)
+	for _, kv := range strings.Split(s, ",") {
+		kv = strings.TrimSpace(kv)
+		if kv == "" {
+			continue
+		}
+		p := strings.SplitN(kv, "=", 2)
+		if len(p) != 2 || p[0] == "" || p[1] == "" {
+			return nil, fmt.Errorf("invalid key=value pair: %q", kv)
+		}
+		kvs[p[0]] = p[1]
+	}
+	return kvs, nil
+}
+
+// parseUnits parses a list of RFID-units on the form:
+// "workstation1=host[:port][@vendor],workstation2=host[:port][@vendor]"
+func parseUnits(s string) (map[string]unitConfig, error) {
+	kvs, err := parseKeyValues(s)
+	if err != nil {
+		return nil, err
+	}
+	units := make(map[string]unitConfig)
+	for k, v := range kvs {
+		var unit unitConfig
+		if i := strings.LastIndex(v, "@"); i != -1 {
+			unit.Vendor = v[i+1:]
+			v = v[:i]
+			if unit.Vendor == "" {
+				return nil, fmt.Errorf("invalid RFID-unit mapping: %q", k+"="+kvs[k])
+			}
+		}
+		unit.Addr = v
+		units[k] = unit
+	}
+	return units, nil
 }
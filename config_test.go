@@ -0,0 +1,246 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRFIDAddr(t *testing.T) {
+	cfg := config{
+		TCPPort: "6005",
+		Units: map[string]unitConfig{
+			"desk1":    {Addr: "10.172.2.10"},
+			"desk2":    {Addr: "10.172.2.11:7000"},
+			"10.0.0.9": {Addr: "10.172.2.12"},
+		},
+	}
+
+	var tests = []struct {
+		workstation, ip string
+		want            string
+	}{
+		{"desk1", "10.0.0.1", "10.172.2.10:6005"},
+		{"desk2", "10.0.0.1", "10.172.2.11:7000"},
+		{"10.0.0.9", "10.0.0.9", "10.172.2.12:6005"},
+		{"desk3", "10.0.0.9", "10.172.2.12:6005"},
+		{"desk3", "10.0.0.3", "10.0.0.3:6005"},
+		{"10.0.0.3", "10.0.0.3", "10.0.0.3:6005"},
+	}
+
+	for _, tt := range tests {
+		if got := cfg.rfidAddr(tt.workstation, tt.ip); got != tt.want {
+			t.Errorf("rfidAddr(%q, %q) => %q; want %q", tt.workstation, tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestObserverAllowed(t *testing.T) {
+	cfg := config{Observers: map[string]string{"10.0.0.40": "desk1", "10.0.0.50": "*"}}
+	var tests = []struct {
+		ip, workstation string
+		want            bool
+	}{
+		{"10.0.0.40", "desk1", true},
+		{"10.0.0.40", "desk2", false},
+		{"10.0.0.50", "desk2", true},
+		{"10.0.0.1", "desk1", false},
+	}
+	for _, tt := range tests {
+		if got := cfg.observerAllowed(tt.ip, tt.workstation); got != tt.want {
+			t.Errorf("observerAllowed(%q, %q) => %v; want %v", tt.ip, tt.workstation, got, tt.want)
+		}
+	}
+}
+
+func TestVendorName(t *testing.T) {
+	cfg := config{
+		Vendor: "deichman",
+		Units: map[string]unitConfig{
+			"desk1":    {Addr: "10.172.2.10", Vendor: "acme"},
+			"10.0.0.9": {Vendor: "other"},
+		},
+	}
+
+	var tests = []struct {
+		workstation, ip string
+		want            string
+	}{
+		{"desk1", "10.0.0.1", "acme"},
+		{"desk2", "10.0.0.9", "other"},
+		{"desk2", "10.0.0.3", "deichman"},
+	}
+
+	for _, tt := range tests {
+		if got := cfg.vendorName(tt.workstation, tt.ip); got != tt.want {
+			t.Errorf("vendorName(%q, %q) => %q; want %q", tt.workstation, tt.ip, got, tt.want)
+		}
+	}
+
+	if err := cfg.checkVendors(); err == nil {
+		t.Error("checkVendors() => no error; want an error for unknown vendors")
+	}
+}
+
+func TestParseUnits(t *testing.T) {
+	units, err := parseUnits("desk1=10.172.2.10, desk2=10.172.2.11:7000@deichman,10.0.0.9=@deichman")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]unitConfig{
+		"desk1":    {Addr: "10.172.2.10"},
+		"desk2":    {Addr: "10.172.2.11:7000", Vendor: "deichman"},
+		"10.0.0.9": {Vendor: "deichman"},
+	}
+	if !reflect.DeepEqual(units, want) {
+		t.Errorf("parseUnits => %+v; want %+v", units, want)
+	}
+
+	for _, s := range []string{"desk1", "desk1=", "=10.172.2.10", "desk1=10.172.2.10@"} {
+		if _, err := parseUnits(s); err == nil {
+			t.Errorf("parseUnits(%q) => no error; want an error", s)
+		}
+	}
+}
+
+func TestTagParams(t *testing.T) {
+	cfg := config{
+		TagParams: tagParams{CountryCode: "SE"},
+		Branches: map[string]branchConfig{
+			"hutl": {TagParams: tagParams{LibraryNumber: "02030001", WaitTime: "3000"}},
+		},
+	}
+
+	want := defaultTagParams
+	want.CountryCode = "SE"
+	if got := cfg.tagParams("fmaj"); got != want {
+		t.Errorf("tagParams(\"fmaj\") => %+v; want %+v", got, want)
+	}
+
+	want.LibraryNumber = "02030001"
+	want.WaitTime = "3000"
+	if got := cfg.tagParams("hutl"); got != want {
+		t.Errorf("tagParams(\"hutl\") => %+v; want %+v", got, want)
+	}
+}
+
+func TestRFIDTimeout(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.RFIDTimeouts["UNITPreWriteStep8"] = duration{0}
+
+	var tests = []struct {
+		state UnitState
+		want  time.Duration
+	}{
+		{UNITCheckin, 0},
+		{UNITIdle, 0},
+		{UNITWaitForCheckinAlarmOn, 10 * time.Second},
+		{UNITWriting, 30 * time.Second},
+		{UNITPreWriteStep8, 0},
+	}
+
+	for _, tt := range tests {
+		if got := cfg.rfidTimeout(tt.state); got != tt.want {
+			t.Errorf("rfidTimeout(%v) => %v; want %v", tt.state, got, tt.want)
+		}
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	f, err := ioutil.TempFile("", "rfidhub-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`{
+		"SIPServer": "koha:6001",
+		"SIPDept": "hutl",
+		"RFIDReconnectMax": "30s",
+		"Units": {"desk1": {"Addr": "10.172.2.10"}},
+		"Branches": {"hutl": {"TagParams": {"LibraryNumber": "02030001"}}}
+	}`)
+	f.Close()
+
+	os.Setenv("SIP_CONNS", "5")
+	os.Setenv("SIP_USER", "rfid")
+	defer os.Unsetenv("SIP_CONNS")
+	defer os.Unsetenv("SIP_USER")
+
+	cfg, err := loadConfig(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.SIPServer != "koha:6001" || cfg.SIPDept != "hutl" {
+		t.Errorf("settings from file not applied: %+v", cfg)
+	}
+	if cfg.RFIDReconnectMax.Duration != 30*time.Second {
+		t.Errorf("cfg.RFIDReconnectMax => %v; want 30s", cfg.RFIDReconnectMax)
+	}
+	if cfg.HTTPPort != "8899" {
+		t.Errorf("cfg.HTTPPort => %q; want default 8899", cfg.HTTPPort)
+	}
+	if cfg.NumSIPConnections != 5 || cfg.SIPUser != "rfid" {
+		t.Errorf("environment variables didn't override configuration: %+v", cfg)
+	}
+	if cfg.tagParams("hutl").LibraryNumber != "02030001" {
+		t.Errorf("branch settings from file not applied: %+v", cfg.Branches)
+	}
+
+	os.Setenv("SIP_CONNS", "five")
+	if _, err := loadConfig(f.Name()); err == nil {
+		t.Error("loadConfig with SIP_CONNS=five => no error; want an error")
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	var tests = []struct {
+		json string
+		want string
+	}{
+		{`{"SIPServre": "koha:6001"}`, "unknown field"},
+		{`{"RFIDReconnectMin": 1000}`, "cannot parse"},
+		{`{"HTTPPort": "http"}`, "HTTPPort"},
+		{`{"SIPServer": "koha"}`, "SIPServer"},
+		{`{"NumSIPConnections": 0}`, "NumSIPConnections"},
+		{`{"SIPTLS": true, "SIPTLSCert": "client.pem"}`, "SIPTLSCert"},
+		{`{"SIPTLS": true, "SIPTLSCA": "/nonexistent/ca.pem"}`, "SIPTLS"},
+		{`{"SIPTLSServerName": "koha"}`, "SIPTLS"},
+		{`{"Language": "sv"}`, "Language"},
+		{`{"HTTPTLSCert": "cert.pem"}`, "HTTPTLSCert"},
+		{`{"HTTPTLSCert": "/nonexistent/cert.pem", "HTTPTLSKey": "/nonexistent/key.pem"}`, "HTTPTLSCert"},
+		{`{"HTTPTLSReload": "-1s"}`, "HTTPTLSReload"},
+		{`{"HTTPRedirectPort": "80"}`, "HTTPRedirectPort"},
+		{`{"AuthSecret": "secret"}`, "AuthSecret"},
+		{`{"SessionExpiry": "-1m"}`, "SessionExpiry"},
+		{`{"AllowedOrigins": ["koha.example.org"]}`, "AllowedOrigins"},
+		{`{"AllowedOrigins": ["https://koha.example.org/"]}`, "AllowedOrigins"},
+		{`{"Observers": {"display1": "desk1"}}`, "Observers"},
+		{`{"Vendor": "acme"}`, "Vendor"},
+		{`{"Units": {"desk1": {"Addr": "10.172.2.10:port"}}}`, "Units[desk1]"},
+		{`{"Branches": {"hutl": {"TagParams": {"SecurityBit": "2"}}}}`, "Branches[hutl]"},
+		{`{"AuditLogBackups": -1}`, "AuditLogBackups"},
+		{`{"AdminToken": "secret"}`, "AdminToken"},
+		{`{"Units": {"desk1": {"Printer": "10.172.2.30:port"}}}`, "Units[desk1].Printer"},
+		{`{"Branches": {"hutl": {"Templates": {"Receipt": "/nonexistent/receipt.txt"}}}}`, "Branches[hutl].Templates"},
+		{`{"RFIDTimeouts": {"UNITWritting": "1m"}}`, "RFIDTimeouts[UNITWritting]"},
+	}
+
+	for _, tt := range tests {
+		f, err := ioutil.TempFile("", "rfidhub-config")
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteString(tt.json)
+		f.Close()
+
+		_, err = loadConfig(f.Name())
+		os.Remove(f.Name())
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("loadConfig(%s) => %v; want error containing %q", tt.json, err, tt.want)
+		}
+	}
+}
@@ -1,8 +1,17 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
 	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
@@ -16,7 +25,356 @@ func statusHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write(b)
 }
 
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	status.WritePrometheus(w)
+}
+
+// auditHandler returns the audit log entries matching the query parameters
+// barcode, patron, from and to. The dates are given as 2006-01-02 or RFC3339;
+// a date-only "to" includes the whole day. At most limit entries are returned,
+// after skipping offset of them; if there are more, the next page is given in
+// a Link header. It is part of the admin API.
+func auditHandler(w http.ResponseWriter, r *http.Request) {
+	if !adminRequest(w, r, "GET") {
+		return
+	}
+	if audit == nil {
+		http.Error(w, "audit log not enabled", http.StatusNotFound)
+		return
+	}
+
+	var q auditQuery
+	var err error
+	v := r.URL.Query()
+	q.Barcode = v.Get("barcode")
+	q.Patron = v.Get("patron")
+	if q.From, err = parseAuditTime(v.Get("from"), false); err != nil {
+		http.Error(w, "from: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if q.To, err = parseAuditTime(v.Get("to"), true); err != nil {
+		http.Error(w, "to: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if q.Offset, err = parseAuditCount(v.Get("offset")); err != nil {
+		http.Error(w, "offset: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if q.Limit, err = parseAuditCount(v.Get("limit")); err != nil {
+		http.Error(w, "limit: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	entries, more, err := audit.Query(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if more {
+		v.Set("offset", strconv.Itoa(q.Offset+len(entries)))
+		next := url.URL{Path: r.URL.Path, RawQuery: v.Encode()}
+		w.Header().Set("Link", "<"+next.String()+`>; rel="next"`)
+	}
+	b, err := json.Marshal(entries)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// parseAuditTime parses a time given as 2006-01-02 (in local time) or RFC3339.
+// If endOfDay is true, a date-only time is moved to the start of the next day.
+func parseAuditTime(s string, endOfDay bool) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", s, time.Local)
+	if err != nil {
+		return time.Parse(time.RFC3339, s)
+	}
+	if endOfDay {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+// parseAuditCount parses a non-negative number, where empty means 0.
+func parseAuditCount(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid number %q", s)
+	}
+	return n, nil
+}
+
+// offlineHandler returns the checkins in the offline queue, optionally only
+// those with the given status; status=conflict gives the checkins refused by
+// Koha. It is part of the admin API, as are the other offline handlers.
+func offlineHandler(w http.ResponseWriter, r *http.Request) {
+	if !adminRequest(w, r, "GET") {
+		return
+	}
+	if offline == nil {
+		http.Error(w, "offline queue not enabled", http.StatusNotFound)
+		return
+	}
+	b, err := json.Marshal(offline.List(r.URL.Query().Get("status")))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// offlineRetryHandler marks the offline checkin given by the id parameter, or
+// all of them if no id is given, as pending, and sends them to Koha right
+// away.
+func offlineRetryHandler(w http.ResponseWriter, r *http.Request) {
+	offlineAction(w, r, true, offline.Retry)
+}
+
+// offlineDiscardHandler removes the offline checkin given by the id parameter
+// from the queue, without sending it to Koha.
+func offlineDiscardHandler(w http.ResponseWriter, r *http.Request) {
+	offlineAction(w, r, false, offline.Discard)
+}
+
+// offlineAction performs f on the offline checkin given by the id parameter.
+// If optional is true, the id can be left out, and f is called with id 0.
+func offlineAction(w http.ResponseWriter, r *http.Request, optional bool, f func(int64) (bool, error)) {
+	if !adminRequest(w, r, "POST") {
+		return
+	}
+	if offline == nil {
+		http.Error(w, "offline queue not enabled", http.StatusNotFound)
+		return
+	}
+	var id int64
+	if v := r.FormValue("id"); v != "" || !optional {
+		var err error
+		if id, err = strconv.ParseInt(v, 10, 64); err != nil || id <= 0 {
+			http.Error(w, "id: invalid id "+strconv.Quote(v), http.StatusBadRequest)
+			return
+		}
+	}
+	found, err := f(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, "no such offline checkin", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// messagesHandler returns the message catalog for the language given by the
+// lang query parameter, keyed by message code, so that the UI can translate
+// ErrorCode. Without lang, the catalogs of all languages are returned.
+func messagesHandler(w http.ResponseWriter, r *http.Request) {
+	var v interface{} = catalog
+	if lang := r.URL.Query().Get("lang"); lang != "" {
+		if !validLanguage(lang) {
+			http.Error(w, "unknown language", http.StatusNotFound)
+			return
+		}
+		v = catalog[lang]
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// adminConnectionsHandler returns the UI connections, with the state of their
+// RFID-units, sorted by workstation.
+func adminConnectionsHandler(w http.ResponseWriter, r *http.Request) {
+	if !adminRequest(w, r, "GET") {
+		return
+	}
+	conns := hub.connections()
+	infos := make([]connInfo, 0, len(conns))
+	for _, ac := range conns {
+		infos = append(infos, ac.info())
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].Workstation != infos[j].Workstation {
+			return infos[i].Workstation < infos[j].Workstation
+		}
+		return !infos[i].Observer && infos[j].Observer
+	})
+	b, err := json.Marshal(infos)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// adminDisconnectHandler closes the UI connection of the workstation given by
+// the workstation parameter, which shuts down its RFID-unit state-machine.
+// Observers of the workstation stay connected.
+func adminDisconnectHandler(w http.ResponseWriter, r *http.Request) {
+	adminAction(w, r, false, func(ac adminConn) (interface{}, error) {
+		log.Printf("WARN: UI[%v] connection closed from admin API", ac.c.workstation)
+		ac.c.ws.Close()
+		return nil, nil
+	})
+}
+
+// adminResetHandler ends scanning at the RFID-unit of the workstation given by
+// the workstation parameter, and clears its session. The UI is sent RESET.
+func adminResetHandler(w http.ResponseWriter, r *http.Request) {
+	adminAction(w, r, true, func(ac adminConn) (interface{}, error) {
+		if resp := ac.unit.admin(adminReq{cmd: adminReset}); resp.err != nil {
+			return nil, resp.err
+		}
+		ac.c.session.clear()
+		return nil, nil
+	})
+}
+
+// adminCommandHandler sends the request body as a vendor command to the idle
+// RFID-unit of the workstation given by the workstation parameter, and returns
+// the response of the RFID-unit as {"Response": "..."}.
+func adminCommandHandler(w http.ResponseWriter, r *http.Request) {
+	adminAction(w, r, true, func(ac adminConn) (interface{}, error) {
+		cmd, err := ioutil.ReadAll(io.LimitReader(r.Body, 1024))
+		if err != nil {
+			return nil, err
+		}
+		cmd = bytes.TrimSpace(cmd)
+		if len(cmd) == 0 {
+			return nil, errEmptyCommand
+		}
+		resp := ac.unit.admin(adminReq{cmd: adminCommand, data: cmd})
+		if resp.err != nil {
+			return nil, resp.err
+		}
+		return struct{ Response string }{string(bytes.TrimRight(resp.resp, "\r"))}, nil
+	})
+}
+
+// adminAction performs f on the controlling UI connection of the workstation
+// given by the workstation parameter. If needUnit is true, its RFID-unit must
+// be connected. The result of f is returned as JSON, or 204 if it is nil.
+func adminAction(w http.ResponseWriter, r *http.Request, needUnit bool, f func(adminConn) (interface{}, error)) {
+	if !adminRequest(w, r, "POST") {
+		return
+	}
+	ac, ok := hub.controller(r.URL.Query().Get("workstation"))
+	if !ok || (needUnit && ac.unit == nil) {
+		http.Error(w, errNoSuchUnit.Error(), http.StatusNotFound)
+		return
+	}
+	v, err := f(ac)
+	switch err {
+	case nil:
+	case errEmptyCommand:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case errUnitBusy, errUnitReset:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case errUnitTimeout:
+		http.Error(w, err.Error(), http.StatusGatewayTimeout)
+		return
+	default:
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	if v == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// adminRequest checks that the admin API is enabled, and that the request is
+// authorized and uses the given method. If not, the error is written, and
+// false returned.
+func adminRequest(w http.ResponseWriter, r *http.Request, method string) bool {
+	if hub.cfg.AdminToken == "" {
+		http.Error(w, "admin API not enabled", http.StatusNotFound)
+		return false
+	}
+	if !adminAuthorized(hub.cfg, r) {
+		log.Printf("WARN: admin API request from IP %v refused: not authorized", clientIP(r, hub.cfg.TrustForwardedFor))
+		w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	return true
+}
+
 func wsHandler(w http.ResponseWriter, r *http.Request) {
+	ip := clientIP(r, hub.cfg.TrustForwardedFor)
+	if !allowedOrigin(hub.cfg, r) {
+		log.Printf("WARN: websocket-connection from IP %v refused: origin %q not allowed", ip, r.Header.Get("Origin"))
+		http.Error(w, "Origin not allowed", http.StatusForbidden)
+		return
+	}
+	user, err := authenticate(hub.cfg, r, time.Now())
+	if err != nil {
+		log.Printf("WARN: websocket-connection from IP %v refused: %v", ip, err)
+		http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	workstation := r.URL.Query().Get("workstation")
+	if workstation == "" {
+		workstation = r.Header.Get("X-Workstation")
+	}
+	// Patron-facing displays and dashboards can follow the UI of the
+	// workstation as observers:
+	observer := r.URL.Query().Get("role") == "observer"
+	if observer {
+		if workstation == "" {
+			workstation = ip
+		}
+		if !hub.cfg.observerAllowed(ip, workstation) {
+			log.Printf("WARN: websocket-connection from IP %v refused: not allowed to observe %v", ip, workstation)
+			http.Error(w, "Forbidden: not allowed to observe "+workstation, http.StatusForbidden)
+			return
+		}
+	} else {
+		// Only the UI the token was issued for can control the workstation,
+		// and not while another staff user is using it:
+		if workstation, err = authorizeWorkstation(hub.cfg, user, workstation, ip); err != nil {
+			log.Printf("WARN: websocket-connection from IP %v refused: %v", ip, err)
+			http.Error(w, "Forbidden: "+err.Error(), http.StatusForbidden)
+			return
+		}
+		if ac, ok := hub.controller(workstation); ok && ac.c.staff.User != user.User {
+			log.Printf("WARN: websocket-connection from IP %v refused: workstation %v in use by %v", ip, workstation, ac.c.staff.User)
+			http.Error(w, "Workstation in use by another staff user", http.StatusConflict)
+			return
+		}
+	}
+
 	ws, err := websocket.Upgrade(w, r, nil, 1024, 1024)
 	if _, ok := err.(websocket.HandshakeError); ok {
 		http.Error(w, "Not a websocket handshake", 400)
@@ -25,9 +383,31 @@ func wsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	lang := r.URL.Query().Get("lang")
+	if !validLanguage(lang) {
+		lang = hub.cfg.Language
+	}
+
+	send := make(chan UIMsg)
+	observers := hub.observers
+	if observer {
+		send = make(chan UIMsg, observerBuffer)
+		observers = nil
+	}
+
 	c := &uiConn{
-		send: make(chan UIMsg),
-		ws:   ws}
+		lang:        lang,
+		staff:       user,
+		session:     hub.sessions.get(workstation),
+		observer:    observer,
+		observers:   observers,
+		send:        send,
+		noticed:     make(chan struct{}, 1),
+		done:        make(chan struct{}),
+		ip:          ip,
+		workstation: workstation,
+		connected:   time.Now(),
+		ws:          ws}
 
 	hub.uiReg <- c
 	defer func() {
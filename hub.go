@@ -1,12 +1,12 @@
 package main
 
 import (
-	"bufio"
 	"encoding/json"
 	"fmt"
 	"log"
-	"net"
 	"os"
+	"sync"
+	"time"
 
 	pool "gopkg.in/fatih/pool.v2"
 
@@ -14,140 +14,274 @@ import (
 )
 
 // Hub waits for webscoket-connections coming from Koha's user interface.
-// For each websocket-connection it attempts to open a TCP-connection to a
-// RFID-unit using the same IP-adress as the websocket connection.
+// For each websocket-connection it attempts to open a TCP-connection to the
+// RFID-unit configured for the workstation, or else a RFID-unit using the same
+// IP-adress as the websocket connection, retrying until it succeeds or the
+// websocket-connection is closed.
 // If successfull, a state-machine is started to handle all communications
 // between the UI, SIP and the RFID-unit.
 type Hub struct {
 	cfg config
-	// Connected IP adresses
-	ipAdresses map[string]*uiConn
+	// Connected workstations, keyed by workstation identifier or IP adress
+	workstations map[string]*uiConn
 	// A map of connected UI connections
 	uiConnections map[*uiConn]bool
 	// Register a new UI connection:
 	uiReg chan *uiConn
 	// Unregister a UI connection:
 	uiUnReg chan *uiConn
+	// Results of attempts to connect to RFID-units:
+	rfidConn chan rfidConnResult
+	// Sessions of the workstations, kept across page reloads:
+	sessions *sessionStore
+	// Read-only UI connections of the workstations:
+	observers *observerSet
+	// Requests from the admin API for the UI connections:
+	adminList chan chan []adminConn
 
 	closed chan bool
+	// Closed when run has returned:
+	stopped chan struct{}
 }
 
-// newHub creates and returns a new Hub instance.
+// rfidConnResult is the outcome of an attempt to connect to the RFID-unit of
+// a UI connection.
+type rfidConnResult struct {
+	c    *uiConn
+	unit *RFIDUnit
+	err  error
+}
+
+// newHub creates and returns a new Hub instance. It creates the SIP connection
+// pool and circuit breaker, and opens the audit log and offline queue, which
+// are shared by the RFID-unit state-machines and the HTTP handlers, so that
+// they are in place before the Hub and the HTTP server are started.
 func newHub(cfg config) *Hub {
+	// Fall back to defaults for settings not given:
+	if cfg.RFIDReconnectMin.Duration <= 0 {
+		cfg.RFIDReconnectMin.Duration = time.Second
+	}
+	if cfg.RFIDReconnectMax.Duration < cfg.RFIDReconnectMin.Duration {
+		cfg.RFIDReconnectMax.Duration = time.Minute
+	}
+	if cfg.Vendor == "" {
+		cfg.Vendor = "deichman"
+	}
+	if cfg.OfflineReplayInterval.Duration <= 0 {
+		cfg.OfflineReplayInterval.Duration = time.Minute
+	}
+
+	log.Printf("Creating SIP Connection pool with size: %v", cfg.NumSIPConnections)
+	var err error
+	sipPool, err = pool.NewChannelPool(0, cfg.NumSIPConnections, initSIPConn(cfg))
+	if err != nil {
+		log.Println("ERROR", err.Error())
+		os.Exit(1)
+	}
+
+	breaker = nil
+	if cfg.SIPBreakerThreshold > 0 {
+		p := sipPool
+		breaker = newCircuitBreaker(cfg.SIPBreakerThreshold, cfg.SIPBreakerCooldown.Duration,
+			func() error { return sipProbe(p) })
+	}
+
+	audit = nil
+	if cfg.AuditLog != "" {
+		audit, err = openAuditLog(cfg.AuditLog, int64(cfg.AuditLogMaxSize)*1024*1024, cfg.AuditLogBackups)
+		if err != nil {
+			log.Println("ERROR", err.Error())
+			os.Exit(1)
+		}
+	}
+
+	offline = nil
+	if cfg.OfflineQueue != "" {
+		offline, err = openOfflineQueue(cfg.OfflineQueue)
+		if err != nil {
+			log.Println("ERROR", err.Error())
+			os.Exit(1)
+		}
+	}
+
 	return &Hub{
 		cfg:           cfg,
-		ipAdresses:    make(map[string]*uiConn),
+		workstations:  make(map[string]*uiConn),
 		uiConnections: make(map[*uiConn]bool),
 		uiReg:         make(chan *uiConn),
 		uiUnReg:       make(chan *uiConn),
+		rfidConn:      make(chan rfidConnResult),
+		sessions:      newSessionStore(cfg.SessionExpiry.Duration),
+		observers:     newObserverSet(),
+		adminList:     make(chan chan []adminConn),
 		closed:        make(chan bool),
+		stopped:       make(chan struct{}),
 	}
 }
 
 // run starts the Hub. Meant to be run in its own goroutine.
 func (h *Hub) run() {
-	log.Printf("Creating SIP Connection pool with size: %v", h.cfg.NumSIPConnections)
-	var err error
-	sipPool, err = pool.NewChannelPool(0, h.cfg.NumSIPConnections, initSIPConn(h.cfg))
-	if err != nil {
-		log.Println("ERROR", err.Error())
-		os.Exit(1)
+	defer close(h.stopped)
+	status.SIPPoolMaxCapacity.Update(int64(h.cfg.NumSIPConnections))
+
+	if h.cfg.SIPKeepalive.Duration > 0 {
+		go h.sipKeepalive(sipPool)
+	}
+
+	if offline != nil {
+		go offline.run(sipPool, h.cfg.OfflineReplayInterval.Duration)
 	}
 
 	for {
 		select {
 		case c := <-h.uiReg:
-			var ip = addr2IP(c.ws.RemoteAddr().String())
+			var ws = c.workstation
+
+			if c.observer {
+				// Observers don't control the RFID-unit, and can connect
+				// alongside the UI of the workstation:
+				h.uiConnections[c] = true
+				h.observers.add(c)
+				log.Printf("UI[%v] observer connected from IP %v", ws, c.ip)
+				ctrl := h.workstations[ws]
+				msg := UIMsg{Action: "CONNECT", RFIDError: ctrl == nil || ctrl.unit == nil}
+				if msg.RFIDError {
+					msg.ErrorCode = msgRFIDError
+				}
+				c.send <- msg
+				break
+			}
 
-			// If there is allready a connection from that IP - close it
-			if oldc, ok := h.ipAdresses[ip]; ok {
-				log.Printf("WARN: Duplicate websocket-connection from IP %v; closing the first one.", ip)
+			// If there is allready a connection from that workstation - close it,
+			// unless it belongs to another staff user. That is refused by
+			// wsHandler, but they may have connected at the same time:
+			if oldc, ok := h.workstations[ws]; ok && oldc.staff.User != c.staff.User {
+				log.Printf("WARN: UI[%v] connection from IP %v as %v refused: workstation in use by %v",
+					ws, c.ip, c.staff.User, oldc.staff.User)
+				h.uiConnections[c] = true
+				c.ws.Close()
+				break
+			}
+			if oldc, ok := h.workstations[ws]; ok {
+				log.Printf("WARN: Duplicate websocket-connection from workstation %v; closing the first one.", ws)
 				if oldc.unit != nil {
-					oldc.unit.Quit <- true
+					oldc.unit.stop()
 				}
 
 				oldc.unit = nil
 				oldc.ws.Close()
-				log.Printf("UI[%v] connection closed", ip)
+				log.Printf("UI[%v] connection closed", ws)
 			}
 
 			h.uiConnections[c] = true
-			h.ipAdresses[ip] = c
-			log.Printf("UI[%v] connected", ip)
-
-			// Try to create a TCP connection to RFID-unit:
-			conn, err := net.Dial("tcp", ip+":"+h.cfg.TCPPort)
-			if err != nil {
-				log.Printf("WARN: RFID-unit[%v:%v] connection failed: %v", ip, h.cfg.TCPPort, err.Error())
-				// Note that the Hub never retries to connect after failure.
-				// The User must refresh the UI page to try to establish the
-				// RFID TCP connection again.
-				c.send <- UIMsg{Action: "CONNECT", RFIDError: true}
-				break
+			h.workstations[ws] = c
+			if c.staff.User != "" {
+				log.Printf("UI[%v] connected from IP %v as %v", ws, c.ip, c.staff.User)
+			} else {
+				log.Printf("UI[%v] connected from IP %v", ws, c.ip)
 			}
 
-			// Init the RFID-unit with version command
-			var initError string
-			unit := newRFIDUnit(conn, c.send)
-			req := unit.vendor.GenerateRFIDReq(RFIDReq{Cmd: cmdInitVersion})
-			_, err = conn.Write(req)
-			if err != nil {
-				initError = err.Error()
-			}
-			log.Printf("-> RFID-unit[%v:%v] %q", ip, h.cfg.TCPPort, req)
-
-			rdr := bufio.NewReader(conn)
-			msg, err := rdr.ReadBytes('\r')
-			if err != nil {
-				initError = err.Error()
-			}
-			r, err := unit.vendor.ParseRFIDResp(msg)
+			vendor, err := newVendor(h.cfg.vendorName(ws, c.ip))
 			if err != nil {
-				initError = err.Error()
+				log.Printf("ERROR: UI[%v] %v", ws, err)
+				c.send <- UIMsg{Action: "CONNECT", RFIDError: true, ErrorMessage: err.Error(),
+					ErrorCode: msgRFIDError}
+				break
 			}
-			log.Printf("<- RFID-unit[%v:%v] %q", ip, h.cfg.TCPPort, msg)
 
-			if initError == "" && !r.OK {
-				initError = "RFID-unit responded with NOK"
+			// Try to create a TCP connection to RFID-unit. This is done in
+			// the background, as the RFID-unit might not be available yet:
+			unit := newRFIDUnit(h.cfg, h.cfg.rfidAddr(ws, c.ip), vendor, c.send)
+			unit.workstation = ws
+			unit.ip = c.ip
+			unit.staff = c.staff.User
+			unit.vendorName = h.cfg.vendorName(ws, c.ip)
+			unit.session = c.session
+			go h.connectRFIDUnit(c, unit)
+		case res := <-h.rfidConn:
+			if h.workstations[res.c.workstation] != res.c {
+				// UI connection closed or replaced while connecting
+				if res.err == nil {
+					res.unit.getConn().Close()
+				}
+				break
 			}
 
-			if initError != "" {
-				log.Printf("ERROR: RFID-unit[%v:%v] initialization failed: %v", ip, h.cfg.TCPPort, initError)
-				c.send <- UIMsg{Action: "CONNECT", RFIDError: true}
-				unit = nil
+			if res.err != nil {
+				c := res.c
+				c.send <- UIMsg{Action: "CONNECT", RFIDError: true, ErrorCode: msgRFIDError}
+				h.notifySIPUnavailable(c)
 				break
 			}
 
-			log.Printf("RFID-unit[%v:%v] connected & initialized", ip, h.cfg.TCPPort)
+			log.Printf("RFID-unit[%v] connected & initialized", res.unit.addr)
 			// Initialize the RFID-unit state-machine with the TCP connection:
-			c.unit = unit
-			go unit.run()
-			go unit.tcpWriter()
-			go unit.tcpReader()
+			c := res.c
+			c.unit = res.unit
+			go c.unit.run()
+			go c.unit.tcpWriter()
+			go c.unit.tcpReader()
 			// Notify UI of success:
 			c.send <- UIMsg{Action: "CONNECT"}
+			h.notifySIPUnavailable(c)
+		case reply := <-h.adminList:
+			conns := make([]adminConn, 0, len(h.uiConnections))
+			for c := range h.uiConnections {
+				conns = append(conns, adminConn{c: c, unit: c.unit})
+			}
+			reply <- conns
+		case <-breaker.Changed():
+			// Let all UIs know that the SIP-server is unavailable, or
+			// available again:
+			if breaker.State() == breakerClosed {
+				offline.Trigger()
+			}
+			for c := range h.uiConnections {
+				if breaker.State() == breakerClosed {
+					msg := UIMsg{Action: "CONNECT", RFIDError: c.unit == nil}
+					if msg.RFIDError {
+						msg.ErrorCode = msgRFIDError
+					}
+					c.notify(msg)
+				} else {
+					c.notify(sipErrorMsg(errSIPUnavailable))
+				}
+			}
 		case c := <-h.uiUnReg:
-			var ip = addr2IP(c.ws.RemoteAddr().String())
+			var ws = c.workstation
 
 			if _, ok := h.uiConnections[c]; !ok {
 				// Connection allready gone. I can't understand how, but...
 				break
 			}
 
+			if c.observer {
+				h.observers.remove(c)
+				close(c.done)
+				c.ws.Close()
+				delete(h.uiConnections, c)
+				log.Printf("UI[%v] observer at IP %v disconnected", ws, c.ip)
+				close(c.send)
+				break
+			}
+
+			// Stop any attempts to connect to the RFID-unit:
+			close(c.done)
+
 			// Shutdown RFID-unit state-machine if it exists:
 			if c.unit != nil {
-				c.unit.Quit <- true
+				c.unit.stop()
 			}
 
 			c.unit = nil
-			if sameC, ok := h.ipAdresses[ip]; ok {
+			if sameC, ok := h.workstations[ws]; ok {
 				if c == sameC {
-					delete(h.ipAdresses, ip)
+					delete(h.workstations, ws)
 				}
 			}
 			c.ws.Close()
 			delete(h.uiConnections, c)
-			log.Printf("UI[%v] connection lost", ip)
+			log.Printf("UI[%v] connection lost", ws)
 			close(c.send)
 		case <-h.closed:
 			return
@@ -155,11 +289,79 @@ func (h *Hub) run() {
 	}
 }
 
+// connectRFIDUnit tries to connect to the RFID-unit belonging to the given UI
+// connection. It keeps retrying, waiting longer between each attempt, until it
+// succeeds or the UI connection is lost. The result of the first attempt, and
+// the eventual success, is reported back to the Hub.
+func (h *Hub) connectRFIDUnit(c *uiConn, unit *RFIDUnit) {
+	wait := h.cfg.RFIDReconnectMin.Duration
+	for attempt := 1; ; attempt++ {
+		err := unit.connect()
+		if err != nil {
+			log.Printf("WARN: RFID-unit[%v] connection failed (attempt %d): %v", unit.addr, attempt, err)
+		}
+		if err == nil || attempt == 1 {
+			select {
+			case h.rfidConn <- rfidConnResult{c: c, unit: unit, err: err}:
+			case <-c.done:
+				if err == nil {
+					unit.getConn().Close()
+				}
+				return
+			case <-h.closed:
+				return
+			}
+			if err == nil {
+				return
+			}
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-c.done:
+			return
+		case <-h.closed:
+			return
+		}
+		wait = nextBackoff(wait, h.cfg.RFIDReconnectMax.Duration)
+	}
+}
+
+// notifySIPUnavailable tells a newly connected UI if requests to the
+// SIP-server are suspended by the circuit breaker.
+func (h *Hub) notifySIPUnavailable(c *uiConn) {
+	if breaker.State() != breakerClosed {
+		c.notify(sipErrorMsg(errSIPUnavailable))
+	}
+}
+
+// sipKeepalive runs a health check of the SIP connection pool at the
+// configured interval, until the Hub is closed. It is skipped while the
+// SIP-server is known to be unavailable.
+func (h *Hub) sipKeepalive(p pool.Pool) {
+	for {
+		select {
+		case <-time.After(h.cfg.SIPKeepalive.Duration):
+		case <-h.closed:
+			return
+		}
+		if breaker.State() == breakerClosed {
+			sipHealthCheck(p, h.cfg.SIPConnsMin, h.cfg.SIPIdleTimeout.Duration)
+		}
+	}
+}
+
 func (h *Hub) Close() {
 	for c, _ := range h.uiConnections {
 		h.uiUnReg <- c
 	}
 	close(h.closed)
+	// Wait for run to return before closing what it shares with the RFID-unit
+	// state-machines:
+	<-h.stopped
+	offline.Close()
+	breaker.Close()
+	audit.Close()
 }
 
 // uiConn represents a UI connection. It also stores a reference to the RFID-
@@ -167,19 +369,109 @@ func (h *Hub) Close() {
 type uiConn struct {
 	// Websocket connection:
 	ws *websocket.Conn
+	// IP-address of the UI:
+	ip string
+	// Workstation identifier; the IP-address if not supplied by the UI:
+	workstation string
+	// Time of the websocket handshake:
+	connected time.Time
 	// RFID-unit state-machine:
 	unit *RFIDUnit
 	// Outgoing messages to UI:
 	send chan UIMsg
+	// Signalled when there is a notice for the writer; see notify:
+	noticed chan struct{}
+	// Closed when the UI connection is unregistered:
+	done chan struct{}
+
+	// Authenticated staff user; empty if authentication is disabled:
+	staff staff
+	// Session of the workstation; nil if sessions are disabled:
+	session *session
+	// Read-only connection, which gets the messages sent to the UI of the
+	// workstation, but cannot send actions:
+	observer bool
+	// Observers to send copies of the messages to; nil for observers:
+	observers *observerSet
+
+	mu sync.Mutex // guards lang and notice
+	// Language of the statuses sent to the UI:
+	lang string
+	// Latest notice not yet written to the UI:
+	notice *UIMsg
+}
+
+// language returns the language of the UI connection.
+func (c *uiConn) language() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lang
+}
+
+// setLanguage sets the language of the UI connection, if there is a message
+// catalog for it. It returns false if there is not.
+func (c *uiConn) setLanguage(lang string) bool {
+	if !validLanguage(lang) {
+		return false
+	}
+	c.mu.Lock()
+	c.lang = lang
+	c.mu.Unlock()
+	return true
+}
+
+// notify gives the UI a notice, like the state of the SIP-server, without
+// blocking the Hub, even while the writer is busy. A notice not yet written is
+// replaced by the newer one, so that the UI ends up with the latest state.
+func (c *uiConn) notify(msg UIMsg) {
+	c.mu.Lock()
+	c.notice = &msg
+	c.mu.Unlock()
+	select {
+	case c.noticed <- struct{}{}:
+	default:
+		// The writer has yet to pick up the earlier notice.
+	}
+}
+
+// takeNotice returns the notice for the writer, if any, and clears it.
+func (c *uiConn) takeNotice() (UIMsg, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.notice == nil {
+		return UIMsg{}, false
+	}
+	msg := *c.notice
+	c.notice = nil
+	return msg, true
 }
 
 func (c *uiConn) writer() {
-	for message := range c.send {
+	for {
+		var message UIMsg
+		select {
+		case msg, ok := <-c.send:
+			if !ok {
+				return
+			}
+			message = msg
+		case <-c.noticed:
+			msg, ok := c.takeNotice()
+			if !ok {
+				continue
+			}
+			message = msg
+		}
+		if !c.observer {
+			c.session.record(message)
+			c.observers.send(c.workstation, message)
+		}
+		message = message.localize(c.language())
 		err := c.ws.WriteJSON(message)
 		if err != nil {
 			break
 		}
-		log.Printf("-> UI[%v] %+v", addr2IP(c.ws.RemoteAddr().String()), message)
+		log.Printf("-> UI[%v] %+v", c.workstation, message)
 	}
 }
 
@@ -192,19 +484,65 @@ func (c *uiConn) reader() {
 		var m UIMsg
 		err = json.Unmarshal(msg, &m)
 		if err != nil {
-			log.Printf("WARN: UI[%v] failed to unmarshal JSON: %q", addr2IP(c.ws.RemoteAddr().String()), msg)
+			log.Printf("WARN: UI[%v] failed to unmarshal JSON: %q", c.workstation, msg)
 			c.send <- UIMsg{Action: "CONNECT", UserError: true,
-				ErrorMessage: fmt.Sprintf("Failed to parse the JSON request: %v", err)}
+				ErrorMessage: fmt.Sprintf("Failed to parse the JSON request: %v", err),
+				ErrorCode:    msgBadRequest}
 			continue
 		}
-		log.Printf("<- UI[%v] %q", addr2IP(c.ws.RemoteAddr().String()), msg)
-		if c.unit != nil {
-			if c.unit.state == UNITOff {
-				// TODO log warning? (UI is not aware of state-machine stopped)
-				c.unit = nil
-				continue
+		log.Printf("<- UI[%v] %q", c.workstation, msg)
+		if c.staff.User != "" {
+			if time.Now().After(c.staff.Expires.Add(tokenLeeway)) {
+				log.Printf("WARN: UI[%v] token of %v expired; closing connection", c.workstation, c.staff.User)
+				c.send <- UIMsg{Action: "CONNECT", UserError: true,
+					ErrorMessage: "Token expired", ErrorCode: msgTokenExpired}
+				break
 			}
-			c.unit.FromUI <- m
+			if c.staff.Branch != "" {
+				// Staff can only work at the branch they are logged in at:
+				if m.Branch == "" {
+					m.Branch = c.staff.Branch
+				} else if m.Branch != c.staff.Branch {
+					log.Printf("WARN: UI[%v] %v not allowed at branch %v", c.workstation, c.staff.User, m.Branch)
+					c.send <- UIMsg{Action: m.Action, UserError: true,
+						ErrorMessage: fmt.Sprintf("Not allowed at branch %v", m.Branch),
+						ErrorCode:    msgBranchNotAllowed}
+					continue
+				}
+			}
+		}
+		if m.Action == "CONNECT" {
+			// The UI can change the language of the connection at any time:
+			if m.Language != "" && !c.setLanguage(m.Language) {
+				c.send <- UIMsg{Action: "CONNECT", UserError: true,
+					ErrorMessage: fmt.Sprintf("Unknown language: %q", m.Language),
+					ErrorCode:    msgUnknownLanguage}
+			}
+			continue
+		}
+		if m.Action == "RESUME" {
+			// Replay the items processed before the page was reloaded:
+			for _, msg := range c.session.replay() {
+				c.send <- msg
+			}
+			continue
+		}
+		if c.observer {
+			c.send <- UIMsg{Action: m.Action, UserError: true,
+				ErrorMessage: "Observers cannot send actions", ErrorCode: msgReadOnly}
+			continue
+		}
+		if c.unit == nil {
+			// The RFID-unit is not connected (yet), so nothing is started:
+			c.send <- UIMsg{Action: "CONNECT", RFIDError: true, ErrorCode: msgRFIDError}
+			continue
+		}
+		if c.unit.state == UNITOff {
+			// TODO log warning? (UI is not aware of state-machine stopped)
+			c.unit = nil
+			continue
 		}
+		// The RFID-unit starts the session, in turn with its other requests:
+		c.unit.FromUI <- m
 	}
 }
@@ -1,11 +1,10 @@
 package main
 
 import (
+	"flag"
 	"log"
 	"net/http"
 	_ "net/http/pprof"
-	"os"
-	"strconv"
 
 	pool "gopkg.in/fatih/pool.v2"
 )
@@ -15,7 +14,10 @@ import (
 var (
 	sipPool pool.Pool // TODO move to hub struct
 	hub     *Hub
-	status  *appMetrics // TODO move to hub struct
+	status  *appMetrics     // TODO move to hub struct
+	audit   *auditLog       // nil if not enabled
+	breaker *circuitBreaker // SIP circuit breaker, nil if not enabled
+	offline *offlineQueue   // nil if not enabled
 )
 
 // APPLICATION ENTRY POINT
@@ -25,41 +27,29 @@ func init() {
 
 	// TODO create struct implementing http.handler
 	http.HandleFunc("/.status", statusHandler)
+	http.HandleFunc("/metrics", metricsHandler)
+	http.HandleFunc("/audit", auditHandler)
+	http.HandleFunc("/offline", offlineHandler)
+	http.HandleFunc("/offline/retry", offlineRetryHandler)
+	http.HandleFunc("/offline/discard", offlineDiscardHandler)
+	http.HandleFunc("/messages", messagesHandler)
+	http.HandleFunc("/admin/connections", adminConnectionsHandler)
+	http.HandleFunc("/admin/disconnect", adminDisconnectHandler)
+	http.HandleFunc("/admin/reset", adminResetHandler)
+	http.HandleFunc("/admin/command", adminCommandHandler)
 	http.HandleFunc("/ws", wsHandler)
 }
 
 func main() {
-	// Config defaults
-	cfg := config{
-		TCPPort:           "6005",
-		HTTPPort:          "8899",
-		SIPServer:         "localhost:6001",
-		SIPUser:           "autouser",
-		SIPPass:           "autopass",
-		NumSIPConnections: 3,
-	}
-	// Override with environment vars
-	if os.Getenv("TCP_PORT") != "" {
-		cfg.TCPPort = os.Getenv("TCP_PORT")
-	}
-	if os.Getenv("HTTP_PORT") != "" {
-		cfg.HTTPPort = os.Getenv("HTTP_PORT")
-	}
-	if os.Getenv("SIP_SERVER") != "" {
-		cfg.SIPServer = os.Getenv("SIP_SERVER")
-	}
-	if os.Getenv("SIP_USER") != "" {
-		cfg.SIPUser = os.Getenv("SIP_USER")
-	}
-	if os.Getenv("SIP_PASS") != "" {
-		cfg.SIPPass = os.Getenv("SIP_PASS")
-	}
-	if os.Getenv("SIP_CONNS") != "" {
-		n, _ := strconv.Atoi(os.Getenv("SIP_CONNS"))
-		cfg.NumSIPConnections = n
+	configFile := flag.String("config", "", "path to configuration file (JSON)")
+	flag.Parse()
+
+	cfg, err := loadConfig(*configFile)
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	log.Printf("Config: %+v", cfg)
+	log.Printf("Config: %+v", cfg.redacted())
 
 	hub = newHub(cfg)
 	status = registerMetrics()
@@ -67,8 +57,7 @@ func main() {
 	log.Println("Starting Websocket hub")
 	go hub.run()
 
-	log.Printf("Starting HTTP server, listening at port %v", cfg.HTTPPort)
-	if err := http.ListenAndServe(":"+cfg.HTTPPort, nil); err != nil {
+	if err := serve(cfg); err != nil {
 		log.Fatal(err)
 	}
 }
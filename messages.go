@@ -0,0 +1,155 @@
+package main
+
+import "fmt"
+
+// Message codes, sent to the UI in UIMsg.ErrorCode, item.StatusCode and
+// patron.StatusCode, so that the UI can tell what happened without parsing
+// messages. Statuses from the catalog are sent in the language of the UI
+// connection; the error messages in UIMsg.ErrorMessage are always in English,
+// and can be looked up in the catalog by ErrorCode.
+const (
+	// Item and patron statuses
+	msgItemUnknown      = "ITEM_UNKNOWN"
+	msgAlarmOnFailed    = "ALARM_ON_FAILED"
+	msgAlarmOffFailed   = "ALARM_OFF_FAILED"
+	msgSIPFailed        = "SIP_FAILED"
+	msgTagCountMismatch = "TAG_COUNT_MISMATCH"
+	msgWriteOK          = "WRITE_OK"
+	msgPatronUnknown    = "PATRON_UNKNOWN"
+	msgPatronBlocked    = "PATRON_BLOCKED"
+	msgSIPMessage       = "SIP_MESSAGE" // Status is a screen message from the SIP-server, which is not translated
+
+	// Errors
+	msgRFIDError        = "RFID_ERROR"
+	msgRFIDTimeout      = "RFID_TIMEOUT"
+	msgSIPError         = "SIP_ERROR"
+	msgSIPTimeout       = "SIP_TIMEOUT"
+	msgSIPUnavailable   = "SIP_UNAVAILABLE"
+	msgBadRequest       = "BAD_REQUEST"
+	msgUnknownLanguage  = "UNKNOWN_LANGUAGE"
+	msgPatronMissing    = "PATRON_MISSING"
+	msgNoCheckouts      = "NO_CHECKOUTS"
+	msgPrintFailed      = "PRINT_FAILED"
+	msgTokenExpired     = "TOKEN_EXPIRED"
+	msgBranchNotAllowed = "BRANCH_NOT_ALLOWED"
+	msgReadOnly         = "READ_ONLY"
+)
+
+// defaultLanguage is the language of the statuses made by the server, before
+// they are translated to the language of the UI connection.
+const defaultLanguage = "nb"
+
+// catalog holds the messages for each message code, by language. Messages
+// may have fmt verbs, for the arguments given to localize.
+var catalog = map[string]map[string]string{
+	"nb": {
+		msgItemUnknown:      "eksemplaret finnes ikke i basen",
+		msgAlarmOnFailed:    "Feil: fikk ikke skrudd på alarm.",
+		msgAlarmOffFailed:   "Feil: fikk ikke skrudd av alarm.",
+		msgSIPFailed:        "Feil: fikk ikke kontakt med SIP-serveren.",
+		msgTagCountMismatch: "forventet %d brikke(r), men fant %d.",
+		msgWriteOK:          "OK, preget",
+		msgPatronUnknown:    "låneren finnes ikke i basen",
+		msgPatronBlocked:    "låneren er sperret",
+		msgRFIDError:        "Feil: fikk ikke kontakt med RFID-enheten.",
+		msgRFIDTimeout:      "Feil: RFID-enheten svarte ikke.",
+		msgSIPError:         "Feil: fikk ikke kontakt med SIP-serveren.",
+		msgSIPTimeout:       "Feil: SIP-serveren svarte ikke.",
+		msgSIPUnavailable:   "Koha er utilgjengelig.",
+		msgBadRequest:       "Feil: ugyldig forespørsel.",
+		msgUnknownLanguage:  "Feil: ukjent språk.",
+		msgPatronMissing:    "Feil: låner mangler.",
+		msgNoCheckouts:      "Ingen utlån å lage kvittering for.",
+		msgPrintFailed:      "Feil: fikk ikke skrevet ut.",
+		msgTokenExpired:     "Innloggingen er utløpt. Last siden på nytt.",
+		msgBranchNotAllowed: "Feil: du er ikke logget inn på dette biblioteket.",
+		msgReadOnly:         "Denne skjermen kan bare vise utlån og innleveringer.",
+	},
+	"en": {
+		msgItemUnknown:      "item not found",
+		msgAlarmOnFailed:    "Error: failed to turn on the alarm.",
+		msgAlarmOffFailed:   "Error: failed to turn off the alarm.",
+		msgSIPFailed:        "Error: failed to contact the SIP-server.",
+		msgTagCountMismatch: "expected %d tag(s), but found %d.",
+		msgWriteOK:          "OK, written",
+		msgPatronUnknown:    "patron not found",
+		msgPatronBlocked:    "patron is blocked",
+		msgRFIDError:        "Error: failed to contact the RFID-unit.",
+		msgRFIDTimeout:      "Error: the RFID-unit didn't respond.",
+		msgSIPError:         "Error: failed to contact the SIP-server.",
+		msgSIPTimeout:       "Error: the SIP-server didn't respond.",
+		msgSIPUnavailable:   "Koha is unavailable.",
+		msgBadRequest:       "Error: invalid request.",
+		msgUnknownLanguage:  "Error: unknown language.",
+		msgPatronMissing:    "Error: patron missing.",
+		msgNoCheckouts:      "No checkouts to make a receipt for.",
+		msgPrintFailed:      "Error: printing failed.",
+		msgTokenExpired:     "The login has expired. Reload the page.",
+		msgBranchNotAllowed: "Error: you are not logged in at this branch.",
+		msgReadOnly:         "This screen can only show checkouts and checkins.",
+	},
+}
+
+// validLanguage returns true if there is a message catalog for the language.
+func validLanguage(lang string) bool {
+	_, ok := catalog[lang]
+	return ok
+}
+
+// localize returns the message with the given code in the given language,
+// falling back to the default language, and to the code itself if there is
+// no such message.
+func localize(lang, code string, args ...interface{}) string {
+	msg, ok := catalog[lang][code]
+	if !ok {
+		if msg, ok = catalog[defaultLanguage][code]; !ok {
+			return code
+		}
+	}
+	if len(args) > 0 {
+		return fmt.Sprintf(msg, args...)
+	}
+	return msg
+}
+
+// screenMessageCode returns the code of a status which is a screen message
+// from the SIP-server, or an empty string if there is no message.
+func screenMessageCode(s string) string {
+	if s == "" {
+		return ""
+	}
+	return msgSIPMessage
+}
+
+// setStatus sets the status of the item to the message with the given code,
+// in the default language. The status is cleared if code is empty.
+func (i *item) setStatus(code string, args ...interface{}) {
+	i.StatusCode = code
+	i.Status = ""
+	if code != "" {
+		i.Status = localize(defaultLanguage, code, args...)
+	}
+}
+
+// localize translates the statuses of the message to the given language.
+// Screen messages from the SIP-server are left as they are.
+func (m UIMsg) localize(lang string) UIMsg {
+	if lang == defaultLanguage {
+		return m
+	}
+	switch m.Item.StatusCode {
+	case "", msgSIPMessage:
+	case msgTagCountMismatch:
+		m.Item.Status = localize(lang, msgTagCountMismatch, m.Item.NumTags, m.Item.TagsFound)
+	default:
+		m.Item.Status = localize(lang, m.Item.StatusCode)
+	}
+	if m.PatronInfo != nil {
+		p := *m.PatronInfo
+		if p.StatusCode != "" && p.StatusCode != msgSIPMessage {
+			p.Status = localize(lang, p.StatusCode)
+		}
+		m.PatronInfo = &p
+	}
+	return m
+}
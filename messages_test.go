@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestCatalogs(t *testing.T) {
+	// All languages must have every message of the default language, with
+	// the same number of arguments:
+	for lang, msgs := range catalog {
+		for code, def := range catalog[defaultLanguage] {
+			msg, ok := msgs[code]
+			if !ok {
+				t.Errorf("catalog[%q] is missing %v", lang, code)
+				continue
+			}
+			if strings.Count(msg, "%") != strings.Count(def, "%") {
+				t.Errorf("catalog[%q][%v] = %q; arguments don't match %q", lang, code, msg, def)
+			}
+		}
+	}
+}
+
+func TestLocalize(t *testing.T) {
+	tests := []struct {
+		lang, code string
+		args       []interface{}
+		want       string
+	}{
+		{"nb", msgItemUnknown, nil, "eksemplaret finnes ikke i basen"},
+		{"en", msgItemUnknown, nil, "item not found"},
+		{"xx", msgItemUnknown, nil, "eksemplaret finnes ikke i basen"},
+		{"en", "NO_SUCH_CODE", nil, "NO_SUCH_CODE"},
+		{"en", msgTagCountMismatch, []interface{}{2, 1}, "expected 2 tag(s), but found 1."},
+	}
+	for _, tt := range tests {
+		if got := localize(tt.lang, tt.code, tt.args...); got != tt.want {
+			t.Errorf("localize(%q, %q, %v) => %q; want %q", tt.lang, tt.code, tt.args, got, tt.want)
+		}
+	}
+
+	var i item
+	i.NumTags = 2
+	i.TagsFound = 1
+	i.setStatus(msgTagCountMismatch, i.NumTags, i.TagsFound)
+	msg := UIMsg{Action: "CHECKIN", Item: i,
+		PatronInfo: &patron{Status: "Patron has fines", StatusCode: msgSIPMessage}}
+
+	got := msg.localize("en")
+	if want := "expected 2 tag(s), but found 1."; got.Item.Status != want {
+		t.Errorf("localize(en) => Item.Status %q; want %q", got.Item.Status, want)
+	}
+	if want := "Patron has fines"; got.PatronInfo.Status != want {
+		t.Errorf("localize(en) => PatronInfo.Status %q; want %q", got.PatronInfo.Status, want)
+	}
+	if want := "forventet 2 brikke(r), men fant 1."; msg.Item.Status != want {
+		t.Errorf("localize(en) changed the original message: %q", msg.Item.Status)
+	}
+}
+
+func TestConnectionLanguage(t *testing.T) {
+	// setup ->
+
+	uiChan := make(chan UIMsg)
+	sipSrv := newSIPTestServer()
+	defer sipSrv.Close()
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	d := newDummyRFIDReader()
+	defer d.Close()
+
+	hub = newHub(config{
+		HTTPPort:          port(srv.URL),
+		SIPServer:         sipSrv.Addr(),
+		TCPPort:           port(d.addr()),
+		NumSIPConnections: 1,
+		Language:          "nb",
+	})
+	go hub.run()
+	defer hub.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial(
+		fmt.Sprintf("ws://localhost:%s/ws?lang=en", port(srv.URL)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &dummyUIAgent{c: ws, msg: uiChan}
+	go a.run()
+	defer a.c.Close()
+
+	// <- end setup
+
+	<-d.incoming // VER2.00
+	d.outgoing <- []byte("OK\r")
+	<-uiChan // CONNECT
+
+	unknown := "64              00020140303    110236000000000000000000000000AOHUTL|AA1234|BLN|\r"
+
+	// The language is given by the lang query parameter
+	sipSrv.Respond(unknown)
+	err = a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"PATRON-INFO", "Patron": "1234", "Branch":"hutl"}`))
+	if err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	uiMsg := <-uiChan
+	want := &patron{Blocked: true, Status: "patron not found", StatusCode: msgPatronUnknown}
+	if !reflect.DeepEqual(uiMsg.PatronInfo, want) {
+		t.Errorf("Got %+v; want %+v", uiMsg.PatronInfo, want)
+	}
+
+	// An unknown language is refused, and the language is kept
+	err = a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CONNECT", "Language": "xx"}`))
+	if err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	uiMsg = <-uiChan
+	if !uiMsg.UserError || uiMsg.ErrorCode != msgUnknownLanguage {
+		t.Errorf("Got %+v; want UserError with ErrorCode %v", uiMsg, msgUnknownLanguage)
+	}
+
+	// The UI can change the language with CONNECT
+	err = a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CONNECT", "Language": "nb"}`))
+	if err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	sipSrv.Respond(unknown)
+	err = a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"PATRON-INFO", "Patron": "1234", "Branch":"hutl"}`))
+	if err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	uiMsg = <-uiChan
+	want = &patron{Blocked: true, Status: "låneren finnes ikke i basen", StatusCode: msgPatronUnknown}
+	if !reflect.DeepEqual(uiMsg.PatronInfo, want) {
+		t.Errorf("Got %+v; want %+v", uiMsg.PatronInfo, want)
+	}
+}
@@ -1,7 +1,11 @@
 package main
 
 import (
+	"fmt"
+	"io"
 	"os"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/rcrowley/go-metrics"
@@ -11,6 +15,27 @@ type appMetrics struct {
 	StartTime        time.Time
 	PID              int
 	ClientsConnected metrics.Counter
+
+	Checkins           *counterVec // by outcome
+	Checkouts          *counterVec // by outcome
+	Renewals           *counterVec // by outcome
+	OfflineCheckins    *counterVec // replayed, by outcome
+	AlarmFailures      *counterVec // by alarm (on/off)
+	Writes             *counterVec // by outcome
+	TagCountMismatches metrics.Counter
+	RFIDReconnects     metrics.Counter
+	RFIDTimeouts       *counterVec   // by state
+	SIPRequests        *histogramVec // duration by SIP message type
+	SIPTimeouts        metrics.Counter
+	SIPChecksumErrors  metrics.Counter
+	SIPConnsInUse      metrics.Counter
+	SIPConnsEvicted    *counterVec // by reason (dead/idle)
+	SIPPoolMaxCapacity metrics.Gauge
+	SIPCircuitTrips    metrics.Counter
+
+	// Running RFID-unit state-machines, with their last reported state:
+	mu    sync.Mutex
+	units map[*RFIDUnit]UnitState
 }
 
 type exportMetrics struct {
@@ -18,7 +43,8 @@ type exportMetrics struct {
 	PID                    int
 	ClientsConnected       int64
 	SIPPoolCurrentCapacity int
-	//SIPPoolMaxCapacity     int
+	SIPPoolMaxCapacity     int
+	SIPCircuit             string // closed/open/half-open
 }
 
 func registerMetrics() *appMetrics {
@@ -29,9 +55,64 @@ func registerMetrics() *appMetrics {
 	m.ClientsConnected = metrics.NewCounter()
 	metrics.Register("ClientsConnected", m.ClientsConnected)
 
+	m.Checkins = newCounterVec("outcome")
+	m.Checkouts = newCounterVec("outcome")
+	m.Renewals = newCounterVec("outcome")
+	m.OfflineCheckins = newCounterVec("outcome")
+	m.AlarmFailures = newCounterVec("alarm")
+	m.Writes = newCounterVec("outcome")
+	m.TagCountMismatches = metrics.NewCounter()
+	m.RFIDReconnects = metrics.NewCounter()
+	m.RFIDTimeouts = newCounterVec("state")
+	m.SIPRequests = newHistogramVec("message", sipLatencyBuckets)
+	m.SIPTimeouts = metrics.NewCounter()
+	m.SIPChecksumErrors = metrics.NewCounter()
+	m.SIPConnsInUse = metrics.NewCounter()
+	m.SIPConnsEvicted = newCounterVec("reason")
+	m.SIPPoolMaxCapacity = metrics.NewGauge()
+	m.SIPCircuitTrips = metrics.NewCounter()
+	m.units = make(map[*RFIDUnit]UnitState)
+
 	return &m
 }
 
+// addUnit registers a running RFID-unit state-machine, in the given state.
+func (m *appMetrics) addUnit(u *RFIDUnit, s UnitState) {
+	m.mu.Lock()
+	m.units[u] = s
+	m.mu.Unlock()
+}
+
+// setUnitState records the current state of a running RFID-unit
+// state-machine. It is called by the state-machine itself, as its state is
+// not safe to read from other goroutines.
+func (m *appMetrics) setUnitState(u *RFIDUnit, s UnitState) {
+	m.mu.Lock()
+	if _, ok := m.units[u]; ok {
+		m.units[u] = s
+	}
+	m.mu.Unlock()
+}
+
+// removeUnit unregisters a RFID-unit state-machine which has shut down.
+func (m *appMetrics) removeUnit(u *RFIDUnit) {
+	m.mu.Lock()
+	delete(m.units, u)
+	m.mu.Unlock()
+}
+
+// unitStates returns the number of running RFID-unit state-machines in each
+// state.
+func (m *appMetrics) unitStates() map[string]int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	states := make(map[string]int64)
+	for _, s := range m.units {
+		states[s.String()]++
+	}
+	return states
+}
+
 func (m *appMetrics) Export() *exportMetrics {
 	now := time.Now()
 	uptime := now.Sub(m.StartTime)
@@ -41,6 +122,183 @@ func (m *appMetrics) Export() *exportMetrics {
 		PID:                    m.PID,
 		ClientsConnected:       m.ClientsConnected.Count(),
 		SIPPoolCurrentCapacity: sipPool.Len(),
-		//SIPPoolMaxCapacity:     sipPool.MaximumCapacity(),
+		SIPPoolMaxCapacity:     int(m.SIPPoolMaxCapacity.Value()),
+		SIPCircuit:             breaker.State().String(),
+	}
+}
+
+// WritePrometheus writes the metrics in the Prometheus text exposition format.
+func (m *appMetrics) WritePrometheus(w io.Writer) {
+	writeMetric(w, "rfidhub_uptime_seconds", "gauge", "Time since the RFID-hub started.",
+		"", time.Since(m.StartTime).Seconds())
+	writeMetric(w, "rfidhub_clients_connected", "gauge", "Number of connected UI websockets.",
+		"", m.ClientsConnected.Count())
+	m.Checkins.write(w, "rfidhub_checkins_total", "Number of checkins, by outcome.")
+	m.Checkouts.write(w, "rfidhub_checkouts_total", "Number of checkouts, by outcome.")
+	m.Renewals.write(w, "rfidhub_renewals_total", "Number of renewals, by outcome.")
+	m.OfflineCheckins.write(w, "rfidhub_offline_checkins_replayed_total",
+		"Number of offline checkins sent to Koha, by outcome.")
+	writeMetric(w, "rfidhub_offline_checkins_pending", "gauge",
+		"Number of offline checkins waiting to be sent to Koha.", "", offline.Len(offlinePending))
+	writeMetric(w, "rfidhub_offline_checkins_conflicts", "gauge",
+		"Number of offline checkins refused by Koha.", "", offline.Len(offlineConflict))
+	m.AlarmFailures.write(w, "rfidhub_alarm_failures_total", "Number of failures to turn alarm on or off.")
+	writeMetric(w, "rfidhub_tag_count_mismatches_total", "counter",
+		"Number of writes aborted because of unexpected number of tags.",
+		"", m.TagCountMismatches.Count())
+	m.Writes.write(w, "rfidhub_writes_total", "Number of RFID-tag writes, by outcome.")
+	writeMetric(w, "rfidhub_rfid_reconnects_total", "counter",
+		"Number of reconnects to RFID-units after lost connection.",
+		"", m.RFIDReconnects.Count())
+	m.RFIDTimeouts.write(w, "rfidhub_rfid_timeouts_total",
+		"Number of times a RFID-unit didn't respond in time, by state.")
+	m.SIPRequests.write(w, "rfidhub_sip_request_duration_seconds",
+		"Duration of SIP requests, by SIP message type.")
+	writeMetric(w, "rfidhub_sip_timeouts_total", "counter",
+		"Number of SIP requests where the SIP-server didn't respond in time.",
+		"", m.SIPTimeouts.Count())
+	writeMetric(w, "rfidhub_sip_checksum_errors_total", "counter",
+		"Number of SIP responses with wrong checksum.", "", m.SIPChecksumErrors.Count())
+	writeMetric(w, "rfidhub_sip_connections_in_use", "gauge",
+		"Number of SIP connections currently in use.", "", m.SIPConnsInUse.Count())
+	if sipPool != nil {
+		writeMetric(w, "rfidhub_sip_connections_idle", "gauge",
+			"Number of idle SIP connections in the pool.", "", sipPool.Len())
+	}
+	m.SIPConnsEvicted.write(w, "rfidhub_sip_connections_evicted_total",
+		"Number of idle SIP connections closed by the health check, by reason.")
+	writeMetric(w, "rfidhub_sip_connections_max", "gauge",
+		"Maximum number of SIP connections in the pool.", "", m.SIPPoolMaxCapacity.Value())
+	writeMetric(w, "rfidhub_sip_circuit_trips_total", "counter",
+		"Number of times the SIP circuit breaker has opened.", "", m.SIPCircuitTrips.Count())
+	var open int
+	if breaker.State() != breakerClosed {
+		open = 1
+	}
+	writeMetric(w, "rfidhub_sip_circuit_open", "gauge",
+		"1 if requests to the SIP-server are suspended by the circuit breaker.", "", open)
+
+	fmt.Fprintf(w, "# HELP rfidhub_units Number of RFID-unit state-machines, by state.\n")
+	fmt.Fprintf(w, "# TYPE rfidhub_units gauge\n")
+	states := m.unitStates()
+	for st := UnitState(0); int(st) < len(unitStateNames); st++ {
+		fmt.Fprintf(w, "rfidhub_units{state=%q} %d\n", st.String(), states[st.String()])
+	}
+}
+
+// writeMetric writes a single metric in the Prometheus text format.
+func writeMetric(w io.Writer, name, typ, help, labels string, value interface{}) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s%s %v\n", name, help, name, typ, name, labels, value)
+}
+
+// counterVec is a set of counters, partitioned by the value of a label.
+type counterVec struct {
+	mu       sync.Mutex
+	label    string
+	counters map[string]metrics.Counter
+}
+
+func newCounterVec(label string) *counterVec {
+	return &counterVec{label: label, counters: make(map[string]metrics.Counter)}
+}
+
+// Inc increments the counter for the given label value.
+func (v *counterVec) Inc(value string) {
+	v.mu.Lock()
+	c, ok := v.counters[value]
+	if !ok {
+		c = metrics.NewCounter()
+		v.counters[value] = c
+	}
+	v.mu.Unlock()
+	c.Inc(1)
+}
+
+// Count returns the count for the given label value.
+func (v *counterVec) Count(value string) int64 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if c, ok := v.counters[value]; ok {
+		return c.Count()
+	}
+	return 0
+}
+
+func (v *counterVec) write(w io.Writer, name, help string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+	values := make([]string, 0, len(v.counters))
+	for value := range v.counters {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+	for _, value := range values {
+		fmt.Fprintf(w, "%s{%s=%q} %d\n", name, v.label, value, v.counters[value].Count())
+	}
+}
+
+// sipLatencyBuckets are the upper bounds, in seconds, of the SIP request
+// duration histogram.
+var sipLatencyBuckets = []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// histogram counts observations in buckets, as a Prometheus histogram.
+type histogram struct {
+	counts []int64 // per bucket, not cumulative
+	count  int64
+	sum    float64
+}
+
+// histogramVec is a set of histograms, partitioned by the value of a label.
+type histogramVec struct {
+	mu         sync.Mutex
+	label      string
+	buckets    []float64
+	histograms map[string]*histogram
+}
+
+func newHistogramVec(label string, buckets []float64) *histogramVec {
+	return &histogramVec{label: label, buckets: buckets, histograms: make(map[string]*histogram)}
+}
+
+// Observe adds an observation to the histogram for the given label value.
+func (v *histogramVec) Observe(value string, d time.Duration) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	h, ok := v.histograms[value]
+	if !ok {
+		h = &histogram{counts: make([]int64, len(v.buckets))}
+		v.histograms[value] = h
+	}
+	secs := d.Seconds()
+	for i, le := range v.buckets {
+		if secs <= le {
+			h.counts[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += secs
+}
+
+func (v *histogramVec) write(w io.Writer, name, help string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	values := make([]string, 0, len(v.histograms))
+	for value := range v.histograms {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+	for _, value := range values {
+		h := v.histograms[value]
+		var cum int64
+		for i, le := range v.buckets {
+			cum += h.counts[i]
+			fmt.Fprintf(w, "%s_bucket{%s=%q,le=\"%v\"} %d\n", name, v.label, value, le, cum)
+		}
+		fmt.Fprintf(w, "%s_bucket{%s=%q,le=\"+Inf\"} %d\n", name, v.label, value, h.count)
+		fmt.Fprintf(w, "%s_sum{%s=%q} %v\n", name, v.label, value, h.sum)
+		fmt.Fprintf(w, "%s_count{%s=%q} %d\n", name, v.label, value, h.count)
 	}
 }
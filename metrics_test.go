@@ -1,12 +1,15 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestStatusEndpoint(t *testing.T) {
@@ -52,6 +55,9 @@ func TestStatusEndpoint(t *testing.T) {
 	a := newDummyUIAgent(uiChan, port(srv.URL))
 	defer a.c.Close()
 
+	// The CONNECT message is sent after the client has been counted.
+	<-uiChan
+
 	r.Body.Close()
 	r, err = http.Get(fmt.Sprintf("http://localhost:%s/.status", port(srv.URL)))
 
@@ -73,7 +79,77 @@ func TestStatusEndpoint(t *testing.T) {
 		t.Errorf("status.ClientsConnected => %v, expected 1", status.ClientsConnected)
 	}
 
-	<-uiChan
-
 	a.c.Close()
 }
+
+func TestPrometheusEndpoint(t *testing.T) {
+	// Setup: ->
+
+	sipSrv := newSIPTestServer()
+	defer sipSrv.Close()
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	hub = newHub(config{
+		HTTPPort:          port(srv.URL),
+		SIPServer:         sipSrv.Addr(),
+		TCPPort:           "12346", // not listening
+		NumSIPConnections: 1,
+	})
+	go hub.run()
+	defer hub.Close()
+
+	// <- end setup
+
+	status.Checkins.Inc("ok")
+
+	r, err := http.Get(fmt.Sprintf("http://localhost:%s/metrics", port(srv.URL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Body.Close()
+
+	if ct := r.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("Content-Type => %q; want text/plain", ct)
+	}
+
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		"# TYPE rfidhub_checkins_total counter\n",
+		`rfidhub_checkins_total{outcome="ok"} `,
+		"# TYPE rfidhub_sip_request_duration_seconds histogram\n",
+		"rfidhub_sip_connections_max 1\n",
+		`rfidhub_units{state="UNITIdle"} `,
+	} {
+		if !bytes.Contains(b, []byte(want)) {
+			t.Errorf("/metrics missing %q", want)
+		}
+	}
+}
+
+func TestHistogramVec(t *testing.T) {
+	h := newHistogramVec("message", []float64{0.1, 1})
+	h.Observe("09", 50*time.Millisecond)
+	h.Observe("09", 500*time.Millisecond)
+	h.Observe("09", 5*time.Second)
+
+	var b bytes.Buffer
+	h.write(&b, "sip_seconds", "SIP latency.")
+
+	want := `# HELP sip_seconds SIP latency.
+# TYPE sip_seconds histogram
+sip_seconds_bucket{message="09",le="0.1"} 1
+sip_seconds_bucket{message="09",le="1"} 2
+sip_seconds_bucket{message="09",le="+Inf"} 3
+sip_seconds_sum{message="09"} 5.55
+sip_seconds_count{message="09"} 3
+`
+	if b.String() != want {
+		t.Errorf("Got:\n%s\nWant:\n%s", b.String(), want)
+	}
+}
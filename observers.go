@@ -0,0 +1,61 @@
+package main
+
+import (
+	"log"
+	"sync"
+)
+
+// observerBuffer is the number of messages buffered for an observer, before
+// messages to it are dropped.
+const observerBuffer = 64
+
+// observerSet holds the observers of the workstations: read-only UI
+// connections, eg. patron-facing displays or supervisor dashboards, which get
+// a copy of every message sent to the controlling UI connection of the
+// workstation.
+type observerSet struct {
+	mu        sync.Mutex
+	observers map[string]map[*uiConn]bool // keyed by workstation identifier
+}
+
+func newObserverSet() *observerSet {
+	return &observerSet{observers: make(map[string]map[*uiConn]bool)}
+}
+
+func (s *observerSet) add(c *uiConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.observers[c.workstation] == nil {
+		s.observers[c.workstation] = make(map[*uiConn]bool)
+	}
+	s.observers[c.workstation][c] = true
+}
+
+// remove removes the observer. No messages are sent to it afterwards, so
+// that its send channel can be closed.
+func (s *observerSet) remove(c *uiConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.observers[c.workstation], c)
+	if len(s.observers[c.workstation]) == 0 {
+		delete(s.observers, c.workstation)
+	}
+}
+
+// send sends a copy of the message to the observers of the workstation. An
+// observer which doesn't keep up misses messages, rather than holding up the
+// controlling UI connection. Nothing is sent if s is nil.
+func (s *observerSet) send(workstation string, msg UIMsg) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.observers[workstation] {
+		select {
+		case c.send <- msg:
+		default:
+			log.Printf("WARN: UI[%v] observer at IP %v not keeping up; message dropped", workstation, c.ip)
+		}
+	}
+}
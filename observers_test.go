@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestObservers(t *testing.T) {
+	// Setup: ->
+
+	uiChan := make(chan UIMsg)
+	obsChan := make(chan UIMsg)
+	sipSrv := newSIPTestServer()
+	defer sipSrv.Close()
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	d := newDummyRFIDReader()
+	defer d.Close()
+
+	hub = newHub(config{
+		HTTPPort:          port(srv.URL),
+		SIPServer:         sipSrv.Addr(),
+		TCPPort:           port(d.addr()),
+		NumSIPConnections: 1,
+		Observers:         map[string]string{"127.0.0.1": "desk1"},
+	})
+	go hub.run()
+	defer hub.Close()
+
+	url := fmt.Sprintf("ws://localhost:%s/ws?workstation=desk1", port(srv.URL))
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &dummyUIAgent{c: ws, msg: uiChan}
+	go a.run()
+	defer a.c.Close()
+
+	// <- end setup
+
+	<-d.incoming
+	d.outgoing <- []byte("OK\r")
+	<-uiChan // CONNECT
+
+	// Observers can only follow the workstations they are allowed to
+	obsURL := fmt.Sprintf("ws://localhost:%s/ws?workstation=desk2&role=observer", port(srv.URL))
+	if _, resp, err := websocket.DefaultDialer.Dial(obsURL, nil); err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Dial(%q) => %v, %v; want status %d", obsURL, resp, err, http.StatusForbidden)
+	}
+
+	// An observer connects alongside the UI, and is told that the RFID-unit
+	// is connected
+	ws, _, err = websocket.DefaultDialer.Dial(url+"&role=observer&lang=en", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := &dummyUIAgent{c: ws, msg: obsChan}
+	go o.run()
+	defer o.c.Close()
+
+	if got, want := <-obsChan, (UIMsg{Action: "CONNECT"}); !reflect.DeepEqual(got, want) {
+		t.Errorf("Observer got %+v; want %+v", got, want)
+	}
+
+	// The observer cannot send actions
+	err = o.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKIN","Branch":"hutl"}`))
+	if err != nil {
+		t.Fatal("Observer failed to send message over websokcet conn")
+	}
+	if got := <-obsChan; !got.UserError || got.ErrorCode != msgReadOnly {
+		t.Errorf("Observer got %+v; want UserError with ErrorCode %v", got, msgReadOnly)
+	}
+
+	// The observer gets the messages sent to the UI, in its own language
+	err = a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKIN","Branch":"hutl"}`))
+	if err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	<-d.incoming // BEG
+	d.outgoing <- []byte("OK\r")
+
+	sipSrv.Respond("100NUY20140128    114702AO|AB234567890|CV99|AFItem not checked out|\r")
+	d.outgoing <- []byte("RDT1003010824124004:NO:02030000|0\r")
+	<-d.incoming // alarm unchanged
+	d.outgoing <- []byte("OK\r")
+
+	uiMsg := <-uiChan
+	obsMsg := <-obsChan
+	if uiMsg.Item.Status != "eksemplaret finnes ikke i basen" {
+		t.Errorf("UI got %+v; want item not found in Norwegian", uiMsg)
+	}
+	want := uiMsg
+	want.Item.Status = "item not found"
+	if !reflect.DeepEqual(obsMsg, want) {
+		t.Errorf("Observer got %+v; want %+v", obsMsg, want)
+	}
+
+	// The UI is not affected when the observer disconnects
+	o.c.Close()
+	err = a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"END"}`))
+	if err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	if msg := <-d.incoming; string(msg) != "END\r" {
+		t.Errorf("RFID-unit got %q; want END", msg)
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	pool "gopkg.in/fatih/pool.v2"
+)
+
+// offlineCheckin is a checkin done while the SIP-server was unavailable,
+// waiting to be sent to Koha.
+type offlineCheckin struct {
+	ID          int64
+	Time        time.Time // when the item was checked in
+	Workstation string
+	Staff       string `json:",omitempty"` // Koha user who checked in the item, if authenticated
+	Branch      string
+	Barcode     string
+	Tag         string
+	Status      string // pending/conflict
+	Attempts    int    // number of attempts to send the checkin to Koha
+	LastAttempt time.Time
+	LastError   string `json:",omitempty"` // SIP error, or why Koha refused the checkin
+}
+
+const (
+	offlinePending  = "pending"  // waiting to be sent to Koha
+	offlineConflict = "conflict" // refused by Koha; must be resolved by staff
+)
+
+// offlineQueue is a durable queue of offline checkins, stored as a JSON
+// array in a file which is rewritten on every change. Checkins are sent to
+// Koha, oldest first, by replay. A checkin is removed from the queue when it
+// succeeds, or is discarded by staff. If Koha refuses a checkin, eg. because
+// the item was checked out again before it could be sent, it is kept as a
+// conflict until it is retried or discarded.
+//
+// A nil *offlineQueue is a disabled queue.
+type offlineQueue struct {
+	path    string
+	trigger chan struct{}
+	stop    chan struct{}
+
+	mu      sync.Mutex
+	entries []offlineCheckin
+	nextID  int64
+}
+
+// openOfflineQueue loads the offline queue at the given path, creating it if
+// it doesn't exist.
+func openOfflineQueue(path string) (*offlineQueue, error) {
+	q := &offlineQueue{
+		path:    path,
+		trigger: make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		nextID:  1,
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return q, q.save()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &q.entries); err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	for _, e := range q.entries {
+		if e.ID >= q.nextID {
+			q.nextID = e.ID + 1
+		}
+	}
+	return q, nil
+}
+
+// save writes the queue to a temporary file, which then replaces the queue
+// file. The caller must hold q.mu.
+func (q *offlineQueue) save() error {
+	b, err := json.MarshalIndent(q.entries, "", "\t")
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(q.path), filepath.Base(q.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), q.path)
+}
+
+// Add queues a checkin, and returns it.
+func (q *offlineQueue) Add(e offlineCheckin) (offlineCheckin, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	e.ID = q.nextID
+	e.Status = offlinePending
+	q.entries = append(q.entries, e)
+	if err := q.save(); err != nil {
+		q.entries = q.entries[:len(q.entries)-1]
+		return e, err
+	}
+	q.nextID++
+	return e, nil
+}
+
+// List returns the queued checkins with the given status, or all if status is
+// empty, oldest first.
+func (q *offlineQueue) List(status string) []offlineCheckin {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	res := []offlineCheckin{}
+	for _, e := range q.entries {
+		if status == "" || e.Status == status {
+			res = append(res, e)
+		}
+	}
+	return res
+}
+
+// Len returns the number of queued checkins with the given status.
+func (q *offlineQueue) Len(status string) int {
+	if q == nil {
+		return 0
+	}
+	return len(q.List(status))
+}
+
+// update applies f to the queued checkin with the given id, and saves the
+// queue. It returns false if there is no such checkin.
+func (q *offlineQueue) update(id int64, f func(*offlineCheckin)) (bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i := range q.entries {
+		if q.entries[i].ID == id {
+			f(&q.entries[i])
+			return true, q.save()
+		}
+	}
+	return false, nil
+}
+
+// remove removes the queued checkin with the given id. It returns false if
+// there is no such checkin.
+func (q *offlineQueue) remove(id int64) (bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, e := range q.entries {
+		if e.ID == id {
+			q.entries = append(q.entries[:i], q.entries[i+1:]...)
+			return true, q.save()
+		}
+	}
+	return false, nil
+}
+
+// Retry marks the checkin with the given id, or all conflicts if id is 0, as
+// pending, and triggers a replay. It returns false if there is no such
+// checkin.
+func (q *offlineQueue) Retry(id int64) (bool, error) {
+	found := id == 0
+	var err error
+	if id == 0 {
+		q.mu.Lock()
+		for i := range q.entries {
+			q.entries[i].Status = offlinePending
+		}
+		err = q.save()
+		q.mu.Unlock()
+	} else {
+		found, err = q.update(id, func(e *offlineCheckin) { e.Status = offlinePending })
+	}
+	if found && err == nil {
+		q.Trigger()
+	}
+	return found, err
+}
+
+// Discard removes the checkin with the given id from the queue, without
+// sending it to Koha. It returns false if there is no such checkin.
+func (q *offlineQueue) Discard(id int64) (bool, error) {
+	return q.remove(id)
+}
+
+// Trigger makes the replay loop send the pending checkins right away.
+func (q *offlineQueue) Trigger() {
+	if q == nil {
+		return
+	}
+	select {
+	case q.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// run sends the pending checkins to Koha at the given interval, or when
+// triggered, until the queue is closed.
+func (q *offlineQueue) run(p pool.Pool, interval time.Duration) {
+	for {
+		select {
+		case <-time.After(interval):
+		case <-q.trigger:
+		case <-q.stop:
+			return
+		}
+		q.replay(p)
+	}
+}
+
+// replay sends the pending checkins to Koha, oldest first, with the original
+// transaction date. It stops at the first SIP error, as the SIP-server is
+// probably still unavailable.
+func (q *offlineQueue) replay(p pool.Pool) {
+	for _, e := range q.List(offlinePending) {
+		res, err := DoSIPCall(p, sipFormMsgOfflineCheckin(e.Branch, e.Barcode, e.Time), checkinParse)
+		if err != nil {
+			log.Printf("WARN: failed to send offline checkin of %v: %v", e.Barcode, err)
+			q.update(e.ID, func(e *offlineCheckin) {
+				e.Attempts++
+				e.LastAttempt = time.Now()
+				e.LastError = err.Error()
+			})
+			return
+		}
+
+		outcome := transactionOutcome(res.Item)
+		status.OfflineCheckins.Inc(outcome)
+		err = audit.Record(auditEntry{
+			Time:        time.Now(),
+			Action:      "OFFLINE-CHECKIN",
+			Workstation: e.Workstation,
+			Staff:       e.Staff,
+			Branch:      e.Branch,
+			Barcode:     e.Barcode,
+			Tag:         e.Tag,
+			SIP:         outcome,
+			Item:        res.Item,
+		})
+		if err != nil {
+			log.Printf("ERROR: failed to write to audit log: %v", err)
+		}
+		if outcome != "ok" {
+			log.Printf("WARN: offline checkin of %v refused by Koha: %v", e.Barcode, res.Item.Status)
+			_, err = q.update(e.ID, func(e *offlineCheckin) {
+				e.Status = offlineConflict
+				e.Attempts++
+				e.LastAttempt = time.Now()
+				e.LastError = res.Item.Status
+			})
+		} else {
+			log.Printf("Offline checkin of %v sent to Koha", e.Barcode)
+			_, err = q.remove(e.ID)
+		}
+		if err != nil {
+			log.Printf("ERROR: failed to save offline queue: %v", err)
+		}
+	}
+}
+
+// Close stops the replay loop.
+func (q *offlineQueue) Close() {
+	if q == nil {
+		return
+	}
+	close(q.stop)
+}
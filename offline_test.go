@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"gopkg.in/fatih/pool.v2"
+)
+
+func TestOfflineQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rfidhub-offline")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "offline.json")
+
+	q, err := openOfflineQueue(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkedIn := time.Date(2014, 3, 24, 14, 2, 0, 0, time.Local)
+	for _, barcode := range []string{"03010824124004", "03011143299001", "234567890"} {
+		if _, err := q.Add(offlineCheckin{Time: checkedIn, Branch: "hutl", Barcode: barcode}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The queue survives a restart:
+	q, err = openOfflineQueue(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := q.Len(offlinePending); n != 3 {
+		t.Fatalf("reopened queue: Len(pending) => %d; want 3", n)
+	}
+	if found, err := q.Discard(2); !found || err != nil {
+		t.Fatalf("Discard(2) => %v, %v; want true, nil", found, err)
+	}
+	if found, _ := q.Retry(2); found {
+		t.Errorf("Retry(2) after discard => true; want false")
+	}
+
+	// Replay: the first checkin succeeds, and is removed from the queue; the
+	// second is refused by Koha, and kept as a conflict.
+	srv := newSIPTestServer()
+	defer srv.Close()
+	p, err := pool.NewChannelPool(1, 1, initSIPConn(config{SIPServer: srv.Addr()}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.RespondSeq(
+		"101YNN20140324    140200AOhutl|AB03010824124004|AQhutl|AJHeavy metal in Baghdad|AA1|\r",
+		"100NUY20140324    140200AOhutl|AB234567890|CV99|AFItem not checked out|\r", // unknown barcode
+	)
+	q.replay(p)
+
+	got := q.List("")
+	if len(got) != 1 {
+		t.Fatalf("after replay: List() => %+v; want 1 entry", got)
+	}
+	if got[0].ID != 3 || got[0].Status != offlineConflict || got[0].LastError != "eksemplaret finnes ikke i basen" || got[0].Attempts != 1 {
+		t.Errorf("after replay: List() => %+v; want conflict for id 3", got)
+	}
+	if c := q.List(offlineConflict); !reflect.DeepEqual(c, got) {
+		t.Errorf("List(conflict) => %+v; want %+v", c, got)
+	}
+
+	// The checkin is sent with the original date, and must not be blocked:
+	msg := sipFormMsgOfflineCheckin("hutl", "234567890", checkedIn).String()
+	if want := "09Y20140324    140200"; !strings.HasPrefix(msg, want) {
+		t.Errorf("sipFormMsgOfflineCheckin => %q; want prefix %q", msg, want)
+	}
+}
+
+func TestOfflineCheckin(t *testing.T) {
+	// Setup: ->
+
+	dir, err := ioutil.TempDir("", "rfidhub-offline")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	uiChan := make(chan UIMsg)
+	sipSrv := newSIPTestServer().Failing()
+	defer sipSrv.Close()
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	d := newDummyRFIDReader()
+	defer d.Close()
+
+	hub = newHub(config{
+		HTTPPort:          port(srv.URL),
+		SIPServer:         sipSrv.Addr(),
+		TCPPort:           port(d.addr()),
+		NumSIPConnections: 1,
+		OfflineQueue:      filepath.Join(dir, "offline.json"),
+		AdminToken:        testAdminToken,
+	})
+	go hub.run()
+	defer hub.Close()
+
+	a := newDummyUIAgent(uiChan, port(srv.URL))
+	defer a.c.Close()
+
+	// <- end setup
+
+	<-d.incoming // VER2.00
+	d.outgoing <- []byte("OK\r")
+	<-uiChan // CONNECT
+
+	err = a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKIN","Branch":"hutl"}`))
+	if err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	<-d.incoming // BEG
+	d.outgoing <- []byte("OK\r")
+
+	// The SIP-server is down, but the item is checked in offline, and the
+	// alarm turned on:
+	d.outgoing <- []byte("RDT1003010824124004:NO:02030000|0\r")
+	if msg := <-d.incoming; string(msg) != "OK1\r" {
+		t.Fatalf("RFID-unit got %q; want alarm on (OK1)", msg)
+	}
+	d.outgoing <- []byte("OK\r")
+	uiMsg := <-uiChan
+	want := UIMsg{Action: "CHECKIN", Item: item{Barcode: "03010824124004", Offline: true}}
+	if !reflect.DeepEqual(uiMsg, want) {
+		t.Errorf("Got %+v; want %+v", uiMsg, want)
+	}
+
+	queued := getOfflineQueue(t, srv.URL, "pending")
+	if len(queued) != 1 || queued[0].Barcode != "1003010824124004" || queued[0].Branch != "hutl" {
+		t.Fatalf("GET /offline?status=pending => %+v; want the offline checkin", queued)
+	}
+
+	// The checkin is sent to Koha when retried, once the SIP-server is back:
+	sipSrv.Respond("101YNN20140226    161239AOhutl|AB03010824124004|AQhutl|AJHeavy metal in Baghdad|AA1|\r")
+	sipSrv.SetFailing(false)
+	id := fmt.Sprint(queued[0].ID)
+	if code, _ := adminDo(t, "POST", srv.URL+"/offline/retry?id="+id, "", ""); code != http.StatusUnauthorized {
+		t.Errorf("POST /offline/retry without token => %d; want 401 Unauthorized", code)
+	}
+	if code, body := adminDo(t, "POST", srv.URL+"/offline/retry?id="+id, testAdminToken, ""); code != http.StatusNoContent {
+		t.Fatalf("POST /offline/retry => %d %s; want 204 No Content", code, body)
+	}
+	for i := 0; len(queued) > 0; i++ {
+		if i == 100 {
+			t.Fatalf("offline checkin not sent to Koha: %+v", queued)
+		}
+		time.Sleep(10 * time.Millisecond)
+		queued = getOfflineQueue(t, srv.URL, "")
+	}
+
+	if code, _ := adminDo(t, "POST", srv.URL+"/offline/discard?id="+id, testAdminToken, ""); code != http.StatusNotFound {
+		t.Errorf("POST /offline/discard of sent checkin => %d; want 404 Not Found", code)
+	}
+}
+
+func TestOfflineCheckinSIPTimeout(t *testing.T) {
+	// Setup: ->
+
+	dir, err := ioutil.TempDir("", "rfidhub-offline")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	uiChan := make(chan UIMsg)
+	sipSrv := newSIPTestServer().Hanging()
+	defer sipSrv.Close()
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	d := newDummyRFIDReader()
+	defer d.Close()
+
+	hub = newHub(config{
+		HTTPPort:          port(srv.URL),
+		SIPServer:         sipSrv.Addr(),
+		TCPPort:           port(d.addr()),
+		NumSIPConnections: 1,
+		SIPConnectTimeout: duration{50 * time.Millisecond},
+		SIPReadTimeout:    duration{50 * time.Millisecond},
+		OfflineQueue:      filepath.Join(dir, "offline.json"),
+		AdminToken:        testAdminToken,
+	})
+	go hub.run()
+	defer hub.Close()
+
+	a := newDummyUIAgent(uiChan, port(srv.URL))
+	defer a.c.Close()
+
+	// <- end setup
+
+	<-d.incoming // VER2.00
+	d.outgoing <- []byte("OK\r")
+	<-uiChan // CONNECT
+
+	err = a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKIN","Branch":"hutl"}`))
+	if err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	<-d.incoming // BEG
+	d.outgoing <- []byte("OK\r")
+
+	// The SIP-server got the checkin, but didn't respond in time. Koha might
+	// have checked in the item, so it must not be queued; the checkin fails,
+	// and the alarm is left unchanged:
+	d.outgoing <- []byte("RDT1003010824124004:NO:02030000|0\r")
+	uiMsg := <-uiChan
+	if !uiMsg.SIPTimeout {
+		t.Errorf("Got %+v; want SIP timeout", uiMsg)
+	}
+	if msg := <-d.incoming; string(msg) != "OK \r" {
+		t.Fatalf("RFID-unit got %q; want alarm leave (OK )", msg)
+	}
+	d.outgoing <- []byte("OK\r")
+	uiMsg = <-uiChan
+	if uiMsg.Action != "CHECKIN" || uiMsg.Item.Offline || !uiMsg.Item.TransactionFailed || uiMsg.Item.StatusCode != msgSIPFailed {
+		t.Errorf("Got %+v; want failed checkin", uiMsg)
+	}
+
+	if queued := getOfflineQueue(t, srv.URL, ""); len(queued) != 0 {
+		t.Errorf("GET /offline => %+v; want empty queue", queued)
+	}
+}
+
+func getOfflineQueue(t *testing.T, srvURL, status string) []offlineCheckin {
+	code, body := adminDo(t, "GET", srvURL+"/offline?status="+status, testAdminToken, "")
+	if code != http.StatusOK {
+		t.Fatalf("GET /offline => %d %s; want 200 OK", code, body)
+	}
+	var res []offlineCheckin
+	if err := json.Unmarshal([]byte(body), &res); err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	htmltemplate "html/template"
+	"io/ioutil"
+	"net"
+	"text/template"
+	"time"
+)
+
+// printerPort is the port of network receipt printers, if none is given.
+const printerPort = "9100"
+
+// printerTimeout is the time allowed for connecting and sending a printout to
+// a network printer.
+const printerTimeout = 5 * time.Second
+
+// printQueueSize is the number of printouts which can wait for the printer of
+// a workstation.
+const printQueueSize = 10
+
+// printout is a receipt or slip, rendered as plain text, HTML and ESC/POS, so that
+// the UI can show or print it in the format which suits it.
+type printout struct {
+	Text    string
+	HTML    string
+	ESCPOS  []byte // base64 encoded in JSON
+	Printed bool   // true if sent to the workstation's printer
+}
+
+// printJob is a printout queued for a network printer, with the message to
+// send to the UI when it is done.
+type printJob struct {
+	what string // "receipt" or "slip", for logging
+	addr string // host:port of the printer
+	p    *printout
+	msg  UIMsg // RECEIPT or SLIP, without the printout
+	err  error // set by the printer goroutine
+}
+
+// receiptData is the data available to receipt templates.
+type receiptData struct {
+	Branch     string
+	Patron     string
+	PatronName string
+	Date       string // Format: 03/03/2014 11:02
+	Items      []item // Items checked out, with due date in DueDate
+}
+
+const defaultReceiptText = `{{.Branch}}
+Utlånskvittering {{.Date}}
+
+Låner: {{.Patron}}{{with .PatronName}} {{.}}{{end}}
+
+{{range .Items}}{{.Label}}
+{{.Barcode}}  Lånt til {{.DueDate}}
+
+{{end}}Antall lån: {{len .Items}}
+`
+
+const defaultReceiptHTML = `<div class="receipt">
+<h1>Utlånskvittering</h1>
+<p>{{.Branch}} {{.Date}}</p>
+<p>Låner: {{.Patron}}{{with .PatronName}} {{.}}{{end}}</p>
+<table>
+<tr><th>Tittel</th><th>Strekkode</th><th>Lånt til</th></tr>
+{{range .Items}}<tr><td>{{.Label}}</td><td>{{.Barcode}}</td><td>{{.DueDate}}</td></tr>
+{{end}}</table>
+<p>Antall lån: {{len .Items}}</p>
+</div>
+`
+
+// slipData is the data available to hold and transit slip templates.
+type slipData struct {
+	Branch       string // Branch where the item was checked in
+	Date         string // Format: 03/03/2014 11:02
+	Title        string
+	Barcode      string
+	Patron       string // Hold slips: the patron the item is reserved for
+	PickupBranch string // Hold slips: the branch where the item is to be picked up
+	Destination  string // Branch the item is to be sent to; empty for holds at the current branch
+}
+
+const defaultHoldSlipText = `RESERVERT
+{{.Date}}
+
+Låner: {{.Patron}}
+Hentes på: {{.PickupBranch}}
+{{with .Destination}}Sendes til: {{.}}
+{{end}}
+{{.Title}}
+{{.Barcode}}
+`
+
+const defaultHoldSlipHTML = `<div class="slip hold">
+<h1>Reservert</h1>
+<p>{{.Date}}</p>
+<p>Låner: {{.Patron}}<br>Hentes på: {{.PickupBranch}}{{with .Destination}}<br>Sendes til: {{.}}{{end}}</p>
+<p>{{.Title}}<br>{{.Barcode}}</p>
+</div>
+`
+
+const defaultTransitSlipText = `SENDES TIL {{.Destination}}
+{{.Date}}
+
+Fra: {{.Branch}}
+
+{{.Title}}
+{{.Barcode}}
+`
+
+const defaultTransitSlipHTML = `<div class="slip transit">
+<h1>Sendes til {{.Destination}}</h1>
+<p>{{.Date}}</p>
+<p>Fra: {{.Branch}}</p>
+<p>{{.Title}}<br>{{.Barcode}}</p>
+</div>
+`
+
+// loadTextTemplate parses the template in the given file, or the default
+// template if path is empty.
+func loadTextTemplate(path, def string) (*template.Template, error) {
+	if path == "" {
+		return template.New("default").Parse(def)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return template.New(path).Parse(string(b))
+}
+
+// loadHTMLTemplate parses the HTML template in the given file, or the default
+// template if path is empty.
+func loadHTMLTemplate(path, def string) (*htmltemplate.Template, error) {
+	if path == "" {
+		return htmltemplate.New("default").Parse(def)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return htmltemplate.New(path).Parse(string(b))
+}
+
+// render renders a printout with the given templates, falling back to the
+// default templates for those not given. The templates are read on every
+// call, so that they can be changed without restarting the server.
+func render(textFile, htmlFile, defText, defHTML string, data interface{}) (*printout, error) {
+	t, err := loadTextTemplate(textFile, defText)
+	if err != nil {
+		return nil, err
+	}
+	h, err := loadHTMLTemplate(htmlFile, defHTML)
+	if err != nil {
+		return nil, err
+	}
+	var text, html bytes.Buffer
+	if err := t.Execute(&text, data); err != nil {
+		return nil, err
+	}
+	if err := h.Execute(&html, data); err != nil {
+		return nil, err
+	}
+	return &printout{
+		Text:   text.String(),
+		HTML:   html.String(),
+		ESCPOS: escpos(text.String()),
+	}, nil
+}
+
+// cp865 maps the non-ASCII characters which can be printed to code page 865
+// (Nordic).
+var cp865 = map[rune]byte{
+	'Ç': 0x80, 'ü': 0x81, 'é': 0x82, 'â': 0x83, 'ä': 0x84, 'à': 0x85, 'å': 0x86,
+	'ç': 0x87, 'ê': 0x88, 'ë': 0x89, 'è': 0x8A, 'ï': 0x8B, 'î': 0x8C, 'ì': 0x8D,
+	'Ä': 0x8E, 'Å': 0x8F, 'É': 0x90, 'æ': 0x91, 'Æ': 0x92, 'ô': 0x93, 'ö': 0x94,
+	'ò': 0x95, 'û': 0x96, 'ù': 0x97, 'ÿ': 0x98, 'Ö': 0x99, 'Ü': 0x9A, 'ø': 0x9B,
+	'£': 0x9C, 'Ø': 0x9D, 'á': 0xA0, 'í': 0xA1, 'ó': 0xA2, 'ú': 0xA3, 'ñ': 0xA4,
+	'Ñ': 0xA5, '§': 0x15,
+}
+
+// escpos returns the text as ESC/POS printer commands: the printer is
+// initialized and set to code page 865, and the paper is fed and cut after
+// the text. Characters which cannot be printed are replaced by "?".
+func escpos(text string) []byte {
+	var b bytes.Buffer
+	b.WriteString("\x1b@")     // ESC @: initialize printer
+	b.WriteString("\x1bt\x05") // ESC t 5: code page 865
+	for _, r := range text {
+		switch {
+		case r == '\n' || r == '\t' || (r >= ' ' && r < 0x7F):
+			b.WriteByte(byte(r))
+		case cp865[r] != 0:
+			b.WriteByte(cp865[r])
+		default:
+			b.WriteByte('?')
+		}
+	}
+	b.WriteString("\n\n\n\n")
+	b.WriteString("\x1dV\x01") // GS V 1: partial cut
+	return b.Bytes()
+}
+
+// printRaw sends the printout as ESC/POS to the network printer at the given
+// adress (host:port).
+func printRaw(addr string, p *printout) error {
+	conn, err := net.DialTimeout("tcp", addr, printerTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(printerTimeout))
+	_, err = conn.Write(p.ESCPOS)
+	return err
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestESCPOS(t *testing.T) {
+	got := escpos("Låner: Ærlig Øye €\n")
+	want := []byte("\x1b@\x1bt\x05L\x86ner: \x92rlig \x9dye ?\n\n\n\n\n\x1dV\x01")
+	if !bytes.Equal(got, want) {
+		t.Errorf("escpos => %q; want %q", got, want)
+	}
+}
+
+func TestReceiptTemplates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rfidhub-templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	branchTmpl := filepath.Join(dir, "hutl.txt")
+	if err := ioutil.WriteFile(branchTmpl, []byte("{{.Branch}}:{{range .Items}} {{.Barcode}}{{end}}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := config{Branches: map[string]branchConfig{
+		"hutl": {Templates: templateFiles{Receipt: branchTmpl}},
+	}}
+	data := receiptData{Branch: "hutl", Items: []item{{Barcode: "1"}, {Barcode: "2"}}}
+
+	tmpl := cfg.templates("hutl")
+	p, err := render(tmpl.Receipt, tmpl.ReceiptHTML, defaultReceiptText, defaultReceiptHTML, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "hutl: 1 2"
+	if p.Text != want {
+		t.Errorf("Receipt with branch template => %q; want %q", p.Text, want)
+	}
+	if !bytes.Contains(p.ESCPOS, []byte(want)) {
+		t.Errorf("ESC/POS receipt %q doesn't contain %q", p.ESCPOS, want)
+	}
+
+	// Other branches use the default templates
+	tmpl = cfg.templates("fbol")
+	p, err = render(tmpl.Receipt, tmpl.ReceiptHTML, defaultReceiptText, defaultReceiptHTML, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains([]byte(p.Text), []byte("Antall lån: 2")) {
+		t.Errorf("Receipt with default template => %q", p.Text)
+	}
+}
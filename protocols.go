@@ -1,5 +1,10 @@
 package main
 
+import (
+	"fmt"
+	"sort"
+)
+
 // Vendor interface which any RFID-vendor must satisfy. In order for a vendor
 // to be supported, its read/write logic must be similar to what the RFIDUnit
 // state-machine expects, and its protocol must be a text-based message exchange
@@ -15,6 +20,37 @@ type Vendor interface {
 	ParseRFIDResp([]byte) (RFIDResp, error)
 }
 
+// vendors holds the registered RFID-vendors, keyed by name.
+var vendors = make(map[string]func() Vendor)
+
+// registerVendor makes a RFID-vendor available by the given name. It is meant
+// to be called from the init function of the file implementing the vendor.
+func registerVendor(name string, f func() Vendor) {
+	if _, dup := vendors[name]; dup {
+		panic("registerVendor called twice for vendor " + name)
+	}
+	vendors[name] = f
+}
+
+// newVendor returns a new instance of the named RFID-vendor.
+func newVendor(name string) (Vendor, error) {
+	f, ok := vendors[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown RFID-vendor: %q (available: %v)", name, vendorNames())
+	}
+	return f(), nil
+}
+
+// vendorNames returns the names of all registered RFID-vendors, sorted.
+func vendorNames() []string {
+	names := make([]string, 0, len(vendors))
+	for name := range vendors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 // RFID-unit message protocol /////////////////////////////////////////////////
 
 // RFIDCommand represents the type of request to send to the RFID-unit.
@@ -35,6 +71,7 @@ const (
 
 	// Initialize writer commands.
 	// SLP (Set Library Paramter) commands. Reader returns OK or NOK.
+	// The parameter value is given in RFIDReq.Data, see tagParams.
 	cmdSLPLBN // SLPLBN|02030000 (LBN: library number)
 	cmdSLPLBC // SLPLBC|NO       (LBC: library country code)
 	cmdSLPDTM // SLPDTM|DS24     (DTM: data model, "Danish Standard" / ISO28560−3)
@@ -74,11 +111,20 @@ type item struct {
 	Borrowernr string
 	Label      string
 	Barcode    string
-	Date       string // Format: 10/03/2013
+	Date       string // Format: 10/03/2013. The new due date when renewing
+	DueDate    string // Format: 10/03/2013. The due date when checking out
 	Status     string // An error explanation or an error message passed on from SIP-server
+	StatusCode string // Message code of Status
 	Transfer   string // Branchcode, or empty string if item belongs to the issuing branch
 	Hold       bool   // true if item is reserved for the current branch
+	HoldPatron string // Identifier of the patron the item is reserved for, if any
 	NumTags    int
+	Offline    bool // true if checked in while the SIP-server was unavailable, to be sent to Koha later
+
+	HoldOtherBranch bool   // true if item is reserved for pickup at another branch
+	PickupBranch    string // Branchcode where the reserved item is to be picked up
+	Transit         bool   // true if item must be put in the transit bin, to be sent to TransitTo
+	TransitTo       string // Branchcode the item is to be sent to
 
 	// Possible errors
 	Unknown           bool // true if SIP server cant give any information on a given barcode
@@ -87,16 +133,38 @@ type item struct {
 	AlarmOffFailed    bool // true if it failed to turn off alarm
 	WriteFailed       bool // true if write to tag failed
 	TagCountFailed    bool // true if mismatch between expected number of tags and found tags
+	TagsFound         int  // Number of tags found, when TagCountFailed
+}
+
+// patron holds information about a patron, as given by the SIP-server.
+type patron struct {
+	Name       string
+	Blocked    bool   // true if the patron is not allowed to borrow
+	Status     string // Why the patron is blocked, or a message from the SIP-server
+	StatusCode string // Message code of Status
+	Fines      string // Outstanding fees, if any
+	Holds      int    // Number of holds available for pickup
+	Overdue    int    // Number of overdue items
+	Charged    int    // Number of items on loan
 }
 
 // UIMsg is a message to or from Koha's user interface.
 type UIMsg struct {
-	Action       string // CHECKIN/CHECKOUT/CONNECT/ITEM-INFO/RETRY-ALARM-ON/RETRY-ALARM-OFF/WRITE/END
-	Patron       string // Patron username/barcode
-	Branch       string // branch where transaction is taking place
-	RFIDError    bool   // true if RFID-reader is unavailable
-	SIPError     bool   // true if SIP-server is unavailable
-	UserError    bool   // true if user is not using the API correctly
-	ErrorMessage string // textual description of the error
-	Item         item
+	Action         string  // CHECKIN/CHECKOUT/RENEW/RENEW-ALL/PATRON-INFO/CONNECT/ITEM-INFO/RETRY-ALARM-ON/RETRY-ALARM-OFF/WRITE/END/PRINT-RECEIPT/RECEIPT/RESUME/RESET
+	Patron         string  // Patron username/barcode
+	PatronInfo     *patron `json:",omitempty"` // Response to PATRON-INFO, and when starting CHECKOUT
+	Branch         string  // branch where transaction is taking place
+	RFIDError      bool    // true if RFID-reader is unavailable
+	RFIDTimeout    bool    // true if RFID-reader didn't respond in time
+	SIPError       bool    // true if SIP-server is unavailable
+	SIPTimeout     bool    // true if SIP-server didn't respond in time
+	SIPUnavailable bool    // true while requests to the SIP-server are suspended
+	UserError      bool    // true if user is not using the API correctly
+	ErrorMessage   string  // textual description of the error
+	ErrorCode      string  // Message code of the error
+	Language       string  // Language of the statuses, eg. "en"; set by the UI with CONNECT
+	Mode           string  // RESUME: the action in progress before the page was reloaded, if any
+	Item           item
+	Receipt        *printout `json:",omitempty"` // Receipt of the checkout session, on END and PRINT-RECEIPT
+	Slip           *printout `json:",omitempty"` // Hold or transit slip of a checked in item
 }
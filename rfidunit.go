@@ -2,11 +2,18 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"sync"
+	"time"
 )
 
+// rfidDialTimeout is the time allowed for connecting to, and initializing, a
+// RFID-unit.
+const rfidDialTimeout = 5 * time.Second
+
 // UnitState represent the current state of a RFID-unit.
 type UnitState uint8
 
@@ -21,6 +28,9 @@ const (
 	UNITWaitForCheckinAlarmLeave
 	UNITWaitForCheckoutAlarmOff
 	UNITWaitForCheckoutAlarmLeave
+	UNITRenewWaitForBegOK
+	UNITRenew
+	UNITWaitForRenewAlarmLeave
 	UNITPreWriteStep1
 	UNITPreWriteStep2
 	UNITPreWriteStep3
@@ -35,31 +45,99 @@ const (
 	UNITWaitForRetryAlarmOff
 	UNITOff
 	UNITWaitForEndOK
+	UNITTimeoutWaitForEndOK
+	UNITAdminCommand
 )
 
+var unitStateNames = [...]string{
+	UNITIdle:                      "UNITIdle",
+	UNITCheckinWaitForBegOK:       "UNITCheckinWaitForBegOK",
+	UNITCheckin:                   "UNITCheckin",
+	UNITCheckout:                  "UNITCheckout",
+	UNITCheckoutWaitForBegOK:      "UNITCheckoutWaitForBegOK",
+	UNITWaitForCheckinAlarmOn:     "UNITWaitForCheckinAlarmOn",
+	UNITWaitForCheckinAlarmLeave:  "UNITWaitForCheckinAlarmLeave",
+	UNITWaitForCheckoutAlarmOff:   "UNITWaitForCheckoutAlarmOff",
+	UNITWaitForCheckoutAlarmLeave: "UNITWaitForCheckoutAlarmLeave",
+	UNITRenewWaitForBegOK:         "UNITRenewWaitForBegOK",
+	UNITRenew:                     "UNITRenew",
+	UNITWaitForRenewAlarmLeave:    "UNITWaitForRenewAlarmLeave",
+	UNITPreWriteStep1:             "UNITPreWriteStep1",
+	UNITPreWriteStep2:             "UNITPreWriteStep2",
+	UNITPreWriteStep3:             "UNITPreWriteStep3",
+	UNITPreWriteStep4:             "UNITPreWriteStep4",
+	UNITPreWriteStep5:             "UNITPreWriteStep5",
+	UNITPreWriteStep6:             "UNITPreWriteStep6",
+	UNITPreWriteStep7:             "UNITPreWriteStep7",
+	UNITPreWriteStep8:             "UNITPreWriteStep8",
+	UNITWriting:                   "UNITWriting",
+	UNITWaitForTagCount:           "UNITWaitForTagCount",
+	UNITWaitForRetryAlarmOn:       "UNITWaitForRetryAlarmOn",
+	UNITWaitForRetryAlarmOff:      "UNITWaitForRetryAlarmOff",
+	UNITOff:                       "UNITOff",
+	UNITWaitForEndOK:              "UNITWaitForEndOK",
+	UNITTimeoutWaitForEndOK:       "UNITTimeoutWaitForEndOK",
+	UNITAdminCommand:              "UNITAdminCommand",
+}
+
+func (s UnitState) String() string {
+	if int(s) < len(unitStateNames) {
+		return unitStateNames[s]
+	}
+	return fmt.Sprintf("UnitState(%d)", s)
+}
+
 // RFIDUnit represents a connected RFID-unit.
 type RFIDUnit struct {
+	cfg            config
+	addr           string // host:port of the RFID-unit
+	workstation    string // Workstation identifier of the UI
+	ip             string // IP-address of the UI
+	staff          string // Koha user of the UI, if authenticated
+	vendorName     string // Name of the RFID-vendor
 	state          UnitState
+	interrupted    UnitState // State when the RFID-unit timed out
 	dept           string
 	patron         string
+	patronName     string
 	vendor         Vendor
+	mu             sync.Mutex // protects conn
 	conn           net.Conn
 	failedAlarmOn  map[string]string // map[Barcode]Tag
 	failedAlarmOff map[string]string // map[Barcode]Tag
 	currentItem    UIMsg
+	pending        *auditEntry      // Audit log entry of current item, until the alarm is set
 	items          map[string]UIMsg // Keep items around for retries
+	checkouts      []string         // Barcodes of items checked out in the session, in order
+	session        *session         // Session of the workstation; nil if sessions are disabled
+	tags           tagParams        // Library parameters for writing tags
 	FromUI         chan UIMsg
 	ToUI           chan UIMsg
 	FromRFID       chan []byte
 	ToRFID         chan []byte
 	Quit           chan bool
+	Admin          chan adminReq  // Requests from the admin API
+	lastRFID       time.Time      // When the last message from the RFID-unit was received
+	adminReply     chan adminResp // Reply to the pending vendor command from the admin API
+	prints         chan printJob  // Printouts waiting for the printer goroutine
+	printed        chan printJob  // Printouts done by the printer goroutine
+
+	// Signals from tcpReader when the connection is lost and reestablished:
+	connLost    chan bool
+	reconnected chan bool
+	// Closed when the state-machine shuts down:
+	closed chan struct{}
 }
 
-func newRFIDUnit(c net.Conn, send chan UIMsg) *RFIDUnit {
+// newRFIDUnit returns a RFIDUnit for the RFID-unit at the given address,
+// driven by the given vendor. It must be connected before the state-machine
+// is started.
+func newRFIDUnit(cfg config, addr string, v Vendor, send chan UIMsg) *RFIDUnit {
 	return &RFIDUnit{
+		cfg:            cfg,
+		addr:           addr,
 		state:          UNITIdle,
-		vendor:         newDeichmanVendor(), // TODO get this from config
-		conn:           c,
+		vendor:         v,
 		failedAlarmOn:  make(map[string]string),
 		failedAlarmOff: make(map[string]string),
 		items:          make(map[string]UIMsg),
@@ -69,29 +147,405 @@ func newRFIDUnit(c net.Conn, send chan UIMsg) *RFIDUnit {
 		FromRFID:       make(chan []byte),
 		ToRFID:         make(chan []byte),
 		Quit:           make(chan bool),
+		Admin:          make(chan adminReq),
+		prints:         make(chan printJob, printQueueSize),
+		printed:        make(chan printJob),
+		connLost:       make(chan bool),
+		reconnected:    make(chan bool),
+		closed:         make(chan struct{}),
+	}
+}
+
+// connect opens a TCP connection to the RFID-unit and initializes it with the
+// version command. On success, the connection replaces any previous
+// connection to the RFID-unit.
+func (u *RFIDUnit) connect() error {
+	conn, err := net.DialTimeout("tcp", u.addr, rfidDialTimeout)
+	if err != nil {
+		return err
+	}
+
+	// Init the RFID-unit with version command
+	conn.SetDeadline(time.Now().Add(rfidDialTimeout))
+	req := u.vendor.GenerateRFIDReq(RFIDReq{Cmd: cmdInitVersion})
+	if _, err = conn.Write(req); err != nil {
+		conn.Close()
+		return err
+	}
+	log.Printf("-> RFID-unit[%v] %q", u.addr, req)
+
+	rdr := bufio.NewReader(conn)
+	msg, err := rdr.ReadBytes('\r')
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	log.Printf("<- RFID-unit[%v] %q", u.addr, msg)
+
+	r, err := u.vendor.ParseRFIDResp(msg)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	if !r.OK {
+		conn.Close()
+		return errors.New("RFID-unit responded with NOK")
 	}
+	conn.SetDeadline(time.Time{})
+
+	u.mu.Lock()
+	u.conn = conn
+	u.mu.Unlock()
+	return nil
+}
+
+// getConn returns the current TCP connection to the RFID-unit.
+func (u *RFIDUnit) getConn() net.Conn {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.conn
+}
+
+// reconnect tries to reestablish the connection to the RFID-unit, waiting
+// longer between each attempt. It returns false if the state-machine was shut
+// down before a connection could be made.
+func (u *RFIDUnit) reconnect() bool {
+	wait := u.cfg.RFIDReconnectMin.Duration
+	for {
+		select {
+		case <-time.After(wait):
+		case <-u.closed:
+			return false
+		}
+		if err := u.connect(); err != nil {
+			log.Printf("WARN: RFID-unit[%v] reconnect failed: %v", u.addr, err)
+			wait = nextBackoff(wait, u.cfg.RFIDReconnectMax.Duration)
+			continue
+		}
+		select {
+		case <-u.closed:
+			u.getConn().Close()
+			return false
+		default:
+		}
+		log.Printf("RFID-unit[%v] reconnected & initialized", u.addr)
+		status.RFIDReconnects.Inc(1)
+		return true
+	}
+}
+
+// resume brings the RFID-unit back into scanning mode after a reconnect, if
+// it was in the middle of a checkin or checkout session. Items allready
+// processed in the session are kept.
+func (u *RFIDUnit) resume() {
+	u.record("interrupted")
+	switch u.state {
+	case UNITCheckinWaitForBegOK, UNITCheckin, UNITWaitForCheckinAlarmOn,
+		UNITWaitForCheckinAlarmLeave, UNITWaitForRetryAlarmOn:
+		u.state = UNITCheckinWaitForBegOK
+		log.Printf("[%v] UNITCheckinWaitForBegOK", u.addr)
+		u.ToRFID <- u.vendor.GenerateRFIDReq(RFIDReq{Cmd: cmdBeginScan})
+	case UNITCheckoutWaitForBegOK, UNITCheckout, UNITWaitForCheckoutAlarmOff,
+		UNITWaitForCheckoutAlarmLeave, UNITWaitForRetryAlarmOff:
+		u.state = UNITCheckoutWaitForBegOK
+		log.Printf("[%v] UNITCheckoutWaitForBegOK", u.addr)
+		u.ToRFID <- u.vendor.GenerateRFIDReq(RFIDReq{Cmd: cmdBeginScan})
+	case UNITRenewWaitForBegOK, UNITRenew, UNITWaitForRenewAlarmLeave:
+		u.state = UNITRenewWaitForBegOK
+		log.Printf("[%v] UNITRenewWaitForBegOK", u.addr)
+		u.ToRFID <- u.vendor.GenerateRFIDReq(RFIDReq{Cmd: cmdBeginScan})
+	case UNITAdminCommand:
+		u.adminCommandDone(nil, errors.New("connection to RFID-unit lost"))
+	default:
+		u.state = UNITIdle
+		log.Printf("[%v] UNITIdle", u.addr)
+	}
+}
+
+// timedOut is called when the RFID-unit doesn't respond in time. The item
+// being processed is reported as failed, and the UI notified. The RFID-unit
+// is then told to end scanning, so that the state-machine can continue from
+// a known state, see resumeAfterTimeout.
+func (u *RFIDUnit) timedOut() {
+	log.Printf("WARN: [%v] RFID-unit didn't respond in state %v", u.addr, u.state)
+	status.RFIDTimeouts.Inc(u.state.String())
+
+	if u.state == UNITTimeoutWaitForEndOK {
+		// Unable to recover; reconnect and resume where we left off
+		log.Printf("WARN: [%v] RFID-unit didn't respond to END, reconnecting", u.addr)
+		u.state = u.interrupted
+		u.getConn().Close()
+		return
+	}
+
+	if u.state == UNITAdminCommand {
+		// Not part of a session; the RFID-unit is left as it is
+		u.adminCommandDone(nil, errUnitTimeout)
+		return
+	}
+
+	switch u.state {
+	case UNITWaitForCheckinAlarmOn, UNITWaitForRetryAlarmOn:
+		u.currentItem.Item.AlarmOnFailed = true
+		u.currentItem.Item.setStatus(msgAlarmOnFailed)
+		status.AlarmFailures.Inc("on")
+		if u.dept == u.currentItem.Item.Transfer {
+			u.currentItem.Item.Transfer = ""
+		}
+		if u.state == UNITWaitForCheckinAlarmOn {
+			u.currentItem.Slip = u.checkinSlip()
+		}
+	case UNITWaitForCheckoutAlarmOff, UNITWaitForRetryAlarmOff:
+		u.currentItem.Item.AlarmOffFailed = true
+		u.currentItem.Item.setStatus(msgAlarmOffFailed)
+		status.AlarmFailures.Inc("off")
+	case UNITWaitForCheckinAlarmLeave, UNITWaitForCheckoutAlarmLeave, UNITWaitForRenewAlarmLeave:
+		// Item allready processed
+	case UNITWaitForTagCount:
+		u.currentItem.Action = "ITEM-INFO"
+		u.currentItem.Item.TransactionFailed = true
+	case UNITPreWriteStep1, UNITPreWriteStep2, UNITPreWriteStep3, UNITPreWriteStep4,
+		UNITPreWriteStep5, UNITPreWriteStep6, UNITPreWriteStep7, UNITPreWriteStep8,
+		UNITWriting:
+		u.currentItem.Item.WriteFailed = true
+		status.Writes.Inc("failed")
+	default:
+		u.currentItem = UIMsg{}
+	}
+	u.record("timeout")
+	if u.currentItem.Action != "" {
+		u.ToUI <- u.currentItem
+	}
+	u.ToUI <- UIMsg{Action: "CONNECT", RFIDError: true, RFIDTimeout: true,
+		ErrorMessage: "RFID-unit didn't respond in time", ErrorCode: msgRFIDTimeout}
+
+	u.interrupted = u.state
+	u.state = UNITTimeoutWaitForEndOK
+	log.Printf("[%v] UNITTimeoutWaitForEndOK", u.addr)
+	u.vendor.Reset()
+	u.ToRFID <- u.vendor.GenerateRFIDReq(RFIDReq{Cmd: cmdEndScan})
+}
+
+// shutdown stops the state-machine, and closes the connection to the
+// RFID-unit. It is called from run, which must return afterwards.
+func (u *RFIDUnit) shutdown() {
+	u.record("interrupted")
+	close(u.ToRFID)
+	u.state = UNITOff
+	close(u.closed)
+	log.Printf("Shutting down RFID-unit state-machine for %v", addr2IP(u.addr))
+	//u.ToRFID <- u.vendor.GenerateRFIDReq(RFIDReq{Cmd: cmdEndScan})
+	log.Printf("Closing TCP connection to %v", u.addr)
+	u.getConn().Close()
+}
+
+// stop tells the state-machine to shut down, unless it has allready done so
+// by itself.
+func (u *RFIDUnit) stop() {
+	select {
+	case u.Quit <- true:
+	case <-u.closed:
+	}
+}
+
+// resumeAfterTimeout continues from where the RFID-unit timed out, once it
+// has ended scanning: an ongoing checkin, checkout or renewal session is
+// resumed, or else the state-machine goes idle.
+func (u *RFIDUnit) resumeAfterTimeout() {
+	u.state = u.interrupted
+	u.resume()
 }
 
 // reset checkin/checkout session
 func (u *RFIDUnit) reset() {
 	u.vendor.Reset()
 	u.items = make(map[string]UIMsg)
+	u.checkouts = nil
 	u.failedAlarmOn = make(map[string]string)
 	u.failedAlarmOff = make(map[string]string)
 	u.currentItem = UIMsg{}
+	u.pending = nil
+}
+
+// restore continues the session of the workstation, if it is in the mode
+// requested by the UI, for the same patron, eg. when the UI starts the mode
+// again after the page was reloaded: the items allready processed are kept,
+// so that they are not sent to the SIP-server again, and are on the receipt.
+func (u *RFIDUnit) restore(uiReq UIMsg) {
+	mode := uiReq.Action
+	branch, items, ok := u.session.resumed(mode, uiReq.Patron)
+	if !ok {
+		return
+	}
+	if branch != "" {
+		u.dept = branch
+	}
+	for _, m := range items {
+		u.items[m.Item.Barcode] = m
+		if mode == "CHECKOUT" && !m.Item.Unknown && !m.Item.TransactionFailed {
+			u.checkouts = append(u.checkouts, m.Item.Barcode)
+		}
+	}
+}
+
+// checkedOut returns true if the item is allready checked out in the session.
+func (u *RFIDUnit) checkedOut(barcode string) bool {
+	for _, bc := range u.checkouts {
+		if bc == barcode {
+			return true
+		}
+	}
+	return false
+}
+
+// auditItem prepares the audit log entry for a transaction on the given
+// item. It is written to the audit log by record, when the result of setting
+// the alarm is known.
+func (u *RFIDUnit) auditItem(action, barcode, tag, sipResult string) {
+	e := u.newAuditEntry(action, barcode, tag, sipResult)
+	u.pending = &e
+}
+
+// newAuditEntry returns an audit log entry for a transaction on the given
+// item, at the current workstation, branch and patron.
+func (u *RFIDUnit) newAuditEntry(action, barcode, tag, sipResult string) auditEntry {
+	e := auditEntry{
+		Time:        time.Now(),
+		Action:      action,
+		Workstation: u.workstation,
+		IP:          u.ip,
+		Staff:       u.staff,
+		Branch:      u.dept,
+		Barcode:     stripLeading10(barcode),
+		Tag:         tag,
+		SIP:         sipResult,
+	}
+	if action != "CHECKIN" && action != "RETRY-ALARM-ON" {
+		e.Patron = u.patron
+	}
+	return e
+}
+
+// record writes the pending audit log entry, along with the result of
+// setting the alarm and the current item as sent to the UI.
+func (u *RFIDUnit) record(alarm string) {
+	if u.pending == nil {
+		return
+	}
+	u.pending.Alarm = alarm
+	u.pending.Item = u.currentItem.Item
+	u.writeAudit(*u.pending)
+	u.pending = nil
+}
+
+func (u *RFIDUnit) writeAudit(e auditEntry) {
+	if err := audit.Record(e); err != nil {
+		log.Printf("ERROR: [%v] failed to write to audit log: %v", u.addr, err)
+	}
+}
+
+// sipFailed handles an item which couldn't be processed because of a SIP
+// error. The UI is notified of the error, and the item is made the current
+// item, marked as failed. It is sent to the UI, and written to the audit log,
+// once the RFID-unit has been told to leave the alarm as it is.
+func (u *RFIDUnit) sipFailed(action string, r RFIDResp, err error) {
+	log.Println("ERROR:", err.Error())
+	u.ToUI <- sipErrorMsg(err)
+	u.auditItem(action, r.Barcode, r.Tag, "sip-error")
+	u.pending.SIPError = err.Error()
+	u.currentItem = UIMsg{Action: action,
+		Item: item{Barcode: stripLeading10(r.Barcode), TransactionFailed: true}}
+	u.currentItem.Item.setStatus(msgSIPFailed)
+}
+
+// checkinOffline queues a checkin which couldn't be sent to the SIP-server,
+// to be sent to Koha later, and turns on the alarm as for a successful
+// checkin. It returns false if the checkin couldn't be queued. Only checkins
+// which never reached the SIP-server may be queued, since Koha could already
+// have performed any other.
+func (u *RFIDUnit) checkinOffline(r RFIDResp, sipErr error) bool {
+	log.Printf("WARN: [%v] checking in %v offline: %v", u.addr, r.Barcode, sipErr)
+	_, err := offline.Add(offlineCheckin{
+		Time:        time.Now(),
+		Workstation: u.workstation,
+		Staff:       u.staff,
+		Branch:      u.dept,
+		Barcode:     r.Barcode,
+		Tag:         r.Tag,
+	})
+	if err != nil {
+		log.Printf("ERROR: [%v] failed to queue offline checkin: %v", u.addr, err)
+		return false
+	}
+	status.Checkins.Inc("queued")
+	u.auditItem("CHECKIN", r.Barcode, r.Tag, "queued")
+	u.pending.SIPError = sipErr.Error()
+
+	barcode := stripLeading10(r.Barcode)
+	u.currentItem = UIMsg{Action: "CHECKIN", Item: item{Barcode: barcode, Offline: true}}
+	u.items[barcode] = u.currentItem
+	u.failedAlarmOn[barcode] = r.Tag // Store tag id for potential retry
+	u.ToRFID <- u.vendor.GenerateRFIDReq(RFIDReq{Cmd: cmdAlarmOn})
+	u.state = UNITWaitForCheckinAlarmOn
+	log.Printf("[%v] UNITCheckinWaitForAlarmOn", u.addr)
+	return true
+}
+
+// alarmResult describes the result of an alarm command, for the audit log.
+func alarmResult(alarm string, ok bool) string {
+	if !ok {
+		return alarm + "-failed"
+	}
+	return alarm
 }
 
 // run starts the state-machine for a RFID-unit. It will shut down when the UI-
-// connection is lost, on certain RFID-errors, or if it can't get a working
-// connection to the SIP-server.
+// connection is lost, or on certain RFID-errors. SIP errors are reported to the
+// UI, but doesn't stop the state-machine.
 func (u *RFIDUnit) run() {
 	var err error
-	var adr = u.conn.RemoteAddr().String()
+	var adr = u.addr
+	var timeout <-chan time.Time // fires if the RFID-unit doesn't respond in time
+	var lost bool                // true while reconnecting to the RFID-unit
+	status.addUnit(u, u.state)
+	defer status.removeUnit(u)
+	go u.printer()
 	for {
 		select {
+		case <-u.connLost:
+			log.Printf("WARN: [%v] lost connection to RFID-unit, trying to reconnect", adr)
+			lost = true
+			u.ToUI <- UIMsg{Action: "CONNECT", RFIDError: true, ErrorCode: msgRFIDError}
+		case <-u.reconnected:
+			// Notify UI that the RFID-unit is available again, and continue
+			// where we left off:
+			lost = false
+			u.ToUI <- UIMsg{Action: "CONNECT"}
+			u.resume()
+		case <-timeout:
+			u.timedOut()
+		case req := <-u.Admin:
+			if !u.handleAdmin(req) {
+				// Keep the deadline of the current state
+				continue
+			}
+		case job := <-u.printed:
+			u.printDone(job)
+			// Not an event from the RFID-unit; keep the deadline
+			continue
 		case uiReq := <-u.FromUI:
+			if uiReq.Action != "CHECKOUT" {
+				// Started below, once the patron is allowed to borrow
+				u.session.start(uiReq)
+			}
 			switch uiReq.Action {
 			case "END":
+				switch u.state {
+				case UNITCheckout, UNITWaitForCheckoutAlarmOff, UNITWaitForCheckoutAlarmLeave, UNITWaitForRetryAlarmOff:
+					if len(u.checkouts) > 0 {
+						u.sendReceipt()
+					}
+				}
 				u.state = UNITWaitForEndOK
 				log.Printf("[%v] UNITWaitForEndOK", adr)
 				r := u.vendor.GenerateRFIDReq(RFIDReq{Cmd: cmdEndScan})
@@ -100,8 +554,9 @@ func (u *RFIDUnit) run() {
 				u.currentItem, err = DoSIPCall(sipPool, sipFormMsgItemStatus(uiReq.Item.Barcode), itemStatusParse)
 				if err != nil {
 					log.Println("ERROR:", err.Error())
-					u.ToUI <- UIMsg{Action: "CONNECT", SIPError: true}
-					u.Quit <- true
+					u.ToUI <- sipErrorMsg(err)
+					u.state = UNITIdle
+					log.Printf("[%v] UNITIdle", adr)
 					break
 				}
 				u.state = UNITWaitForTagCount
@@ -114,37 +569,112 @@ func (u *RFIDUnit) run() {
 				log.Printf("[%v] UNITPreWriteStep1", adr)
 				u.currentItem.Action = "WRITE"
 				u.currentItem.Item.NumTags = uiReq.Item.NumTags
+				branch := uiReq.Branch
+				if branch == "" {
+					branch = u.dept
+				}
+				u.tags = u.cfg.tagParams(branch)
 				u.vendor.Reset()
-				r := u.vendor.GenerateRFIDReq(RFIDReq{Cmd: cmdSLPLBN})
+				r := u.vendor.GenerateRFIDReq(RFIDReq{Cmd: cmdSLPLBN, Data: []byte(u.tags.LibraryNumber)})
 				u.ToRFID <- r
 			case "CHECKIN":
 				u.state = UNITCheckinWaitForBegOK
 				u.dept = uiReq.Branch
 				log.Printf("[%v] UNITCheckinWaitForBegOK", adr)
 				u.reset()
+				u.restore(uiReq)
 				r := u.vendor.GenerateRFIDReq(RFIDReq{Cmd: cmdBeginScan})
 				u.ToRFID <- r
 			case "CHECKOUT":
+				// A refused checkout leaves the RFID-unit, and the session,
+				// as they were, so that any ongoing scanning continues.
 				if uiReq.Patron == "" {
 					u.ToUI <- UIMsg{Action: "CHECKOUT",
-						UserError: true, ErrorMessage: "Patron not supplied"}
+						UserError: true, ErrorMessage: "Patron not supplied", ErrorCode: msgPatronMissing}
+					break
+				}
+				// Check that the patron is allowed to borrow before
+				// scanning for items:
+				info, err := DoSIPCall(sipPool, sipFormMsgPatronInfo(uiReq.Branch, uiReq.Patron), patronInfoParse)
+				if err != nil {
+					log.Println("ERROR:", err.Error())
+					u.ToUI <- sipErrorMsg(err)
+					break
+				}
+				u.ToUI <- info
+				if info.PatronInfo.Blocked {
+					log.Printf("[%v] patron %v blocked: %v", adr, uiReq.Patron, info.PatronInfo.Status)
+					u.ToUI <- UIMsg{Action: "CHECKOUT",
+						UserError: true, ErrorMessage: "Patron blocked", ErrorCode: msgPatronBlocked}
+					break
+				}
+				u.patron = uiReq.Patron
+				u.dept = uiReq.Branch
+				u.patronName = info.PatronInfo.Name
+				u.session.start(uiReq)
+				u.state = UNITCheckoutWaitForBegOK
+				log.Printf("[%v] UNITCheckoutWaitForBegOK", adr)
+				u.reset()
+				u.restore(uiReq)
+				r := u.vendor.GenerateRFIDReq(RFIDReq{Cmd: cmdBeginScan})
+				u.ToRFID <- r
+			case "RENEW":
+				if uiReq.Patron == "" {
+					u.ToUI <- UIMsg{Action: "RENEW",
+						UserError: true, ErrorMessage: "Patron not supplied", ErrorCode: msgPatronMissing}
 					u.state = UNITIdle
 					log.Printf("[%v] UNITIdle", adr)
 					break
 				}
-				u.state = UNITCheckoutWaitForBegOK
+				u.state = UNITRenewWaitForBegOK
 				u.patron = uiReq.Patron
 				u.dept = uiReq.Branch
-				log.Printf("[%v] UNITCheckoutWaitForBegOK", adr)
+				log.Printf("[%v] UNITRenewWaitForBegOK", adr)
 				u.reset()
+				u.restore(uiReq)
 				r := u.vendor.GenerateRFIDReq(RFIDReq{Cmd: cmdBeginScan})
 				u.ToRFID <- r
+			case "RENEW-ALL":
+				if uiReq.Patron == "" {
+					u.ToUI <- UIMsg{Action: "RENEW-ALL",
+						UserError: true, ErrorMessage: "Patron not supplied", ErrorCode: msgPatronMissing}
+					break
+				}
+				u.patron = uiReq.Patron
+				u.dept = uiReq.Branch
+				if err := u.renewAll(); err != nil {
+					log.Println("ERROR:", err.Error())
+					status.Renewals.Inc("sip-error")
+					u.ToUI <- sipErrorMsg(err)
+				}
+			case "PRINT-RECEIPT":
+				if len(u.checkouts) == 0 {
+					u.ToUI <- UIMsg{Action: "RECEIPT",
+						UserError: true, ErrorMessage: "No items checked out", ErrorCode: msgNoCheckouts}
+					break
+				}
+				u.sendReceipt()
+			case "PATRON-INFO":
+				if uiReq.Patron == "" {
+					u.ToUI <- UIMsg{Action: "PATRON-INFO",
+						UserError: true, ErrorMessage: "Patron not supplied", ErrorCode: msgPatronMissing}
+					break
+				}
+				info, err := DoSIPCall(sipPool, sipFormMsgPatronInfo(uiReq.Branch, uiReq.Patron), patronInfoParse)
+				if err != nil {
+					log.Println("ERROR:", err.Error())
+					u.ToUI <- sipErrorMsg(err)
+					break
+				}
+				u.ToUI <- info
 			case "RETRY-ALARM-ON":
 				u.state = UNITWaitForRetryAlarmOn
 				log.Printf("[%v] UNITWaitForRetryAlarmOn", adr)
 				for k, v := range u.failedAlarmOn {
 					u.currentItem = u.items[k]
 					u.currentItem.Item.Transfer = ""
+					u.currentItem.Item.Transit, u.currentItem.Item.TransitTo = false, ""
+					u.auditItem("RETRY-ALARM-ON", k, v, "")
 					r := u.vendor.GenerateRFIDReq(RFIDReq{Cmd: cmdRetryAlarmOn, Data: []byte(v)})
 					u.ToRFID <- r
 					break // Remaining will be triggered in case UNITWaitForRetryAlarmOn
@@ -154,6 +684,7 @@ func (u *RFIDUnit) run() {
 				log.Printf("[%v] UNITWaitForRetryAlarmOff", adr)
 				for k, v := range u.failedAlarmOff {
 					u.currentItem = u.items[k]
+					u.auditItem("RETRY-ALARM-OFF", k, v, "")
 					r := u.vendor.GenerateRFIDReq(RFIDReq{Cmd: cmdRetryAlarmOff, Data: []byte(v)})
 					u.ToRFID <- r
 					break // Remaining will be triggered in case UNITWaitForRetryAlarmOff
@@ -161,30 +692,39 @@ func (u *RFIDUnit) run() {
 				// TODO default case -> ERROR
 			}
 		case msg := <-u.FromRFID:
+			u.lastRFID = time.Now()
+			if u.state == UNITAdminCommand {
+				// The response is returned as is, without being parsed
+				u.adminCommandDone(msg, nil)
+				break
+			}
 			r, err := u.vendor.ParseRFIDResp(msg)
 			if err != nil {
 				log.Println("ERROR:", err.Error())
 				log.Printf("WARN: [%v] failed to understand RFID message, shutting down.", adr)
-				u.ToUI <- UIMsg{Action: "CONNECT", RFIDError: true}
-				u.Quit <- true
-				break
+				u.ToUI <- UIMsg{Action: "CONNECT", RFIDError: true, ErrorCode: msgRFIDError}
+				u.shutdown()
+				return
 			}
 			switch u.state {
+			case UNITTimeoutWaitForEndOK:
+				// Whatever the response, the RFID-unit is alive again
+				u.resumeAfterTimeout()
 			case UNITWaitForEndOK:
 				if !r.OK {
 					// Bail out in the unlikely event of not being able to stop
 					// the scan loop:
-					u.ToUI <- UIMsg{Action: "CONNECT", RFIDError: true}
-					u.Quit <- true
-					break
+					u.ToUI <- UIMsg{Action: "CONNECT", RFIDError: true, ErrorCode: msgRFIDError}
+					u.shutdown()
+					return
 				}
 				u.state = UNITIdle
 			case UNITCheckinWaitForBegOK:
 				if !r.OK {
 					log.Printf("WARN: [%v] RFID failed to start scanning, shutting down.", adr)
-					u.ToUI <- UIMsg{Action: "CONNECT", RFIDError: true}
-					u.Quit <- true
-					break
+					u.ToUI <- UIMsg{Action: "CONNECT", RFIDError: true, ErrorCode: msgRFIDError}
+					u.shutdown()
+					return
 				}
 				u.state = UNITCheckin
 				log.Printf("[%v] UNITCheckin", adr)
@@ -197,12 +737,16 @@ func (u *RFIDUnit) run() {
 						// Get item infor from SIP, to have title to display
 						u.currentItem, err = DoSIPCall(sipPool, sipFormMsgItemStatus(r.Barcode), itemStatusParse)
 						if err != nil {
-							log.Println("ERROR:", err.Error())
-							u.ToUI <- UIMsg{Action: "CONNECT", SIPError: true}
-							u.Quit <- true
+							status.Checkins.Inc("sip-error")
+							u.sipFailed("CHECKIN", r, err)
+							u.ToRFID <- u.vendor.GenerateRFIDReq(RFIDReq{Cmd: cmdAlarmLeave})
+							u.state = UNITWaitForCheckinAlarmLeave
+							log.Printf("[%v] UNITCheckinWaitForAlarmLeave", adr)
 							break
 						}
+						status.Checkins.Inc("incomplete")
 					}
+					u.auditItem("CHECKIN", r.Barcode, r.Tag, "incomplete")
 					u.currentItem.Action = "CHECKIN"
 					u.items[stripLeading10(r.Barcode)] = u.currentItem
 					u.ToRFID <- u.vendor.GenerateRFIDReq(RFIDReq{Cmd: cmdAlarmLeave})
@@ -212,10 +756,18 @@ func (u *RFIDUnit) run() {
 					// Proceed with checkin transaciton
 					u.currentItem, err = DoSIPCall(sipPool, sipFormMsgCheckin(u.dept, r.Barcode), checkinParse)
 					if err != nil {
-						log.Println("ERROR:", err.Error())
-						// TODO give UI error response, and send cmdAlarmLeave to RFID
+						if offline != nil && sipUnreachable(err) && u.checkinOffline(r, err) {
+							break
+						}
+						status.Checkins.Inc("sip-error")
+						u.sipFailed("CHECKIN", r, err)
+						u.ToRFID <- u.vendor.GenerateRFIDReq(RFIDReq{Cmd: cmdAlarmLeave})
+						u.state = UNITWaitForCheckinAlarmLeave
+						log.Printf("[%v] UNITCheckinWaitForAlarmLeave", adr)
 						break
 					}
+					status.Checkins.Inc(transactionOutcome(u.currentItem.Item))
+					u.auditItem("CHECKIN", r.Barcode, r.Tag, transactionOutcome(u.currentItem.Item))
 					if u.currentItem.Item.Unknown || u.currentItem.Item.TransactionFailed {
 						u.ToRFID <- u.vendor.GenerateRFIDReq(RFIDReq{Cmd: cmdAlarmLeave})
 						u.state = UNITWaitForCheckinAlarmLeave
@@ -233,32 +785,39 @@ func (u *RFIDUnit) run() {
 				log.Printf("[%v] UNITCheckin", adr)
 				if !r.OK {
 					u.currentItem.Item.AlarmOnFailed = true
-					u.currentItem.Item.Status = "Feil: fikk ikke skrudd på alarm."
+					status.AlarmFailures.Inc("on")
+					u.currentItem.Item.setStatus(msgAlarmOnFailed)
 				} else {
 					delete(u.failedAlarmOn, u.currentItem.Item.Barcode)
 					u.currentItem.Item.AlarmOnFailed = false
-					u.currentItem.Item.Status = ""
+					u.currentItem.Item.setStatus("")
 				}
 				// Discard branchcode if issuing branch is the same as target branch
 				if u.dept == u.currentItem.Item.Transfer {
 					u.currentItem.Item.Transfer = ""
 				}
+				u.currentItem.Slip = u.checkinSlip()
+				u.record(alarmResult("on", r.OK))
 				u.ToUI <- u.currentItem
 			case UNITWaitForRetryAlarmOn:
 				if !r.OK {
 					u.currentItem.Item.AlarmOnFailed = true
-					u.currentItem.Item.Status = "Feil: fikk ikke skrudd på alarm."
+					status.AlarmFailures.Inc("on")
+					u.currentItem.Item.setStatus(msgAlarmOnFailed)
 				} else {
 					delete(u.failedAlarmOn, u.currentItem.Item.Barcode)
-					u.currentItem.Item.Status = ""
+					u.currentItem.Item.setStatus("")
 					u.currentItem.Item.AlarmOnFailed = false
 				}
+				u.record(alarmResult("on", r.OK))
 				u.ToUI <- u.currentItem
 
 				if len(u.failedAlarmOn) > 0 {
 					for k, v := range u.failedAlarmOn {
 						u.currentItem = u.items[k]
 						u.currentItem.Item.Transfer = ""
+						u.currentItem.Item.Transit, u.currentItem.Item.TransitTo = false, ""
+						u.auditItem("RETRY-ALARM-ON", k, v, "")
 						u.state = UNITWaitForRetryAlarmOn
 						log.Printf("[%v] UNITWaitForCheckoutAlarmOn", adr)
 						r := u.vendor.GenerateRFIDReq(RFIDReq{Cmd: cmdRetryAlarmOn, Data: []byte(v)})
@@ -273,13 +832,14 @@ func (u *RFIDUnit) run() {
 				u.state = UNITCheckin
 				log.Printf("[%v] UNITCheckin", adr)
 				u.currentItem.Item.Date = ""
+				u.record(alarmResult("unchanged", r.OK))
 				u.ToUI <- u.currentItem
 			case UNITCheckoutWaitForBegOK:
 				if !r.OK {
 					log.Printf("WARN: [%v] RFID failed to start scanning, shutting down.", adr)
-					u.ToUI <- UIMsg{Action: "CONNECT", RFIDError: true}
-					u.Quit <- true
-					break
+					u.ToUI <- UIMsg{Action: "CONNECT", RFIDError: true, ErrorCode: msgRFIDError}
+					u.shutdown()
+					return
 				}
 				u.state = UNITCheckout
 				log.Printf("[%v] UNITCheckout", adr)
@@ -293,25 +853,43 @@ func (u *RFIDUnit) run() {
 						// get status of item, to have title to display on screen,
 						u.currentItem, err = DoSIPCall(sipPool, sipFormMsgItemStatus(r.Barcode), itemStatusParse)
 						if err != nil {
-							log.Println("ERROR:", err.Error())
-							u.ToUI <- UIMsg{Action: "CONNECT", SIPError: true}
-							u.Quit <- true
+							status.Checkouts.Inc("sip-error")
+							u.sipFailed("CHECKOUT", r, err)
+							u.ToRFID <- u.vendor.GenerateRFIDReq(RFIDReq{Cmd: cmdAlarmLeave})
+							u.state = UNITWaitForCheckoutAlarmLeave
+							log.Printf("[%v] UNITCheckoutWaitForAlarmLeave", adr)
 							break
 						}
+						status.Checkouts.Inc("incomplete")
 					}
+					u.auditItem("CHECKOUT", r.Barcode, r.Tag, "incomplete")
 					u.currentItem.Action = "CHECKOUT"
 					u.items[stripLeading10(r.Barcode)] = u.currentItem
 					u.ToRFID <- u.vendor.GenerateRFIDReq(RFIDReq{Cmd: cmdAlarmLeave})
 					u.state = UNITWaitForCheckoutAlarmLeave
 					log.Printf("[%v] UNITCheckoutWaitForAlarmLeave", adr)
+				} else if bc := stripLeading10(r.Barcode); u.checkedOut(bc) {
+					// Allready checked out in the session, eg. before the page
+					// was reloaded; only make sure the alarm is off, as a new
+					// checkout would renew the item.
+					u.currentItem = u.items[bc]
+					u.failedAlarmOff[bc] = r.Tag
+					u.ToRFID <- u.vendor.GenerateRFIDReq(RFIDReq{Cmd: cmdAlarmOff})
+					u.state = UNITWaitForCheckoutAlarmOff
+					log.Printf("[%v] UNITCheckoutNWaitForAlarmOff", adr)
 				} else {
 					// proced with checkout transaction
 					u.currentItem, err = DoSIPCall(sipPool, sipFormMsgCheckout(u.dept, u.patron, r.Barcode), checkoutParse)
 					if err != nil {
-						log.Println("ERROR:", err.Error())
-						// TODO give UI error response?
+						status.Checkouts.Inc("sip-error")
+						u.sipFailed("CHECKOUT", r, err)
+						u.ToRFID <- u.vendor.GenerateRFIDReq(RFIDReq{Cmd: cmdAlarmLeave})
+						u.state = UNITWaitForCheckoutAlarmLeave
+						log.Printf("[%v] UNITCheckoutWaitForAlarmLeave", adr)
 						break
 					}
+					status.Checkouts.Inc(transactionOutcome(u.currentItem.Item))
+					u.auditItem("CHECKOUT", r.Barcode, r.Tag, transactionOutcome(u.currentItem.Item))
 					u.currentItem.Action = "CHECKOUT"
 					if u.currentItem.Item.Unknown || u.currentItem.Item.TransactionFailed {
 						u.ToRFID <- u.vendor.GenerateRFIDReq(RFIDReq{Cmd: cmdAlarmLeave})
@@ -319,6 +897,9 @@ func (u *RFIDUnit) run() {
 						log.Printf("[%v] UNITCheckoutNWaitForAlarmLeave", adr)
 						break
 					} else {
+						if prev, ok := u.items[stripLeading10(r.Barcode)]; !ok || prev.Item.TransactionFailed {
+							u.checkouts = append(u.checkouts, stripLeading10(r.Barcode))
+						}
 						u.items[stripLeading10(r.Barcode)] = u.currentItem
 						u.failedAlarmOff[stripLeading10(r.Barcode)] = r.Tag // Store tag id for potential retry
 						u.ToRFID <- u.vendor.GenerateRFIDReq(RFIDReq{Cmd: cmdAlarmOff})
@@ -332,27 +913,32 @@ func (u *RFIDUnit) run() {
 				if !r.OK {
 					// TODO unit-test for this
 					u.currentItem.Item.AlarmOffFailed = true
-					u.currentItem.Item.Status = "Feil: fikk ikke skrudd av alarm."
+					status.AlarmFailures.Inc("off")
+					u.currentItem.Item.setStatus(msgAlarmOffFailed)
 				} else {
 					delete(u.failedAlarmOff, u.currentItem.Item.Barcode)
-					u.currentItem.Item.Status = ""
+					u.currentItem.Item.setStatus("")
 					u.currentItem.Item.AlarmOffFailed = false
 				}
+				u.record(alarmResult("off", r.OK))
 				u.ToUI <- u.currentItem
 			case UNITWaitForRetryAlarmOff:
 				if !r.OK {
 					u.currentItem.Item.AlarmOffFailed = true
-					u.currentItem.Item.Status = "Feil: fikk ikke skrudd av alarm."
+					status.AlarmFailures.Inc("off")
+					u.currentItem.Item.setStatus(msgAlarmOffFailed)
 				} else {
 					delete(u.failedAlarmOff, u.currentItem.Item.Barcode)
-					u.currentItem.Item.Status = ""
+					u.currentItem.Item.setStatus("")
 					u.currentItem.Item.AlarmOffFailed = false
 				}
+				u.record(alarmResult("off", r.OK))
 				u.ToUI <- u.currentItem
 
 				if len(u.failedAlarmOff) > 0 {
 					for k, v := range u.failedAlarmOff {
 						u.currentItem = u.items[k]
+						u.auditItem("RETRY-ALARM-OFF", k, v, "")
 						u.state = UNITWaitForCheckoutAlarmOff
 						log.Printf("[%v] UNITWaitForCheckoutAlarmOff", adr)
 						r := u.vendor.GenerateRFIDReq(RFIDReq{Cmd: cmdRetryAlarmOff, Data: []byte(v)})
@@ -371,6 +957,48 @@ func (u *RFIDUnit) run() {
 				}
 				u.state = UNITCheckout
 				log.Printf("[%v] UNITCheckout", adr)
+				u.record(alarmResult("unchanged", r.OK))
+				u.ToUI <- u.currentItem
+			case UNITRenewWaitForBegOK:
+				if !r.OK {
+					log.Printf("WARN: [%v] RFID failed to start scanning, shutting down.", adr)
+					u.ToUI <- UIMsg{Action: "CONNECT", RFIDError: true, ErrorCode: msgRFIDError}
+					u.shutdown()
+					return
+				}
+				u.state = UNITRenew
+				log.Printf("[%v] UNITRenew", adr)
+			case UNITRenew:
+				// Renewals doesn't depend on the item being complete, so
+				// missing tags are ignored. The alarm is left as it is.
+				if prev, ok := u.items[stripLeading10(r.Barcode)]; ok && !prev.Item.Unknown && !prev.Item.TransactionFailed {
+					// Allready renewed in the session, eg. before the page
+					// was reloaded:
+					u.currentItem = prev
+					u.ToRFID <- u.vendor.GenerateRFIDReq(RFIDReq{Cmd: cmdAlarmLeave})
+					u.state = UNITWaitForRenewAlarmLeave
+					log.Printf("[%v] UNITWaitForRenewAlarmLeave", adr)
+					break
+				}
+				u.currentItem, err = DoSIPCall(sipPool, sipFormMsgRenew(u.dept, u.patron, r.Barcode), renewParse)
+				if err != nil {
+					status.Renewals.Inc("sip-error")
+					u.sipFailed("RENEW", r, err)
+				} else {
+					status.Renewals.Inc(transactionOutcome(u.currentItem.Item))
+					u.auditItem("RENEW", r.Barcode, r.Tag, transactionOutcome(u.currentItem.Item))
+				}
+				u.items[stripLeading10(r.Barcode)] = u.currentItem
+				u.ToRFID <- u.vendor.GenerateRFIDReq(RFIDReq{Cmd: cmdAlarmLeave})
+				u.state = UNITWaitForRenewAlarmLeave
+				log.Printf("[%v] UNITWaitForRenewAlarmLeave", adr)
+			case UNITWaitForRenewAlarmLeave:
+				if !r.OK {
+					log.Printf("WARN: [%v] failed to leave alarm in current state", adr)
+				}
+				u.state = UNITRenew
+				log.Printf("[%v] UNITRenew", adr)
+				u.record(alarmResult("unchanged", r.OK))
 				u.ToUI <- u.currentItem
 			case UNITWaitForTagCount:
 				u.currentItem.Item.TransactionFailed = !r.OK
@@ -382,6 +1010,7 @@ func (u *RFIDUnit) run() {
 			case UNITPreWriteStep1:
 				if !r.OK {
 					u.currentItem.Item.WriteFailed = true
+					status.Writes.Inc("failed")
 					u.ToUI <- u.currentItem
 					u.state = UNITIdle
 					log.Printf("[%v] UNITIdle", adr)
@@ -389,11 +1018,12 @@ func (u *RFIDUnit) run() {
 				}
 				u.state = UNITPreWriteStep2
 				log.Printf("[%v] UNITPreWriteStep2", adr)
-				r := u.vendor.GenerateRFIDReq(RFIDReq{Cmd: cmdSLPLBC})
+				r := u.vendor.GenerateRFIDReq(RFIDReq{Cmd: cmdSLPLBC, Data: []byte(u.tags.CountryCode)})
 				u.ToRFID <- r
 			case UNITPreWriteStep2:
 				if !r.OK {
 					u.currentItem.Item.WriteFailed = true
+					status.Writes.Inc("failed")
 					u.ToUI <- u.currentItem
 					u.state = UNITIdle
 					log.Printf("[%v] UNITIdle", adr)
@@ -401,11 +1031,12 @@ func (u *RFIDUnit) run() {
 				}
 				u.state = UNITPreWriteStep3
 				log.Printf("[%v] UNITPreWriteStep3", adr)
-				r := u.vendor.GenerateRFIDReq(RFIDReq{Cmd: cmdSLPDTM})
+				r := u.vendor.GenerateRFIDReq(RFIDReq{Cmd: cmdSLPDTM, Data: []byte(u.tags.DataModel)})
 				u.ToRFID <- r
 			case UNITPreWriteStep3:
 				if !r.OK {
 					u.currentItem.Item.WriteFailed = true
+					status.Writes.Inc("failed")
 					u.ToUI <- u.currentItem
 					u.state = UNITIdle
 					log.Printf("[%v] UNITIdle", adr)
@@ -413,11 +1044,12 @@ func (u *RFIDUnit) run() {
 				}
 				u.state = UNITPreWriteStep4
 				log.Printf("[%v] UNITPreWriteStep4", adr)
-				r := u.vendor.GenerateRFIDReq(RFIDReq{Cmd: cmdSLPSSB})
+				r := u.vendor.GenerateRFIDReq(RFIDReq{Cmd: cmdSLPSSB, Data: []byte(u.tags.SecurityBit)})
 				u.ToRFID <- r
 			case UNITPreWriteStep4:
 				if !r.OK {
 					u.currentItem.Item.WriteFailed = true
+					status.Writes.Inc("failed")
 					u.ToUI <- u.currentItem
 					u.state = UNITIdle
 					log.Printf("[%v] UNITIdle", adr)
@@ -425,11 +1057,12 @@ func (u *RFIDUnit) run() {
 				}
 				u.state = UNITPreWriteStep5
 				log.Printf("[%v] UNITPreWriteStep5", adr)
-				r := u.vendor.GenerateRFIDReq(RFIDReq{Cmd: cmdSLPCRD})
+				r := u.vendor.GenerateRFIDReq(RFIDReq{Cmd: cmdSLPCRD, Data: []byte(u.tags.CheckRead)})
 				u.ToRFID <- r
 			case UNITPreWriteStep5:
 				if !r.OK {
 					u.currentItem.Item.WriteFailed = true
+					status.Writes.Inc("failed")
 					u.ToUI <- u.currentItem
 					u.state = UNITIdle
 					log.Printf("[%v] UNITIdle", adr)
@@ -437,11 +1070,12 @@ func (u *RFIDUnit) run() {
 				}
 				u.state = UNITPreWriteStep6
 				log.Printf("[%v] UNITPreWriteStep6", adr)
-				r := u.vendor.GenerateRFIDReq(RFIDReq{Cmd: cmdSLPWTM})
+				r := u.vendor.GenerateRFIDReq(RFIDReq{Cmd: cmdSLPWTM, Data: []byte(u.tags.WaitTime)})
 				u.ToRFID <- r
 			case UNITPreWriteStep6:
 				if !r.OK {
 					u.currentItem.Item.WriteFailed = true
+					status.Writes.Inc("failed")
 					u.ToUI <- u.currentItem
 					u.state = UNITIdle
 					log.Printf("[%v] UNITIdle", adr)
@@ -449,11 +1083,12 @@ func (u *RFIDUnit) run() {
 				}
 				u.state = UNITPreWriteStep7
 				log.Printf("[%v] UNITPreWriteStep7", adr)
-				r := u.vendor.GenerateRFIDReq(RFIDReq{Cmd: cmdSLPRSS})
+				r := u.vendor.GenerateRFIDReq(RFIDReq{Cmd: cmdSLPRSS, Data: []byte(u.tags.SetStatus)})
 				u.ToRFID <- r
 			case UNITPreWriteStep7:
 				if !r.OK {
 					u.currentItem.Item.WriteFailed = true
+					status.Writes.Inc("failed")
 					u.ToUI <- u.currentItem
 					u.state = UNITIdle
 					log.Printf("[%v] UNITIdle", adr)
@@ -466,6 +1101,7 @@ func (u *RFIDUnit) run() {
 			case UNITPreWriteStep8:
 				if !r.OK {
 					u.currentItem.Item.WriteFailed = true
+					status.Writes.Inc("failed")
 					u.ToUI <- u.currentItem
 					u.state = UNITIdle
 					log.Printf("[%v] UNITIdle", adr)
@@ -474,10 +1110,10 @@ func (u *RFIDUnit) run() {
 				if r.TagCount != u.currentItem.Item.NumTags {
 					// Mismatch between number of tags on the RFID-reader and
 					// expected number assigned in the UI.
-					errMsg := fmt.Sprintf("forventet %d brikke(r), men fant %d.",
-						u.currentItem.Item.NumTags, r.TagCount)
-					u.currentItem.Item.Status = errMsg
+					u.currentItem.Item.TagsFound = r.TagCount
+					u.currentItem.Item.setStatus(msgTagCountMismatch, u.currentItem.Item.NumTags, r.TagCount)
 					u.currentItem.Item.TagCountFailed = true
+					status.TagCountMismatches.Inc(1)
 					u.ToUI <- u.currentItem
 					u.state = UNITIdle
 					log.Printf("[%v] UNITIdle", adr)
@@ -492,6 +1128,7 @@ func (u *RFIDUnit) run() {
 			case UNITWriting:
 				if !r.OK {
 					u.currentItem.Item.WriteFailed = true
+					status.Writes.Inc("failed")
 					u.ToUI <- u.currentItem
 					u.state = UNITIdle
 					log.Printf("[%v] UNITIdle", adr)
@@ -500,53 +1137,260 @@ func (u *RFIDUnit) run() {
 				u.state = UNITIdle
 				log.Printf("[%v] UNITIdle", adr)
 				u.currentItem.Item.WriteFailed = false
-				u.currentItem.Item.Status = "OK, preget"
+				u.currentItem.Item.setStatus(msgWriteOK)
+				status.Writes.Inc("ok")
 				u.ToUI <- u.currentItem
 				// TODO default case -> ERROR
 			}
 
 		case <-u.Quit:
-			close(u.ToRFID)
-			u.state = UNITOff
-			log.Printf("Shutting down RFID-unit state-machine for %v", addr2IP(adr))
-			//u.ToRFID <- u.vendor.GenerateRFIDReq(RFIDReq{Cmd: cmdEndScan})
-			log.Printf("Closing TCP connection to %v", adr)
-			u.conn.Close()
+			u.shutdown()
 			return
 		}
+
+		status.setUnitState(u, u.state)
+
+		// Wait for the RFID-unit to respond in the current state, resetting
+		// the deadline on every event:
+		timeout = nil
+		if d := u.cfg.rfidTimeout(u.state); d > 0 && !lost {
+			timeout = time.After(d)
+		}
 	}
 }
 
 // tcpReader reads from a TCP connection and pipe the messages into FromRFID channel.
+// If the connection is lost, it keeps trying to reconnect to the RFID-unit until
+// it succeeds or the state-machine is shut down.
 func (u *RFIDUnit) tcpReader() {
-	r := bufio.NewReader(u.conn)
+	r := bufio.NewReader(u.getConn())
 	for {
 		msg, err := r.ReadBytes('\r')
 		if err != nil {
-			if u.state != UNITOff {
-				log.Printf("ERROR: [%v] cannot read from connection: %v", u.conn.RemoteAddr().String(), err)
-				//u.ToUI <- UIMsg{Action: "CONNECT", RFIDError: true}
-				u.Quit <- true
+			select {
+			case <-u.closed:
+				return
+			default:
+			}
+			log.Printf("ERROR: [%v] cannot read from connection: %v", u.addr, err)
+			select {
+			case u.connLost <- true:
+			case <-u.closed:
+				return
+			}
+			if !u.reconnect() {
+				return
 			}
-			break
+			r = bufio.NewReader(u.getConn())
+			select {
+			case u.reconnected <- true:
+			case <-u.closed:
+				return
+			}
+			continue
+		}
+		log.Printf("<- [%v] %q", u.addr, msg)
+		select {
+		case u.FromRFID <- msg:
+		case <-u.closed:
+			return
 		}
-		log.Printf("<- [%v] %q", u.conn.RemoteAddr().String(), msg)
-		u.FromRFID <- msg
 	}
 }
 
 // tcpWriter writes messages from channel ToRFID to a TCP connection.
 func (u *RFIDUnit) tcpWriter() {
 	for msg := range u.ToRFID {
-		_, err := u.conn.Write(msg)
+		conn := u.getConn()
+		_, err := conn.Write(msg)
 		if err != nil {
-			if u.state != UNITOff {
-				log.Printf("ERROR: [%v] cannot write to connection: %v", u.conn.RemoteAddr().String(), err)
-				u.ToUI <- UIMsg{Action: "CONNECT", RFIDError: true}
-				u.Quit <- true
+			log.Printf("ERROR: [%v] cannot write to connection: %v", u.addr, err)
+			// Make sure tcpReader notices, so that it can reconnect:
+			conn.Close()
+			continue
+		}
+		log.Printf("-> [%v] %q", u.addr, msg)
+	}
+}
+
+// renewAll renews all items on loan to the current patron, and sends the
+// outcome for each item to the UI. The new due dates are looked up
+// separately, as the Renew All response doesn't include them. An error is
+// only returned if the SIP-server is unavailable.
+func (u *RFIDUnit) renewAll() error {
+	var res renewAllResult
+	if _, err := DoSIPCall(sipPool, sipFormMsgRenewAll(u.dept, u.patron), renewAllParse(&res)); err != nil {
+		return err
+	}
+	if len(res.Renewed) == 0 && len(res.Unrenewed) == 0 {
+		// No items on loan, or the patron is blocked
+		u.ToUI <- UIMsg{Action: "RENEW-ALL",
+			Item: item{TransactionFailed: !res.OK, Status: res.Status,
+				StatusCode: screenMessageCode(res.Status)}}
+		return nil
+	}
+
+	for _, barcode := range res.Renewed {
+		msg, err := DoSIPCall(sipPool, sipFormMsgItemStatus(barcode), dueDateParse)
+		if err != nil {
+			return err
+		}
+		msg.Action = "RENEW-ALL"
+		msg.Item.Barcode = barcode
+		status.Renewals.Inc("ok")
+		e := u.newAuditEntry("RENEW-ALL", barcode, "", "ok")
+		e.Item = msg.Item
+		u.writeAudit(e)
+		u.ToUI <- msg
+	}
+	for _, barcode := range res.Unrenewed {
+		msg := UIMsg{Action: "RENEW-ALL",
+			Item: item{Barcode: barcode, TransactionFailed: true, Status: res.Status,
+				StatusCode: screenMessageCode(res.Status)}}
+		status.Renewals.Inc("failed")
+		e := u.newAuditEntry("RENEW-ALL", barcode, "", "failed")
+		e.Item = msg.Item
+		u.writeAudit(e)
+		u.ToUI <- msg
+	}
+	return nil
+}
+
+// sendReceipt sends a receipt of the items checked out in the session to the
+// UI. If the workstation has a printer, it is sent when it has been printed.
+func (u *RFIDUnit) sendReceipt() {
+	data := receiptData{
+		Branch:     u.dept,
+		Patron:     u.patron,
+		PatronName: u.patronName,
+		Date:       time.Now().Format("02/01/2006 15:04"),
+	}
+	for _, barcode := range u.checkouts {
+		data.Items = append(data.Items, u.items[barcode].Item)
+	}
+	t := u.cfg.templates(u.dept)
+	p, err := render(t.Receipt, t.ReceiptHTML, defaultReceiptText, defaultReceiptHTML, data)
+	if err != nil {
+		log.Printf("ERROR: [%v] failed to render receipt: %v", u.addr, err)
+		u.ToUI <- UIMsg{Action: "RECEIPT", ErrorMessage: err.Error(), ErrorCode: msgPrintFailed}
+		return
+	}
+	msg := UIMsg{Action: "RECEIPT", Patron: u.patron, Branch: u.dept}
+	if !u.print("receipt", p, msg) {
+		msg.Receipt = p
+		u.ToUI <- msg
+	}
+}
+
+// checkinSlip returns a hold slip if the current item is reserved, or a
+// transit slip if it must be sent to another branch. If the workstation has a
+// printer, the slip is printed, and sent to the UI again in a SLIP message
+// when it has been. It returns nil if no slip is needed, or it cannot be made.
+func (u *RFIDUnit) checkinSlip() *printout {
+	i := u.currentItem.Item
+	data := slipData{
+		Branch:  u.dept,
+		Date:    time.Now().Format("02/01/2006 15:04"),
+		Title:   i.Label,
+		Barcode: i.Barcode,
+	}
+	t := u.cfg.templates(u.dept)
+	var p *printout
+	var err error
+	switch {
+	case i.Hold || i.HoldOtherBranch:
+		data.Patron = i.HoldPatron
+		if data.Patron == "" {
+			data.Patron = i.Borrowernr
+		}
+		data.PickupBranch = u.dept
+		if i.HoldOtherBranch {
+			data.PickupBranch = i.PickupBranch
+			data.Destination = i.TransitTo
+		}
+		p, err = render(t.HoldSlip, t.HoldSlipHTML, defaultHoldSlipText, defaultHoldSlipHTML, data)
+	case i.Transit || i.Transfer != "":
+		data.Destination = i.TransitTo
+		if data.Destination == "" {
+			data.Destination = i.Transfer
+		}
+		p, err = render(t.TransitSlip, t.TransitSlipHTML, defaultTransitSlipText, defaultTransitSlipHTML, data)
+	default:
+		return nil
+	}
+	if err != nil {
+		log.Printf("ERROR: [%v] failed to render slip: %v", u.addr, err)
+		return nil
+	}
+	u.print("slip", p, UIMsg{Action: "SLIP", Branch: u.dept, Item: item{Barcode: i.Barcode}})
+	return p
+}
+
+// print queues the printout for the workstation's printer, and returns true,
+// if it has one. The printer goroutine prints it, so that the state-machine
+// doesn't wait for the printer, and msg is sent to the UI with the printout
+// when it is done; see printDone.
+func (u *RFIDUnit) print(what string, p *printout, msg UIMsg) bool {
+	addr := u.cfg.printerAddr(u.workstation, u.ip)
+	if addr == "" {
+		return false
+	}
+	job := printJob{what: what, addr: addr, p: p, msg: msg}
+	select {
+	case u.prints <- job:
+	default:
+		job.err = errors.New("too many printouts waiting")
+		u.printDone(job)
+	}
+	return true
+}
+
+// printer prints the printouts queued by print, one at a time, and hands them
+// back to the state-machine. It stops when the state-machine shuts down.
+func (u *RFIDUnit) printer() {
+	for {
+		select {
+		case job := <-u.prints:
+			job.err = printRaw(job.addr, job.p)
+			select {
+			case u.printed <- job:
+			case <-u.closed:
+				return
 			}
-			break
+		case <-u.closed:
+			return
 		}
-		log.Printf("-> [%v] %q", u.conn.RemoteAddr().String(), msg)
 	}
 }
+
+// printDone sends the message of a print job to the UI, with the printout
+// marked as printed, or with the error if it could not be printed.
+func (u *RFIDUnit) printDone(job printJob) {
+	p := *job.p // a slip is allready sent to the UI with the item
+	msg := job.msg
+	if job.err != nil {
+		log.Printf("ERROR: [%v] failed to print %v: %v: %v", u.addr, job.what, job.addr, job.err)
+		msg.ErrorMessage = fmt.Sprintf("%v: %v", job.addr, job.err)
+		msg.ErrorCode = msgPrintFailed
+	} else {
+		p.Printed = true
+	}
+	if msg.Action == "SLIP" {
+		msg.Slip = &p
+	} else {
+		msg.Receipt = &p
+	}
+	u.ToUI <- msg
+}
+
+// transactionOutcome returns the outcome of a checkin or checkout transaction,
+// as recorded in the metrics.
+func transactionOutcome(i item) string {
+	switch {
+	case i.Unknown:
+		return "unknown"
+	case i.TransactionFailed:
+		return "failed"
+	}
+	return "ok"
+}
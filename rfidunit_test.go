@@ -2,9 +2,12 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net"
+	"net/http"
 	"net/http/httptest"
 	"reflect"
 	"strings"
@@ -52,14 +55,6 @@ func (d *dummyRFID) writer() {
 }
 
 func (d *dummyRFID) run() {
-	var err error
-	d.mu.Lock()
-	d.ln, err = net.Listen("tcp", ":0")
-	d.mu.Unlock()
-	if err != nil {
-		println(err.Error())
-		panic("Cannot start dummy RFID TCP-server")
-	}
 	defer d.ln.Close()
 	c, err := d.ln.Accept()
 	if err != nil {
@@ -93,6 +88,12 @@ func newDummyRFIDReader() *dummyRFID {
 		incoming: make(chan []byte),
 		outgoing: make(chan []byte),
 	}
+	ln, err := net.Listen("tcp", ":0")
+	if err != nil {
+		println(err.Error())
+		panic("Cannot start dummy RFID TCP-server")
+	}
+	d.ln = ln
 	go d.run()
 	return &d
 }
@@ -159,7 +160,7 @@ func TestMissingRFIDUnit(t *testing.T) {
 	// <- end setup
 
 	uiMsg := <-uiChan
-	want := UIMsg{Action: "CONNECT", RFIDError: true}
+	want := UIMsg{Action: "CONNECT", RFIDError: true, ErrorCode: msgRFIDError}
 	if !reflect.DeepEqual(uiMsg, want) {
 		t.Errorf("Got %+v; want %+v", uiMsg, want)
 		t.Fatal("UI didn't get notified of failed RFID connect")
@@ -204,13 +205,74 @@ func TestRFIDUnitInitVersionFailure(t *testing.T) {
 	d.outgoing <- []byte("NOK\r")
 
 	uiMsg := <-uiChan
-	want := UIMsg{Action: "CONNECT", RFIDError: true}
+	want := UIMsg{Action: "CONNECT", RFIDError: true, ErrorCode: msgRFIDError}
 	if !reflect.DeepEqual(uiMsg, want) {
 		t.Errorf("Got %+v; want %+v", uiMsg, want)
 		t.Fatal("UI didn't get notified of failed RFID connect")
 	}
 }
 
+// Test that the state-machine shuts down when the RFID-unit refuses to start
+// scanning, without holding up the hub.
+func TestRFIDUnitBeginScanFailure(t *testing.T) {
+	// Setup: ->
+
+	uiChan := make(chan UIMsg)
+	sipSrv := newSIPTestServer()
+	defer sipSrv.Close()
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	d := newDummyRFIDReader()
+	defer d.Close()
+
+	hub = newHub(config{
+		HTTPPort:          port(srv.URL),
+		SIPServer:         sipSrv.Addr(),
+		TCPPort:           port(d.addr()),
+		NumSIPConnections: 1,
+	})
+	go hub.run()
+	defer hub.Close()
+
+	a := newDummyUIAgent(uiChan, port(srv.URL))
+
+	// <- end setup
+
+	<-d.incoming // VER2.00
+	d.outgoing <- []byte("OK\r")
+	<-uiChan // CONNECT
+
+	err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKIN","Branch":"hutl"}`))
+	if err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	<-d.incoming // BEG
+	d.outgoing <- []byte("NOK\r")
+
+	uiMsg := <-uiChan
+	want := UIMsg{Action: "CONNECT", RFIDError: true, ErrorCode: msgRFIDError}
+	if !reflect.DeepEqual(uiMsg, want) {
+		t.Errorf("Got %+v; want %+v", uiMsg, want)
+	}
+
+	// The hub can stop the state-machine when the UI disconnects
+	a.c.Close()
+	done := make(chan bool)
+	go func() {
+		for len(hub.connections()) > 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Hub didn't unregister the UI after the RFID-unit failed to start scanning")
+	}
+}
+
 func TestUnavailableSIPServer(t *testing.T) {
 	// Setup: ->
 
@@ -257,7 +319,7 @@ func TestUnavailableSIPServer(t *testing.T) {
 	d.outgoing <- []byte("RDT1003010824124004:NO:02030000|1\r")
 
 	uiMsg := <-uiChan
-	want := UIMsg{Action: "CONNECT", SIPError: true}
+	want := UIMsg{Action: "CONNECT", SIPError: true, ErrorCode: msgSIPError}
 	if !reflect.DeepEqual(uiMsg, want) {
 		t.Errorf("Got %+v; want %+v", uiMsg, want)
 		t.Fatal("UI didn't get notified of SIP error")
@@ -265,11 +327,11 @@ func TestUnavailableSIPServer(t *testing.T) {
 
 }
 
-func TestCheckins(t *testing.T) {
+func TestSIPServerTimeout(t *testing.T) {
 	// Setup: ->
 
 	uiChan := make(chan UIMsg)
-	sipSrv := newSIPTestServer()
+	sipSrv := newSIPTestServer().Hanging()
 	defer sipSrv.Close()
 
 	srv := httptest.NewServer(nil)
@@ -278,13 +340,13 @@ func TestCheckins(t *testing.T) {
 	d := newDummyRFIDReader()
 	defer d.Close()
 
-	time.Sleep(50) // make sure rfidreader has got designated a port and is listening
-
 	hub = newHub(config{
 		HTTPPort:          port(srv.URL),
 		SIPServer:         sipSrv.Addr(),
 		TCPPort:           port(d.addr()),
 		NumSIPConnections: 1,
+		SIPConnectTimeout: duration{50 * time.Millisecond},
+		SIPReadTimeout:    duration{50 * time.Millisecond},
 	})
 	go hub.run()
 	defer hub.Close()
@@ -294,149 +356,167 @@ func TestCheckins(t *testing.T) {
 
 	// <- end setup
 
-	msg := <-d.incoming
-	if string(msg) != "VER2.00\r" {
-		t.Fatal("RFID-unit didn't get version init command")
-	}
-
+	<-d.incoming // VER2.00
 	d.outgoing <- []byte("OK\r")
+	<-uiChan // CONNECT
 
-	// Verify that UI get's CONNECT message
-	uiMsg := <-uiChan
-	want := UIMsg{Action: "CONNECT"}
-	if !reflect.DeepEqual(uiMsg, want) {
-		t.Errorf("Got %+v; want %+v", uiMsg, want)
-		t.Fatal("UI didn't get notified of succesfull rfid connect")
+	// The SIP-server never responds. Verify that the UI gets notified of the
+	// timeout, and that the state-machine keeps running.
+	for i := 0; i < 2; i++ {
+		err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"PATRON-INFO", "Patron": "95"}`))
+		if err != nil {
+			t.Fatal("UI failed to send message over websokcet conn")
+		}
+		uiMsg := <-uiChan
+		want := UIMsg{Action: "CONNECT", SIPTimeout: true, ErrorMessage: "SIP-server didn't respond in time",
+			ErrorCode: msgSIPTimeout}
+		if !reflect.DeepEqual(uiMsg, want) {
+			t.Errorf("Got %+v; want %+v", uiMsg, want)
+		}
 	}
+}
 
-	// Send "CHECKIN" message from UI and verify that the UI gets notified of
-	// succesfull connect & RFID-unit that gets instructed to starts scanning for tags.
-	err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKIN","Branch":"fmaj"}`))
-	if err != nil {
-		t.Fatal("UI failed to send message over websokcet conn")
-	}
+func TestSIPCircuitBreaker(t *testing.T) {
+	// Setup: ->
 
-	msg = <-d.incoming
-	if string(msg) != "BEG\r" {
-		t.Fatal("UI -> CHECKIN: RFID-unit didn't get instructed to start scanning")
-	}
+	uiChan := make(chan UIMsg)
+	sipSrv := newSIPTestServer().Failing()
+	defer sipSrv.Close()
 
-	// acknowledge BEG command
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	d := newDummyRFIDReader()
+	defer d.Close()
+
+	hub = newHub(config{
+		HTTPPort:            port(srv.URL),
+		SIPServer:           sipSrv.Addr(),
+		TCPPort:             port(d.addr()),
+		NumSIPConnections:   1,
+		SIPBreakerThreshold: 1,
+		SIPBreakerCooldown:  duration{50 * time.Millisecond},
+	})
+	go hub.run()
+	defer hub.Close()
+
+	a := newDummyUIAgent(uiChan, port(srv.URL))
+	defer a.c.Close()
+
+	// <- end setup
+
+	<-d.incoming // VER2.00
 	d.outgoing <- []byte("OK\r")
+	<-uiChan // CONNECT
 
-	// Simulate found book on RFID-unit. Verify that it get's checked in through
-	// SIP, the Alarm turned on, and that UI get's notified of the transaction
-	sipSrv.Respond("101YNN20140226    161239AO|AB03010824124004|AQfhol|AJHeavy metal in Baghdad|CTfbol|AA2|CS927.8|\r")
-	d.outgoing <- []byte("RDT1003010824124004:NO:02030000|0\r")
+	unavailable := UIMsg{Action: "CONNECT", SIPError: true, SIPUnavailable: true,
+		ErrorMessage: "SIP-server unavailable", ErrorCode: msgSIPUnavailable}
 
-	msg = <-d.incoming
-	if string(msg) != "OK1\r" {
-		t.Errorf("Checkin: RFID reader didn't get instructed to turn on alarm")
+	// The first failed request trips the circuit breaker, and the UI is
+	// notified of the SIP error, and that the SIP-server is unavailable:
+	err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"PATRON-INFO", "Patron": "95"}`))
+	if err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	var got []UIMsg
+	got = append(got, <-uiChan, <-uiChan)
+	if !reflect.DeepEqual(got[0], unavailable) && !reflect.DeepEqual(got[1], unavailable) {
+		t.Fatalf("Got %+v; want one of them to be %+v", got, unavailable)
 	}
-	// simulate failed alarm command
-	d.outgoing <- []byte("NOK\r")
 
-	uiMsg = <-uiChan
-	want = UIMsg{Action: "CHECKIN",
-		Item: item{
-			Label:         "Heavy metal in Baghdad",
-			Barcode:       "03010824124004",
-			Date:          "26/02/2014",
-			AlarmOnFailed: true,
-			Transfer:      "fbol",
-			Status:        "Feil: fikk ikke skrudd på alarm.",
-		}}
-	if !reflect.DeepEqual(uiMsg, want) {
-		t.Errorf("Got %+v; want %+v", uiMsg, want)
-		t.Fatal("UI didn't get the correct message after checkin")
+	r, err := http.Get(fmt.Sprintf("http://localhost:%s/.status", port(srv.URL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var st exportMetrics
+	err = json.NewDecoder(r.Body).Decode(&st)
+	r.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.SIPCircuit == "closed" {
+		t.Errorf("/.status SIPCircuit => %q; want open or half-open", st.SIPCircuit)
 	}
 
-	// retry alarm on
-	err = a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"RETRY-ALARM-ON"}`))
+	// Requests fail fast while the circuit breaker is open:
+	err = a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"PATRON-INFO", "Patron": "95"}`))
 	if err != nil {
 		t.Fatal("UI failed to send message over websokcet conn")
 	}
-
-	msg = <-d.incoming
-	if string(msg) != "ACT1003010824124004:NO:02030000\r" {
-		t.Fatal("UI -> RETRY-ALARM-ON didn't trigger the right RFID command")
+	if uiMsg := <-uiChan; !reflect.DeepEqual(uiMsg, unavailable) {
+		t.Errorf("Got %+v; want %+v", uiMsg, unavailable)
 	}
 
-	d.outgoing <- []byte("OK\r")
+	// When the SIP-server comes back, the probe (SC Status) succeeds, and
+	// the UI is notified:
+	sipSrv.Respond("98YYYNYN01000320140226    2031402.00AOHUTL|BXYYYYYYYYYYYYYYYY|\r")
+	sipSrv.SetFailing(false)
+	if uiMsg := <-uiChan; !reflect.DeepEqual(uiMsg, UIMsg{Action: "CONNECT"}) {
+		t.Errorf("Got %+v; want %+v", uiMsg, UIMsg{Action: "CONNECT"})
+	}
 
-	uiMsg = <-uiChan
-	want = UIMsg{Action: "CHECKIN",
-		Item: item{
-			Label:   "Heavy metal in Baghdad",
-			Barcode: "03010824124004",
-			Date:    "26/02/2014",
-		}}
-	if !reflect.DeepEqual(uiMsg, want) {
-		t.Errorf("Got %+v; want %+v", uiMsg, want)
-		t.Fatal("UI didn't get the correct message after checkin retry alarm on")
+	sipSrv.Respond("64              00020140303    110236000100000003000000000000AOHUTL|AA95|AEPer Hansen|BLY|CQY|\r")
+	err = a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"PATRON-INFO", "Patron": "95"}`))
+	if err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	if uiMsg := <-uiChan; uiMsg.Action != "PATRON-INFO" || uiMsg.PatronInfo == nil {
+		t.Errorf("Got %+v; want PATRON-INFO after SIP-server recovered", uiMsg)
 	}
+}
 
-	// Simulate barcode not in our db
+func TestWorkstationUnitMapping(t *testing.T) {
+	// Setup: ->
 
-	sipSrv.Respond("100NUY20140128    114702AO|AB1234|CV99|AFItem not checked out|\r")
-	d.outgoing <- []byte("RDT1234:NO:02030000|0\r")
+	uiChan := make(chan UIMsg)
+	sipSrv := newSIPTestServer()
+	defer sipSrv.Close()
 
-	msg = <-d.incoming
-	if string(msg) != "OK \r" {
-		t.Errorf("Alarm was changed after unsuccessful checkin")
-	}
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
 
-	d.outgoing <- []byte("OK\r")
+	d := newDummyRFIDReader()
+	defer d.Close()
 
-	uiMsg = <-uiChan
-	want = UIMsg{Action: "CHECKIN",
-		Item: item{
-			Barcode:           "1234",
-			TransactionFailed: true,
-			Unknown:           true,
-			Status:            "eksemplaret finnes ikke i basen",
-		}}
-	if !reflect.DeepEqual(uiMsg, want) {
-		t.Errorf("Got %+v; want %+v", uiMsg, want)
+	hub = newHub(config{
+		HTTPPort:          port(srv.URL),
+		SIPServer:         sipSrv.Addr(),
+		TCPPort:           "12346", // not listening
+		NumSIPConnections: 1,
+		Units: map[string]unitConfig{
+			"desk1": {Addr: "127.0.0.1:" + port(d.addr())},
+		},
+	})
+	go hub.run()
+	defer hub.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial(
+		fmt.Sprintf("ws://localhost:%s/ws?workstation=desk1", port(srv.URL)), nil)
+	if err != nil {
+		t.Fatal(err)
 	}
+	a := &dummyUIAgent{c: ws, msg: uiChan}
+	go a.run()
+	defer a.c.Close()
 
-	// Simulate book on RFID-unit, but with missing tags. Verify that UI gets
-	// notified with the books title, along with an error message
-	sipSrv.Respond("1803020120140226    203140AB03010824124004|AO|AJHeavy metal in Baghdad|AQfhol|BGfhol|\r")
-	d.outgoing <- []byte("RDT1003010824124004:NO:02030000|1\r")
+	// <- end setup
 
-	msg = <-d.incoming
-	if string(msg) != "OK \r" {
-		t.Error("Alarm was changed after unsuccessful checkin")
+	msg := <-d.incoming
+	if string(msg) != "VER2.00\r" {
+		t.Fatal("RFID-unit mapped to workstation didn't get version init command")
 	}
 	d.outgoing <- []byte("OK\r")
 
-	uiMsg = <-uiChan
-	want = UIMsg{Action: "CHECKIN",
-		Item: item{
-			Label:             "Heavy metal in Baghdad",
-			Barcode:           "03010824124004",
-			TransactionFailed: true,
-		}}
+	uiMsg := <-uiChan
+	want := UIMsg{Action: "CONNECT"}
 	if !reflect.DeepEqual(uiMsg, want) {
 		t.Errorf("Got %+v; want %+v", uiMsg, want)
-		t.Fatal("UI didn't get the correct message when item is missing tags")
+		t.Fatal("UI didn't get notified of succesfull rfid connect")
 	}
-
-	// Verify that the RFID-unit gets END message when the corresponding
-	// websocket connection is closed.
-
-	// TODO I'm closing connection before, is this necessary?
-	// msg = <-d.incoming
-	// if string(msg) != "END\r" {
-	// 	t.Fatal("RFID-unit didn't get END message when UI connection was lost")
-	// }
-
 }
 
-func TestCheckouts(t *testing.T) {
-
-	// setup ->
+func TestRFIDUnitReconnect(t *testing.T) {
+	// Setup: ->
 
 	uiChan := make(chan UIMsg)
 	sipSrv := newSIPTestServer()
@@ -445,16 +525,19 @@ func TestCheckouts(t *testing.T) {
 	srv := httptest.NewServer(nil)
 	defer srv.Close()
 
-	d := newDummyRFIDReader()
-	defer d.Close()
-
-	time.Sleep(50) // make sure rfidreader has got designated a port and is listening
+	ln, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
 
 	hub = newHub(config{
 		HTTPPort:          port(srv.URL),
 		SIPServer:         sipSrv.Addr(),
-		TCPPort:           port(d.addr()),
+		TCPPort:           port(ln.Addr().String()),
 		NumSIPConnections: 1,
+		RFIDReconnectMin:  duration{10 * time.Millisecond},
+		RFIDReconnectMax:  duration{50 * time.Millisecond},
 	})
 	go hub.run()
 	defer hub.Close()
@@ -464,31 +547,524 @@ func TestCheckouts(t *testing.T) {
 
 	// <- end setup
 
-	// TESTS /////////////////////////////////////////////////////////////////
-
-	msg := <-d.incoming
+	c, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(c)
+	msg, _ := r.ReadBytes('\r')
 	if string(msg) != "VER2.00\r" {
 		t.Fatal("RFID-unit didn't get version init command")
 	}
-	d.outgoing <- []byte("OK\r")
+	c.Write([]byte("OK\r"))
+	<-uiChan // CONNECT OK
+
+	err = a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKIN","Branch":"fmaj"}`))
+	if err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	msg, _ = r.ReadBytes('\r')
+	if string(msg) != "BEG\r" {
+		t.Fatal("UI -> CHECKIN: RFID-unit didn't get instructed to start scanning")
+	}
+	c.Write([]byte("OK\r"))
+
+	// Simulate the RFID-unit dropping the connection
+	c.Close()
 
 	uiMsg := <-uiChan
-	want := UIMsg{Action: "CONNECT"}
+	want := UIMsg{Action: "CONNECT", RFIDError: true, ErrorCode: msgRFIDError}
 	if !reflect.DeepEqual(uiMsg, want) {
 		t.Errorf("Got %+v; want %+v", uiMsg, want)
-		t.Fatal("UI didn't get notified of succesfull rfid connect")
+		t.Fatal("UI didn't get notified of lost RFID connection")
 	}
 
-	// Send "CHECKOUT" message from UI and verify that the UI gets notified of
-	// succesfull connect & RFID-unit that gets instructed to starts scanning for tags.
-	err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKOUT", "Patron": "95", "Branch":"hutl"}`))
+	// Verify that the hub reconnects, reinitializes the RFID-unit and
+	// resumes the checkin session
+	c, err = ln.Accept()
 	if err != nil {
-		t.Fatal("UI failed to send message over websokcet conn")
+		t.Fatal(err)
 	}
-
-	msg = <-d.incoming
-	if string(msg) != "BEG\r" {
-		t.Fatal("UI -> CHECKOUT: RFID-unit didn't get instructed to start scanning")
+	defer c.Close()
+	r = bufio.NewReader(c)
+	msg, _ = r.ReadBytes('\r')
+	if string(msg) != "VER2.00\r" {
+		t.Fatal("RFID-unit didn't get version init command on reconnect")
+	}
+	c.Write([]byte("OK\r"))
+
+	uiMsg = <-uiChan
+	want = UIMsg{Action: "CONNECT"}
+	if !reflect.DeepEqual(uiMsg, want) {
+		t.Errorf("Got %+v; want %+v", uiMsg, want)
+		t.Fatal("UI didn't get notified of succesfull RFID reconnect")
+	}
+
+	msg, _ = r.ReadBytes('\r')
+	if string(msg) != "BEG\r" {
+		t.Fatal("RFID-unit didn't get instructed to resume scanning after reconnect")
+	}
+}
+
+func TestRFIDUnitTimeout(t *testing.T) {
+	// Setup: ->
+
+	uiChan := make(chan UIMsg)
+	sipSrv := newSIPTestServer()
+	defer sipSrv.Close()
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	d := newDummyRFIDReader()
+	defer d.Close()
+
+	hub = newHub(config{
+		HTTPPort:          port(srv.URL),
+		SIPServer:         sipSrv.Addr(),
+		TCPPort:           port(d.addr()),
+		NumSIPConnections: 1,
+		RFIDTimeout:       duration{50 * time.Millisecond},
+	})
+	go hub.run()
+	defer hub.Close()
+
+	a := newDummyUIAgent(uiChan, port(srv.URL))
+	defer a.c.Close()
+
+	// <- end setup
+
+	<-d.incoming // VER2.00
+	d.outgoing <- []byte("OK\r")
+	<-uiChan // CONNECT
+
+	err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKIN","Branch":"fmaj"}`))
+	if err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	<-d.incoming // BEG
+	d.outgoing <- []byte("OK\r")
+
+	// Scanning for items has no time limit:
+	time.Sleep(100 * time.Millisecond)
+
+	sipSrv.Respond("101YNN20140226    161239AO|AB03010824124004|AQfhol|AJHeavy metal in Baghdad|AA2|CS927.8|\r")
+	d.outgoing <- []byte("RDT1003010824124004:NO:02030000|0\r")
+
+	msg := <-d.incoming
+	if string(msg) != "OK1\r" {
+		t.Fatalf("Checkin: RFID reader didn't get instructed to turn on alarm")
+	}
+
+	// The RFID-unit doesn't respond. Verify that the item is reported with
+	// failed alarm, and that the UI is notified of the timeout.
+	uiMsg := <-uiChan
+	want := UIMsg{Action: "CHECKIN",
+		Item: item{
+			Label:         "Heavy metal in Baghdad",
+			Barcode:       "03010824124004",
+			Date:          "26/02/2014",
+			AlarmOnFailed: true,
+			Transfer:      "fhol",
+			Status:        "Feil: fikk ikke skrudd på alarm.",
+			StatusCode:    msgAlarmOnFailed,
+		}}
+	if uiMsg.Slip == nil || !strings.Contains(uiMsg.Slip.Text, "SENDES TIL fhol") {
+		t.Errorf("Got slip %+v; want transit slip to fhol", uiMsg.Slip)
+	}
+	uiMsg.Slip = nil
+	if !reflect.DeepEqual(uiMsg, want) {
+		t.Errorf("Got %+v; want %+v", uiMsg, want)
+	}
+	uiMsg = <-uiChan
+	want = UIMsg{Action: "CONNECT", RFIDError: true, RFIDTimeout: true,
+		ErrorMessage: "RFID-unit didn't respond in time", ErrorCode: msgRFIDTimeout}
+	if !reflect.DeepEqual(uiMsg, want) {
+		t.Errorf("Got %+v; want %+v", uiMsg, want)
+	}
+
+	// The RFID-unit is recovered with END, then BEG to resume the checkin
+	msg = <-d.incoming
+	if string(msg) != "END\r" {
+		t.Fatalf("Got %q after timeout; want END", msg)
+	}
+	d.outgoing <- []byte("OK\r")
+	msg = <-d.incoming
+	if string(msg) != "BEG\r" {
+		t.Fatalf("Got %q after timeout recovery; want BEG", msg)
+	}
+	d.outgoing <- []byte("OK\r")
+
+	// The failed alarm can be retried as usual
+	err = a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"RETRY-ALARM-ON"}`))
+	if err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	msg = <-d.incoming
+	if string(msg) != "ACT1003010824124004:NO:02030000\r" {
+		t.Fatalf("Got %q; want RETRY-ALARM-ON command", msg)
+	}
+	d.outgoing <- []byte("OK\r")
+	uiMsg = <-uiChan
+	if uiMsg.Item.AlarmOnFailed {
+		t.Errorf("Got %+v; want alarm turned on", uiMsg)
+	}
+
+	if got := status.RFIDTimeouts.Count("UNITWaitForCheckinAlarmOn"); got == 0 {
+		t.Errorf("status.RFIDTimeouts not incremented")
+	}
+}
+
+func TestCheckins(t *testing.T) {
+	// Setup: ->
+
+	uiChan := make(chan UIMsg)
+	sipSrv := newSIPTestServer()
+	defer sipSrv.Close()
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	d := newDummyRFIDReader()
+	defer d.Close()
+
+	time.Sleep(50) // make sure rfidreader has got designated a port and is listening
+
+	hub = newHub(config{
+		HTTPPort:          port(srv.URL),
+		SIPServer:         sipSrv.Addr(),
+		TCPPort:           port(d.addr()),
+		NumSIPConnections: 1,
+	})
+	go hub.run()
+	defer hub.Close()
+
+	a := newDummyUIAgent(uiChan, port(srv.URL))
+	defer a.c.Close()
+
+	// <- end setup
+
+	msg := <-d.incoming
+	if string(msg) != "VER2.00\r" {
+		t.Fatal("RFID-unit didn't get version init command")
+	}
+
+	d.outgoing <- []byte("OK\r")
+
+	// Verify that UI get's CONNECT message
+	uiMsg := <-uiChan
+	want := UIMsg{Action: "CONNECT"}
+	if !reflect.DeepEqual(uiMsg, want) {
+		t.Errorf("Got %+v; want %+v", uiMsg, want)
+		t.Fatal("UI didn't get notified of succesfull rfid connect")
+	}
+
+	// Send "CHECKIN" message from UI and verify that the UI gets notified of
+	// succesfull connect & RFID-unit that gets instructed to starts scanning for tags.
+	err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKIN","Branch":"fmaj"}`))
+	if err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+
+	msg = <-d.incoming
+	if string(msg) != "BEG\r" {
+		t.Fatal("UI -> CHECKIN: RFID-unit didn't get instructed to start scanning")
+	}
+
+	// acknowledge BEG command
+	d.outgoing <- []byte("OK\r")
+
+	// Simulate found book on RFID-unit. Verify that it get's checked in through
+	// SIP, the Alarm turned on, and that UI get's notified of the transaction
+	sipSrv.Respond("101YNN20140226    161239AO|AB03010824124004|AQfhol|AJHeavy metal in Baghdad|CTfbol|AA2|CS927.8|\r")
+	d.outgoing <- []byte("RDT1003010824124004:NO:02030000|0\r")
+
+	msg = <-d.incoming
+	if string(msg) != "OK1\r" {
+		t.Errorf("Checkin: RFID reader didn't get instructed to turn on alarm")
+	}
+	// simulate failed alarm command
+	d.outgoing <- []byte("NOK\r")
+
+	uiMsg = <-uiChan
+	want = UIMsg{Action: "CHECKIN",
+		Item: item{
+			Label:         "Heavy metal in Baghdad",
+			Barcode:       "03010824124004",
+			Date:          "26/02/2014",
+			AlarmOnFailed: true,
+			Transfer:      "fbol",
+			Status:        "Feil: fikk ikke skrudd på alarm.",
+			StatusCode:    msgAlarmOnFailed,
+		}}
+	// A transit slip is made, as the item belongs to another branch
+	if uiMsg.Slip == nil || !strings.Contains(uiMsg.Slip.Text, "SENDES TIL fbol") {
+		t.Errorf("Got slip %+v; want transit slip to fbol", uiMsg.Slip)
+	}
+	uiMsg.Slip = nil
+	if !reflect.DeepEqual(uiMsg, want) {
+		t.Errorf("Got %+v; want %+v", uiMsg, want)
+		t.Fatal("UI didn't get the correct message after checkin")
+	}
+
+	// retry alarm on
+	err = a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"RETRY-ALARM-ON"}`))
+	if err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+
+	msg = <-d.incoming
+	if string(msg) != "ACT1003010824124004:NO:02030000\r" {
+		t.Fatal("UI -> RETRY-ALARM-ON didn't trigger the right RFID command")
+	}
+
+	d.outgoing <- []byte("OK\r")
+
+	uiMsg = <-uiChan
+	want = UIMsg{Action: "CHECKIN",
+		Item: item{
+			Label:   "Heavy metal in Baghdad",
+			Barcode: "03010824124004",
+			Date:    "26/02/2014",
+		}}
+	if !reflect.DeepEqual(uiMsg, want) {
+		t.Errorf("Got %+v; want %+v", uiMsg, want)
+		t.Fatal("UI didn't get the correct message after checkin retry alarm on")
+	}
+
+	// Simulate barcode not in our db
+
+	sipSrv.Respond("100NUY20140128    114702AO|AB1234|CV99|AFItem not checked out|\r")
+	d.outgoing <- []byte("RDT1234:NO:02030000|0\r")
+
+	msg = <-d.incoming
+	if string(msg) != "OK \r" {
+		t.Errorf("Alarm was changed after unsuccessful checkin")
+	}
+
+	d.outgoing <- []byte("OK\r")
+
+	uiMsg = <-uiChan
+	want = UIMsg{Action: "CHECKIN",
+		Item: item{
+			Barcode:           "1234",
+			TransactionFailed: true,
+			Unknown:           true,
+			Status:            "eksemplaret finnes ikke i basen",
+			StatusCode:        msgItemUnknown,
+		}}
+	if !reflect.DeepEqual(uiMsg, want) {
+		t.Errorf("Got %+v; want %+v", uiMsg, want)
+	}
+
+	// Simulate book on RFID-unit, but with missing tags. Verify that UI gets
+	// notified with the books title, along with an error message
+	sipSrv.Respond("1803020120140226    203140AB03010824124004|AO|AJHeavy metal in Baghdad|AQfhol|BGfhol|\r")
+	d.outgoing <- []byte("RDT1003010824124004:NO:02030000|1\r")
+
+	msg = <-d.incoming
+	if string(msg) != "OK \r" {
+		t.Error("Alarm was changed after unsuccessful checkin")
+	}
+	d.outgoing <- []byte("OK\r")
+
+	uiMsg = <-uiChan
+	want = UIMsg{Action: "CHECKIN",
+		Item: item{
+			Label:             "Heavy metal in Baghdad",
+			Barcode:           "03010824124004",
+			TransactionFailed: true,
+		}}
+	if !reflect.DeepEqual(uiMsg, want) {
+		t.Errorf("Got %+v; want %+v", uiMsg, want)
+		t.Fatal("UI didn't get the correct message when item is missing tags")
+	}
+
+	// Verify that the RFID-unit gets END message when the corresponding
+	// websocket connection is closed.
+
+	// TODO I'm closing connection before, is this necessary?
+	// msg = <-d.incoming
+	// if string(msg) != "END\r" {
+	// 	t.Fatal("RFID-unit didn't get END message when UI connection was lost")
+	// }
+
+}
+
+func TestCheckinSlips(t *testing.T) {
+	// setup ->
+
+	uiChan := make(chan UIMsg)
+	sipSrv := newSIPTestServer()
+	defer sipSrv.Close()
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	d := newDummyRFIDReader()
+	defer d.Close()
+
+	// A network printer
+	printer, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer printer.Close()
+	printed := make(chan []byte, 2)
+	go func() {
+		for {
+			conn, err := printer.Accept()
+			if err != nil {
+				return
+			}
+			b, _ := ioutil.ReadAll(conn)
+			conn.Close()
+			printed <- b
+		}
+	}()
+
+	hub = newHub(config{
+		HTTPPort:          port(srv.URL),
+		SIPServer:         sipSrv.Addr(),
+		TCPPort:           port(d.addr()),
+		NumSIPConnections: 1,
+		Units:             map[string]unitConfig{"127.0.0.1": {Printer: printer.Addr().String()}},
+	})
+	go hub.run()
+	defer hub.Close()
+
+	a := newDummyUIAgent(uiChan, port(srv.URL))
+	defer a.c.Close()
+
+	<-d.incoming
+	d.outgoing <- []byte("OK\r")
+	<-uiChan // CONNECT
+
+	err = a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKIN","Branch":"hutl"}`))
+	if err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	<-d.incoming
+	d.outgoing <- []byte("OK\r")
+
+	// <- end setup
+
+	checkin := func(sipResp, tag string) UIMsg {
+		sipSrv.Respond(sipResp)
+		d.outgoing <- []byte("RDT" + tag + ":NO:02030000|0\r")
+		if msg := <-d.incoming; string(msg) != "OK1\r" {
+			t.Fatalf("Got %q; want alarm on", msg)
+		}
+		d.outgoing <- []byte("OK\r")
+		return <-uiChan
+	}
+
+	// Reserved for pickup at another branch
+	uiMsg := checkin("101YNY20140511    092216AOhutl|AB03010013753001|AQhutl|AJHeksenes historie|CTfroa|CY11|CV02|\r", "1003010013753001")
+	if uiMsg.Slip == nil || uiMsg.Slip.Printed {
+		t.Fatalf("Got slip %+v; want hold slip, not yet printed", uiMsg.Slip)
+	}
+	// The slip is sent again when it has been printed
+	slipMsg := <-uiChan
+	if slipMsg.Action != "SLIP" || slipMsg.Item.Barcode != "03010013753001" ||
+		slipMsg.Slip == nil || !slipMsg.Slip.Printed || slipMsg.Slip.Text != uiMsg.Slip.Text {
+		t.Fatalf("Got %+v; want printed hold slip", slipMsg)
+	}
+	for _, want := range []string{"RESERVERT", "Låner: 11", "Hentes på: froa", "Sendes til: froa", "Heksenes historie"} {
+		if !strings.Contains(uiMsg.Slip.Text, want) {
+			t.Errorf("Hold slip %q doesn't contain %q", uiMsg.Slip.Text, want)
+		}
+	}
+	select {
+	case b := <-printed:
+		if !bytes.Equal(b, uiMsg.Slip.ESCPOS) {
+			t.Errorf("Printer got %q; want %q", b, uiMsg.Slip.ESCPOS)
+		}
+	case <-time.After(time.Second):
+		t.Error("Printer didn't get the hold slip")
+	}
+
+	// Reserved for pickup at the current branch
+	uiMsg = checkin("101YNY20140511    092216AOhutl|AB03011063175001|AQhutl|AJCat's cradle|CY12|CV01|\r", "1003011063175001")
+	if uiMsg.Slip == nil || !strings.Contains(uiMsg.Slip.Text, "Hentes på: hutl") ||
+		strings.Contains(uiMsg.Slip.Text, "Sendes til") {
+		t.Errorf("Got slip %+v; want hold slip for pickup at hutl", uiMsg.Slip)
+	}
+	<-printed
+	<-uiChan // SLIP
+
+	// No slip for items belonging to the current branch
+	uiMsg = checkin("101YNN20140511    092216AOhutl|AB03011174511003|AQhutl|AJKrutt-Kim|\r", "1003011174511003")
+	if uiMsg.Slip != nil {
+		t.Errorf("Got slip %+v; want none", uiMsg.Slip)
+	}
+}
+
+func TestCheckouts(t *testing.T) {
+
+	// setup ->
+
+	uiChan := make(chan UIMsg)
+	sipSrv := newSIPTestServer()
+	defer sipSrv.Close()
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	d := newDummyRFIDReader()
+	defer d.Close()
+
+	time.Sleep(50) // make sure rfidreader has got designated a port and is listening
+
+	hub = newHub(config{
+		HTTPPort:          port(srv.URL),
+		SIPServer:         sipSrv.Addr(),
+		TCPPort:           port(d.addr()),
+		NumSIPConnections: 1,
+	})
+	go hub.run()
+	defer hub.Close()
+
+	a := newDummyUIAgent(uiChan, port(srv.URL))
+	defer a.c.Close()
+
+	// <- end setup
+
+	// TESTS /////////////////////////////////////////////////////////////////
+
+	msg := <-d.incoming
+	if string(msg) != "VER2.00\r" {
+		t.Fatal("RFID-unit didn't get version init command")
+	}
+	d.outgoing <- []byte("OK\r")
+
+	uiMsg := <-uiChan
+	want := UIMsg{Action: "CONNECT"}
+	if !reflect.DeepEqual(uiMsg, want) {
+		t.Errorf("Got %+v; want %+v", uiMsg, want)
+		t.Fatal("UI didn't get notified of succesfull rfid connect")
+	}
+
+	// Send "CHECKOUT" message from UI and verify that the UI gets notified of
+	// succesfull connect & RFID-unit that gets instructed to starts scanning for tags.
+	sipSrv.Respond("64              00020140303    110236000000010002000000000000AOHUTL|AA95|AEPer Hansen|BLY|CQY|BV0.00|\r")
+	err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKOUT", "Patron": "95", "Branch":"hutl"}`))
+	if err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+
+	// The patron is checked before scanning starts
+	uiMsg = <-uiChan
+	want = UIMsg{Action: "PATRON-INFO", Patron: "95",
+		PatronInfo: &patron{Name: "Per Hansen", Fines: "0.00", Overdue: 1, Charged: 2}}
+	if !reflect.DeepEqual(uiMsg, want) {
+		t.Errorf("Got %+v; want %+v", uiMsg, want)
+		t.Fatal("UI didn't get patron information when starting checkout")
+	}
+
+	msg = <-d.incoming
+	if string(msg) != "BEG\r" {
+		t.Fatal("UI -> CHECKOUT: RFID-unit didn't get instructed to start scanning")
 	}
 
 	// acknowledge BEG command
@@ -513,64 +1089,202 @@ func TestCheckouts(t *testing.T) {
 			Barcode:           "03011174511003",
 			TransactionFailed: true,
 			Status:            "Item checked out to another patron",
+			StatusCode:        msgSIPMessage,
 		}}
 	if !reflect.DeepEqual(uiMsg, want) {
 		t.Errorf("Got %+v; want %+v", uiMsg, want)
 		t.Fatal("UI didn't get the correct message when item is allready checked out to another patron")
 	}
 
-	// Test successfull checkout
+	// Test successfull checkout
+	sipSrv.Respond("121NNY20140303    110236AOHUTL|AA95|AB03011063175001|AJCat's cradle|AH20140331    235900|\r")
+	d.outgoing <- []byte("RDT1003011063175001:NO:02030000|0\r")
+
+	msg = <-d.incoming
+	if string(msg) != "OK0\r" {
+		t.Errorf("Alarm was not turned off after successful checkout")
+	}
+
+	// simulate failed alarm
+	d.outgoing <- []byte("NOK\r")
+
+	uiMsg = <-uiChan
+	want = UIMsg{Action: "CHECKOUT",
+		Item: item{
+			Label:          "Cat's cradle",
+			Barcode:        "03011063175001",
+			Date:           "03/03/2014",
+			DueDate:        "31/03/2014",
+			AlarmOffFailed: true,
+			Status:         "Feil: fikk ikke skrudd av alarm.",
+			StatusCode:     msgAlarmOffFailed,
+		}}
+	if !reflect.DeepEqual(uiMsg, want) {
+		t.Errorf("Got %+v; want %+v", uiMsg, want)
+		t.Fatal("UI didn't get the correct message after succesfull checkout")
+	}
+
+	// retry alarm off
+	err = a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"RETRY-ALARM-OFF"}`))
+	if err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+
+	msg = <-d.incoming
+	if string(msg) != "DAC1003011063175001:NO:02030000\r" {
+		t.Errorf("Got %q, Want DAC1003011063175001:NO:02030000", msg)
+		t.Fatal("UI -> RETRY-ALARM-ON didn't trigger the right RFID command")
+	}
+
+	d.outgoing <- []byte("OK\r")
+
+	uiMsg = <-uiChan
+	want = UIMsg{Action: "CHECKOUT",
+		Item: item{
+			Label:   "Cat's cradle",
+			Barcode: "03011063175001",
+			Date:    "03/03/2014",
+			DueDate: "31/03/2014",
+		}}
+	if !reflect.DeepEqual(uiMsg, want) {
+		t.Errorf("Got %+v; want %+v", uiMsg, want)
+		t.Fatal("UI didn't get the correct message after succesfull checkout")
+	}
+
+}
+
+func TestCheckoutReceipt(t *testing.T) {
+	// setup ->
+
+	uiChan := make(chan UIMsg)
+	sipSrv := newSIPTestServer()
+	defer sipSrv.Close()
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	d := newDummyRFIDReader()
+	defer d.Close()
+
+	// A network printer, which receives a single printout:
+	printer, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer printer.Close()
+	printed := make(chan []byte, 1)
+	go func() {
+		conn, err := printer.Accept()
+		if err != nil {
+			return
+		}
+		b, _ := ioutil.ReadAll(conn)
+		conn.Close()
+		printed <- b
+	}()
+
+	hub = newHub(config{
+		HTTPPort:          port(srv.URL),
+		SIPServer:         sipSrv.Addr(),
+		TCPPort:           port(d.addr()),
+		NumSIPConnections: 1,
+		Units:             map[string]unitConfig{"127.0.0.1": {Printer: printer.Addr().String()}},
+	})
+	go hub.run()
+	defer hub.Close()
+
+	a := newDummyUIAgent(uiChan, port(srv.URL))
+	defer a.c.Close()
+
+	msg := <-d.incoming
+	d.outgoing <- []byte("OK\r")
+	<-uiChan // CONNECT
+
+	// <- end setup
+
+	// No receipt before anything is checked out
+	err = a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"PRINT-RECEIPT"}`))
+	if err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	uiMsg := <-uiChan
+	want := UIMsg{Action: "RECEIPT", UserError: true, ErrorMessage: "No items checked out",
+		ErrorCode: msgNoCheckouts}
+	if !reflect.DeepEqual(uiMsg, want) {
+		t.Errorf("Got %+v; want %+v", uiMsg, want)
+	}
+
+	sipSrv.Respond("64              00020140303    110236000000010002000000000000AOHUTL|AA95|AEPer Hansen|BLY|CQY|BV0.00|\r")
+	err = a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKOUT", "Patron": "95", "Branch":"hutl"}`))
+	if err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	<-uiChan // PATRON-INFO
+	<-d.incoming
+	d.outgoing <- []byte("OK\r")
+
 	sipSrv.Respond("121NNY20140303    110236AOHUTL|AA95|AB03011063175001|AJCat's cradle|AH20140331    235900|\r")
 	d.outgoing <- []byte("RDT1003011063175001:NO:02030000|0\r")
+	<-d.incoming
+	d.outgoing <- []byte("OK\r")
+	<-uiChan // CHECKOUT
 
-	msg = <-d.incoming
-	if string(msg) != "OK0\r" {
-		t.Errorf("Alarm was not turned off after successful checkout")
-	}
-
-	// simulate failed alarm
-	d.outgoing <- []byte("NOK\r")
-
-	uiMsg = <-uiChan
-	want = UIMsg{Action: "CHECKOUT",
-		Item: item{
-			Label:          "Cat's cradle",
-			Barcode:        "03011063175001",
-			Date:           "03/03/2014",
-			AlarmOffFailed: true,
-			Status:         "Feil: fikk ikke skrudd av alarm.",
-		}}
-	if !reflect.DeepEqual(uiMsg, want) {
-		t.Errorf("Got %+v; want %+v", uiMsg, want)
-		t.Fatal("UI didn't get the correct message after succesfull checkout")
-	}
+	// A failed checkout is not on the receipt
+	sipSrv.Respond("120NUN20140303    102741AOHUTL|AA95|AB03011174511003|AJKrutt-Kim|AH|AFItem checked out to another patron|BLY|\r")
+	d.outgoing <- []byte("RDT1003011174511003:NO:02030000|0\r")
+	<-d.incoming
+	d.outgoing <- []byte("OK\r")
+	<-uiChan // CHECKOUT
 
-	// retry alarm off
-	err = a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"RETRY-ALARM-OFF"}`))
+	// The receipt is sent to the UI and printed when the session ends
+	err = a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"END"}`))
 	if err != nil {
 		t.Fatal("UI failed to send message over websokcet conn")
 	}
+	uiMsg = <-uiChan
+	if uiMsg.Action != "RECEIPT" || uiMsg.Receipt == nil {
+		t.Fatalf("Got %+v after END; want RECEIPT", uiMsg)
+	}
+	if !uiMsg.Receipt.Printed || uiMsg.ErrorMessage != "" {
+		t.Errorf("Receipt not printed: %v", uiMsg.ErrorMessage)
+	}
+	for _, want := range []string{"Per Hansen", "Cat's cradle", "03011063175001", "31/03/2014", "Antall lån: 1"} {
+		if !strings.Contains(uiMsg.Receipt.Text, want) {
+			t.Errorf("Receipt text %q doesn't contain %q", uiMsg.Receipt.Text, want)
+		}
+	}
+	if strings.Contains(uiMsg.Receipt.Text, "Krutt-Kim") {
+		t.Errorf("Receipt text %q contains the failed checkout", uiMsg.Receipt.Text)
+	}
+	if !strings.Contains(uiMsg.Receipt.HTML, "Cat&#39;s cradle") {
+		t.Errorf("Receipt HTML %q doesn't contain the escaped title", uiMsg.Receipt.HTML)
+	}
+	select {
+	case b := <-printed:
+		if !bytes.Equal(b, uiMsg.Receipt.ESCPOS) {
+			t.Errorf("Printer got %q; want %q", b, uiMsg.Receipt.ESCPOS)
+		}
+	case <-time.After(time.Second):
+		t.Error("Printer didn't get the receipt")
+	}
 
 	msg = <-d.incoming
-	if string(msg) != "DAC1003011063175001:NO:02030000\r" {
-		t.Errorf("Got %q, Want DAC1003011063175001:NO:02030000", msg)
-		t.Fatal("UI -> RETRY-ALARM-ON didn't trigger the right RFID command")
+	if string(msg) != "END\r" {
+		t.Fatalf("Got %q; want END", msg)
 	}
-
 	d.outgoing <- []byte("OK\r")
 
+	// The receipt can be reprinted after the session has ended; the printer
+	// is gone, so it is only returned to the UI
+	printer.Close()
+	err = a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"PRINT-RECEIPT"}`))
+	if err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
 	uiMsg = <-uiChan
-	want = UIMsg{Action: "CHECKOUT",
-		Item: item{
-			Label:   "Cat's cradle",
-			Barcode: "03011063175001",
-			Date:    "03/03/2014",
-		}}
-	if !reflect.DeepEqual(uiMsg, want) {
-		t.Errorf("Got %+v; want %+v", uiMsg, want)
-		t.Fatal("UI didn't get the correct message after succesfull checkout")
+	if uiMsg.Receipt == nil || uiMsg.Receipt.Printed || uiMsg.ErrorMessage == "" {
+		t.Errorf("Got %+v; want unprinted receipt with error", uiMsg)
 	}
-
 }
 
 // Test that rereading of items with missing tags doesn't trigger multiple SIP-calls
@@ -635,6 +1349,197 @@ func TestBarcodesSession(t *testing.T) {
 	}
 }
 
+func TestRenewals(t *testing.T) {
+	// setup ->
+
+	uiChan := make(chan UIMsg)
+	sipSrv := newSIPTestServer()
+	defer sipSrv.Close()
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	d := newDummyRFIDReader()
+	defer d.Close()
+
+	hub = newHub(config{
+		HTTPPort:          port(srv.URL),
+		SIPServer:         sipSrv.Addr(),
+		TCPPort:           port(d.addr()),
+		NumSIPConnections: 1,
+	})
+	go hub.run()
+	defer hub.Close()
+
+	a := newDummyUIAgent(uiChan, port(srv.URL))
+	defer a.c.Close()
+
+	// <- end setup
+
+	<-d.incoming // VER2.00
+	d.outgoing <- []byte("OK\r")
+	<-uiChan // CONNECT
+
+	// RENEW without patron is refused
+	err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"RENEW", "Branch":"hutl"}`))
+	if err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	uiMsg := <-uiChan
+	want := UIMsg{Action: "RENEW", UserError: true, ErrorMessage: "Patron not supplied", ErrorCode: msgPatronMissing}
+	if !reflect.DeepEqual(uiMsg, want) {
+		t.Errorf("Got %+v; want %+v", uiMsg, want)
+	}
+
+	err = a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"RENEW", "Patron": "95", "Branch":"hutl"}`))
+	if err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+
+	msg := <-d.incoming
+	if string(msg) != "BEG\r" {
+		t.Fatal("UI -> RENEW: RFID-unit didn't get instructed to start scanning")
+	}
+	d.outgoing <- []byte("OK\r")
+
+	// Simulate book on RFID-unit. Verify that it gets renewed, the alarm is
+	// left unchanged, and the UI gets the new due date.
+	sipSrv.Respond("301YNN20140303    110236AOHUTL|AA95|AB03011063175001|AJCat's cradle|AH20140414    235900|\r")
+	d.outgoing <- []byte("RDT1003011063175001:NO:02030000|0\r")
+
+	msg = <-d.incoming
+	if string(msg) != "OK \r" {
+		t.Errorf("Alarm was changed when renewing")
+	}
+	d.outgoing <- []byte("OK\r")
+
+	uiMsg = <-uiChan
+	want = UIMsg{Action: "RENEW",
+		Item: item{
+			Label:   "Cat's cradle",
+			Barcode: "03011063175001",
+			Date:    "14/04/2014",
+		}}
+	if !reflect.DeepEqual(uiMsg, want) {
+		t.Errorf("Got %+v; want %+v", uiMsg, want)
+	}
+
+	// Renew all the patron's loans
+	sipSrv.RespondSeq(
+		"66100010001"+"20140303    110236AOHUTL|BM03011063175001|BN03011174511003|AFItem has holds|\r",
+		"1802010120140303    110236AB03011063175001|AJCat's cradle|AH20140414    235900|\r",
+	)
+	err = a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"RENEW-ALL", "Patron": "95", "Branch":"hutl"}`))
+	if err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+
+	uiMsg = <-uiChan
+	want = UIMsg{Action: "RENEW-ALL",
+		Item: item{
+			Label:   "Cat's cradle",
+			Barcode: "03011063175001",
+			Date:    "14/04/2014",
+		}}
+	if !reflect.DeepEqual(uiMsg, want) {
+		t.Errorf("Got %+v; want %+v", uiMsg, want)
+	}
+
+	uiMsg = <-uiChan
+	want = UIMsg{Action: "RENEW-ALL",
+		Item: item{
+			Barcode:           "03011174511003",
+			TransactionFailed: true,
+			Status:            "Item has holds",
+			StatusCode:        msgSIPMessage,
+		}}
+	if !reflect.DeepEqual(uiMsg, want) {
+		t.Errorf("Got %+v; want %+v", uiMsg, want)
+	}
+}
+
+func TestPatronInfo(t *testing.T) {
+	// setup ->
+
+	uiChan := make(chan UIMsg)
+	sipSrv := newSIPTestServer()
+	defer sipSrv.Close()
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	d := newDummyRFIDReader()
+	defer d.Close()
+
+	hub = newHub(config{
+		HTTPPort:          port(srv.URL),
+		SIPServer:         sipSrv.Addr(),
+		TCPPort:           port(d.addr()),
+		NumSIPConnections: 1,
+	})
+	go hub.run()
+	defer hub.Close()
+
+	a := newDummyUIAgent(uiChan, port(srv.URL))
+	defer a.c.Close()
+
+	// <- end setup
+
+	<-d.incoming // VER2.00
+	d.outgoing <- []byte("OK\r")
+	<-uiChan // CONNECT
+
+	sipSrv.Respond("64              00020140303    110236000100000003000000000000AOHUTL|AA95|AEPer Hansen|BLY|CQY|\r")
+	err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"PATRON-INFO", "Patron": "95", "Branch":"hutl"}`))
+	if err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	uiMsg := <-uiChan
+	want := UIMsg{Action: "PATRON-INFO", Patron: "95",
+		PatronInfo: &patron{Name: "Per Hansen", Holds: 1, Charged: 3}}
+	if !reflect.DeepEqual(uiMsg, want) {
+		t.Errorf("Got %+v; want %+v", uiMsg, want)
+	}
+
+	// A blocked patron is refused at checkout, and the RFID-unit is not
+	// instructed to start scanning.
+	sipSrv.Respond("64YYYY          00020140303    110236000000050005000000000000AOHUTL|AA95|AEPer Hansen|BLY|CQY|BV250.00|AFPatron has fines|\r")
+	err = a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKOUT", "Patron": "95", "Branch":"hutl"}`))
+	if err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	uiMsg = <-uiChan
+	want = UIMsg{Action: "PATRON-INFO", Patron: "95",
+		PatronInfo: &patron{Name: "Per Hansen", Blocked: true, Status: "Patron has fines", StatusCode: msgSIPMessage,
+			Fines: "250.00", Overdue: 5, Charged: 5}}
+	if !reflect.DeepEqual(uiMsg, want) {
+		t.Errorf("Got %+v; want %+v", uiMsg, want)
+	}
+	uiMsg = <-uiChan
+	want = UIMsg{Action: "CHECKOUT", UserError: true, ErrorMessage: "Patron blocked", ErrorCode: msgPatronBlocked}
+	if !reflect.DeepEqual(uiMsg, want) {
+		t.Errorf("Got %+v; want %+v", uiMsg, want)
+	}
+
+	// The hub is idle, and responds to the next request
+	sipSrv.Respond("64              00020140303    110236000000000000000000000000AOHUTL|AA1234|BLN|\r")
+	err = a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"PATRON-INFO", "Patron": "1234", "Branch":"hutl"}`))
+	if err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	select {
+	case msg := <-d.incoming:
+		t.Errorf("RFID-unit got %q after checkout with blocked patron", msg)
+	case uiMsg = <-uiChan:
+	}
+	want = UIMsg{Action: "PATRON-INFO", Patron: "1234",
+		PatronInfo: &patron{Blocked: true, Status: "låneren finnes ikke i basen",
+			StatusCode: msgPatronUnknown}}
+	if !reflect.DeepEqual(uiMsg, want) {
+		t.Errorf("Got %+v; want %+v", uiMsg, want)
+	}
+}
+
 func TestWriteLogic(t *testing.T) {
 	// setup ->
 
@@ -799,10 +1704,11 @@ func TestWriteLogic(t *testing.T) {
 	uiMsg = <-uiChan
 	want = UIMsg{Action: "WRITE",
 		Item: item{
-			Label:   "Heavy metal in Baghdad",
-			Barcode: "03010824124004",
-			NumTags: 2,
-			Status:  "OK, preget",
+			Label:      "Heavy metal in Baghdad",
+			Barcode:    "03010824124004",
+			NumTags:    2,
+			Status:     "OK, preget",
+			StatusCode: msgWriteOK,
 		}}
 	if !reflect.DeepEqual(uiMsg, want) {
 		t.Errorf("Got %+v; want %+v", uiMsg, want)
@@ -811,6 +1717,70 @@ func TestWriteLogic(t *testing.T) {
 
 }
 
+func TestWriteBranchTagParams(t *testing.T) {
+	// setup ->
+
+	uiChan := make(chan UIMsg)
+	sipSrv := newSIPTestServer()
+	defer sipSrv.Close()
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	d := newDummyRFIDReader()
+	defer d.Close()
+
+	hub = newHub(config{
+		HTTPPort:          port(srv.URL),
+		SIPServer:         sipSrv.Addr(),
+		TCPPort:           port(d.addr()),
+		NumSIPConnections: 1,
+		Branches: map[string]branchConfig{
+			"hutl": {TagParams: tagParams{LibraryNumber: "02030001", CountryCode: "SE"}},
+		},
+	})
+	go hub.run()
+	defer hub.Close()
+
+	a := newDummyUIAgent(uiChan, port(srv.URL))
+	defer a.c.Close()
+
+	// <- end setup
+
+	<-d.incoming
+	d.outgoing <- []byte("OK\r")
+	<-uiChan // CONNECT OK
+
+	err := a.c.WriteMessage(websocket.TextMessage,
+		[]byte(`{"Action":"WRITE", "Branch": "hutl", "Item": {"Barcode": "03010824124004", "NumTags": 1}}`))
+	if err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+
+	msg := <-d.incoming
+	if string(msg) != "SLPLBN|02030001\r" {
+		t.Fatalf("Got %q; want library number configured for branch", msg)
+	}
+	d.outgoing <- []byte("OK\r")
+
+	msg = <-d.incoming
+	if string(msg) != "SLPLBC|SE\r" {
+		t.Fatalf("Got %q; want country code configured for branch", msg)
+	}
+	d.outgoing <- []byte("OK\r")
+
+	msg = <-d.incoming
+	if string(msg) != "SLPDTM|DS24\r" {
+		t.Fatalf("Got %q; want default data model", msg)
+	}
+	d.outgoing <- []byte("NOK\r")
+
+	uiMsg := <-uiChan
+	if !uiMsg.Item.WriteFailed {
+		t.Errorf("Got %+v; want WriteFailed", uiMsg)
+	}
+}
+
 func TestUserErrors(t *testing.T) {
 
 	// setup ->
@@ -853,7 +1823,8 @@ func TestUserErrors(t *testing.T) {
 
 	uiMsg := <-uiChan
 	want := UIMsg{Action: "CONNECT", UserError: true,
-		ErrorMessage: "Failed to parse the JSON request: unexpected end of JSON input"}
+		ErrorMessage: "Failed to parse the JSON request: unexpected end of JSON input",
+		ErrorCode:    msgBadRequest}
 	if !reflect.DeepEqual(uiMsg, want) {
 		t.Errorf("Got %+v; want %+v", uiMsg, want)
 	}
@@ -867,7 +1838,7 @@ func TestUserErrors(t *testing.T) {
 
 	uiMsg = <-uiChan
 	want = UIMsg{Action: "CHECKOUT", UserError: true,
-		ErrorMessage: "Patron not supplied"}
+		ErrorMessage: "Patron not supplied", ErrorCode: msgPatronMissing}
 	if !reflect.DeepEqual(uiMsg, want) {
 		t.Errorf("Got %+v; want %+v", uiMsg, want)
 	}
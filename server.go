@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// certLoader loads the certificate and key of the HTTPS server, and reloads
+// them when the files change, so that renewed certificates are used without
+// restarting the server.
+type certLoader struct {
+	certFile string
+	keyFile  string
+	interval time.Duration // Minimum time between checking the files for changes; 0: never
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time // Latest modification time of the files loaded
+	checked time.Time
+}
+
+// newCertLoader loads the certificate and key from the given files.
+func newCertLoader(certFile, keyFile string, interval time.Duration) (*certLoader, error) {
+	l := &certLoader{certFile: certFile, keyFile: keyFile, interval: interval}
+	modTime, err := l.modified()
+	if err != nil {
+		return nil, err
+	}
+	if err := l.load(modTime); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// modified returns the latest modification time of the certificate and key.
+func (l *certLoader) modified() (time.Time, error) {
+	var t time.Time
+	for _, f := range []string{l.certFile, l.keyFile} {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(t) {
+			t = fi.ModTime()
+		}
+	}
+	return t, nil
+}
+
+func (l *certLoader) load(modTime time.Time) error {
+	cert, err := tls.LoadX509KeyPair(l.certFile, l.keyFile)
+	if err != nil {
+		return err
+	}
+	l.cert = &cert
+	l.modTime = modTime
+	return nil
+}
+
+// GetCertificate returns the current certificate, for use in tls.Config. If
+// the files have changed, they are reloaded; the old certificate is kept if
+// the new one cannot be loaded, eg. while it is being written.
+func (l *certLoader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.interval == 0 || time.Since(l.checked) < l.interval {
+		return l.cert, nil
+	}
+	l.checked = time.Now()
+	modTime, err := l.modified()
+	if err != nil {
+		log.Printf("ERROR: failed to check TLS certificate for changes: %v", err)
+		return l.cert, nil
+	}
+	if !modTime.After(l.modTime) {
+		return l.cert, nil
+	}
+	if err := l.load(modTime); err != nil {
+		log.Printf("ERROR: failed to reload TLS certificate: %v", err)
+		return l.cert, nil
+	}
+	log.Printf("Reloaded TLS certificate %v", l.certFile)
+	return l.cert, nil
+}
+
+// redirectHandler redirects all requests to the same URL with https, at the
+// given port.
+func redirectHandler(httpsPort string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		}
+		u := *r.URL
+		u.Scheme = "https"
+		u.Host = host
+		http.Redirect(w, r, u.String(), http.StatusPermanentRedirect)
+	})
+}
+
+// serve starts the HTTP and websocket server, with TLS if a certificate is
+// configured, and the redirect from plain HTTP if HTTPRedirectPort is given.
+// It only returns if the server fails.
+func serve(cfg config) error {
+	if cfg.HTTPTLSCert == "" {
+		log.Printf("Starting HTTP server, listening at port %v", cfg.HTTPPort)
+		return http.ListenAndServe(":"+cfg.HTTPPort, nil)
+	}
+
+	certs, err := newCertLoader(cfg.HTTPTLSCert, cfg.HTTPTLSKey, cfg.HTTPTLSReload.Duration)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{
+		Addr: ":" + cfg.HTTPPort,
+		TLSConfig: &tls.Config{
+			GetCertificate: certs.GetCertificate,
+			MinVersion:     tls.VersionTLS12,
+		},
+	}
+
+	if cfg.HTTPRedirectPort != "" {
+		log.Printf("Redirecting HTTP at port %v to HTTPS", cfg.HTTPRedirectPort)
+		go func() {
+			err := http.ListenAndServe(":"+cfg.HTTPRedirectPort, redirectHandler(cfg.HTTPPort))
+			log.Printf("ERROR: HTTP redirect server stopped: %v", err)
+		}()
+	}
+
+	log.Printf("Starting HTTPS server, listening at port %v", cfg.HTTPPort)
+	return srv.ListenAndServeTLS("", "")
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestCertReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rfidhub-https")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tmpl := func() *x509.Certificate {
+		return &x509.Certificate{
+			Subject:     pkix.Name{CommonName: "localhost"},
+			DNSNames:    []string{"localhost"},
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}
+	}
+	first := newTestCert(t, tmpl(), nil)
+	certFile, keyFile := first.writePEM(t, dir, "")
+
+	l, err := newCertLoader(certFile, keyFile, time.Nanosecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	current := func() []byte {
+		c, err := l.GetCertificate(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c.Certificate[0]
+	}
+	if !bytes.Equal(current(), first.der) {
+		t.Fatal("GetCertificate didn't return the loaded certificate")
+	}
+
+	// A renewed certificate is loaded when the files change
+	second := newTestCert(t, tmpl(), nil)
+	second.writePEM(t, dir, "")
+	touch := func(d time.Duration) {
+		for _, f := range []string{certFile, keyFile} {
+			if err := os.Chtimes(f, time.Now().Add(d), time.Now().Add(d)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	touch(time.Minute)
+	if !bytes.Equal(current(), second.der) {
+		t.Error("GetCertificate didn't reload the renewed certificate")
+	}
+
+	// A broken certificate is not loaded, and the old one is kept
+	if err := ioutil.WriteFile(keyFile, []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	touch(2 * time.Minute)
+	if !bytes.Equal(current(), second.der) {
+		t.Error("GetCertificate didn't keep the certificate when the new one is broken")
+	}
+}
+
+func TestRedirectHandler(t *testing.T) {
+	tests := []struct {
+		port, url, want string
+	}{
+		{"443", "http://rfidhub.example.org/.status", "https://rfidhub.example.org/.status"},
+		{"8899", "http://rfidhub.example.org:8080/ws?workstation=desk1", "https://rfidhub.example.org:8899/ws?workstation=desk1"},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		redirectHandler(tt.port).ServeHTTP(w, httptest.NewRequest("GET", tt.url, nil))
+		if w.Code != http.StatusPermanentRedirect || w.Header().Get("Location") != tt.want {
+			t.Errorf("GET %v => %d %v; want %d %v", tt.url, w.Code, w.Header().Get("Location"),
+				http.StatusPermanentRedirect, tt.want)
+		}
+	}
+}
+
+func TestSecureWebsocket(t *testing.T) {
+	// Setup: ->
+
+	dir, err := ioutil.TempDir("", "rfidhub-https")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cert := newTestCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "localhost"},
+		DNSNames:    []string{"localhost"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, nil)
+	certFile, keyFile := cert.writePEM(t, dir, "")
+	certs, err := newCertLoader(certFile, keyFile, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uiChan := make(chan UIMsg)
+	sipSrv := newSIPTestServer()
+	defer sipSrv.Close()
+
+	srv := httptest.NewUnstartedServer(nil)
+	srv.TLS = &tls.Config{GetCertificate: certs.GetCertificate}
+	srv.StartTLS()
+	defer srv.Close()
+
+	hub = newHub(config{
+		HTTPPort:          port(srv.URL),
+		SIPServer:         sipSrv.Addr(),
+		TCPPort:           "12346", // not listening
+		NumSIPConnections: 1,
+	})
+	go hub.run()
+	defer hub.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert.cert)
+	dialer := websocket.Dialer{TLSClientConfig: &tls.Config{RootCAs: roots}}
+	ws, _, err := dialer.Dial(fmt.Sprintf("wss://localhost:%s/ws", port(srv.URL)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &dummyUIAgent{c: ws, msg: uiChan}
+	go a.run()
+	defer a.c.Close()
+
+	// <- end setup
+
+	uiMsg := <-uiChan
+	want := UIMsg{Action: "CONNECT", RFIDError: true, ErrorCode: msgRFIDError}
+	if !reflect.DeepEqual(uiMsg, want) {
+		t.Errorf("Got %+v; want %+v", uiMsg, want)
+	}
+}
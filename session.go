@@ -0,0 +1,163 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// session is the state of the UI of a workstation: the current mode and
+// patron, and the items processed so far, so that it can be restored with
+// RESUME when the page is reloaded. It outlives the UI connection, until it
+// expires.
+//
+// A nil *session is a disabled session, which records nothing.
+type session struct {
+	mu      sync.Mutex
+	mode    string // CHECKIN/CHECKOUT/RENEW/RENEW-ALL; empty after END
+	patron  string
+	branch  string
+	items   []UIMsg // in the order they were processed
+	updated time.Time
+}
+
+// sessionModes are the actions which start a new mode in the UI.
+var sessionModes = map[string]bool{
+	"CHECKIN":   true,
+	"CHECKOUT":  true,
+	"RENEW":     true,
+	"RENEW-ALL": true,
+}
+
+// start records a request from the UI. A request which starts another mode,
+// or the same mode for another patron, clears the items of the session.
+func (s *session) start(m UIMsg) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.updated = time.Now()
+	switch {
+	case m.Action == "END":
+		s.mode = ""
+	case sessionModes[m.Action]:
+		if m.Action != s.mode || m.Patron != s.patron {
+			s.items = nil
+		}
+		s.mode = m.Action
+		s.patron = m.Patron
+		s.branch = m.Branch
+	}
+}
+
+// clear ends the session, and forgets its patron, branch and items.
+func (s *session) clear() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.updated = time.Now()
+	s.mode, s.patron, s.branch = "", "", ""
+	s.items = nil
+}
+
+// record adds an item sent to the UI to the session, replacing an earlier
+// message about the same item, eg. when the alarm is retried.
+func (s *session) record(m UIMsg) {
+	if s == nil || !sessionModes[m.Action] || m.Item.Barcode == "" || m.UserError {
+		return
+	}
+	// Receipts and slips are not replayed, so that they are not printed again:
+	m.Receipt, m.Slip = nil, nil
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.updated = time.Now()
+	for i, prev := range s.items {
+		if prev.Action == m.Action && prev.Item.Barcode == m.Item.Barcode {
+			s.items[i] = m
+			return
+		}
+	}
+	s.items = append(s.items, m)
+}
+
+// replay returns the items of the session, followed by a RESUME message
+// with the current mode, patron and branch.
+func (s *session) replay() []UIMsg {
+	if s == nil {
+		return []UIMsg{{Action: "RESUME"}}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	msgs := make([]UIMsg, len(s.items), len(s.items)+1)
+	copy(msgs, s.items)
+	return append(msgs, UIMsg{Action: "RESUME", Mode: s.mode, Patron: s.patron, Branch: s.branch})
+}
+
+// resumed returns the branch and items of the session, if it is in the given
+// mode for the given patron, so that the RFID-unit can continue where it left
+// off when the page was reloaded.
+func (s *session) resumed(mode, patron string) (branch string, items []UIMsg, ok bool) {
+	if s == nil {
+		return "", nil, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.mode != mode || s.patron != patron {
+		return "", nil, false
+	}
+	items = make([]UIMsg, len(s.items))
+	copy(items, s.items)
+	return s.branch, items, true
+}
+
+func (s *session) expired(expiry time.Duration, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return now.Sub(s.updated) > expiry
+}
+
+// sessionStore holds the sessions of the workstations, keyed by workstation
+// identifier. Sessions not used for longer than expiry are discarded.
+//
+// A nil *sessionStore is a disabled store, where get returns nil sessions.
+type sessionStore struct {
+	expiry time.Duration
+
+	mu       sync.Mutex
+	sessions map[string]*session
+}
+
+// newSessionStore returns a session store with the given expiry, or nil if
+// expiry is 0.
+func newSessionStore(expiry time.Duration) *sessionStore {
+	if expiry <= 0 {
+		return nil
+	}
+	return &sessionStore{expiry: expiry, sessions: make(map[string]*session)}
+}
+
+// get returns the session of the workstation, starting a new one if there is
+// none, or it has expired. Expired sessions of other workstations are
+// discarded.
+func (st *sessionStore) get(workstation string) *session {
+	if st == nil {
+		return nil
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	now := time.Now()
+	for ws, s := range st.sessions {
+		if s.expired(st.expiry, now) {
+			delete(st.sessions, ws)
+		}
+	}
+	s, ok := st.sessions[workstation]
+	if !ok {
+		s = &session{updated: now}
+		st.sessions[workstation] = s
+	}
+	return s
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestSession(t *testing.T) {
+	st := newSessionStore(time.Minute)
+	s := st.get("desk1")
+
+	s.start(UIMsg{Action: "CHECKOUT", Patron: "95", Branch: "hutl"})
+	s.record(UIMsg{Action: "CHECKOUT", Item: item{Barcode: "1", AlarmOffFailed: true}})
+	s.record(UIMsg{Action: "CHECKOUT", Item: item{Barcode: "2"}})
+	s.record(UIMsg{Action: "CHECKOUT", UserError: true, ErrorMessage: "Patron not supplied"})
+	s.record(UIMsg{Action: "PATRON-INFO", Patron: "95"})
+	// Retrying the alarm replaces the item:
+	s.record(UIMsg{Action: "CHECKOUT", Item: item{Barcode: "1"}, Receipt: &printout{}})
+
+	want := []UIMsg{
+		{Action: "CHECKOUT", Item: item{Barcode: "1"}},
+		{Action: "CHECKOUT", Item: item{Barcode: "2"}},
+		{Action: "RESUME", Mode: "CHECKOUT", Patron: "95", Branch: "hutl"},
+	}
+	if got := st.get("desk1").replay(); !reflect.DeepEqual(got, want) {
+		t.Errorf("replay() => %+v; want %+v", got, want)
+	}
+
+	// The items are kept after END, but not when the next patron checks out
+	s.start(UIMsg{Action: "END"})
+	if got := s.replay(); len(got) != 3 || got[2].Mode != "" {
+		t.Errorf("replay() after END => %+v; want 2 items, and no mode", got)
+	}
+	s.start(UIMsg{Action: "CHECKOUT", Patron: "96", Branch: "hutl"})
+	if got := s.replay(); len(got) != 1 || got[0].Patron != "96" {
+		t.Errorf("replay() after new CHECKOUT => %+v; want no items", got)
+	}
+
+	// Clearing forgets the patron and items
+	s.record(UIMsg{Action: "CHECKOUT", Item: item{Barcode: "3"}})
+	s.clear()
+	if got, want := s.replay(), []UIMsg{{Action: "RESUME"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("replay() after clear => %+v; want %+v", got, want)
+	}
+
+	// Sessions of other workstations are separate, and expire
+	if st.get("desk2") == s {
+		t.Error("get(desk2) returned the session of desk1")
+	}
+	s.updated = time.Now().Add(-2 * time.Minute)
+	if st.get("desk1") == s {
+		t.Error("get(desk1) returned an expired session")
+	}
+
+	// Disabled sessions record nothing
+	var disabled *sessionStore
+	s = disabled.get("desk1")
+	s.start(UIMsg{Action: "CHECKIN"})
+	s.record(UIMsg{Action: "CHECKIN", Item: item{Barcode: "1"}})
+	if got, want := s.replay(), []UIMsg{{Action: "RESUME"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("replay() of disabled session => %+v; want %+v", got, want)
+	}
+}
+
+func TestResume(t *testing.T) {
+	// Setup: ->
+
+	uiChan := make(chan UIMsg)
+	sipSrv := newSIPTestServer()
+	defer sipSrv.Close()
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	d := newDummyRFIDReader()
+	defer d.Close()
+
+	hub = newHub(config{
+		HTTPPort:          port(srv.URL),
+		SIPServer:         sipSrv.Addr(),
+		TCPPort:           port(d.addr()),
+		NumSIPConnections: 1,
+		SessionExpiry:     duration{time.Minute},
+	})
+	go hub.run()
+	defer hub.Close()
+
+	url := fmt.Sprintf("ws://localhost:%s/ws?workstation=desk1", port(srv.URL))
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &dummyUIAgent{c: ws, msg: uiChan}
+	go a.run()
+
+	// <- end setup
+
+	<-d.incoming
+	d.outgoing <- []byte("OK\r")
+	<-uiChan // CONNECT
+
+	err = a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKIN","Branch":"hutl"}`))
+	if err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	<-d.incoming // BEG
+	d.outgoing <- []byte("OK\r")
+
+	sipSrv.Respond("101YNN20140226    161239AO|AB03010824124004|AQhutl|AJHeavy metal in Baghdad|AA2|CS927.8|\r")
+	d.outgoing <- []byte("RDT1003010824124004:NO:02030000|0\r")
+	<-d.incoming // OK1
+	d.outgoing <- []byte("OK\r")
+	checkedIn := <-uiChan
+
+	// The page is reloaded
+	a.c.Close()
+	ws, _, err = websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a = &dummyUIAgent{c: ws, msg: uiChan}
+	go a.run()
+	defer a.c.Close()
+
+	err = a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"RESUME"}`))
+	if err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	var got []UIMsg
+	for len(got) < 2 {
+		// Skip notifications about the RFID-unit, which is not reconnected:
+		if msg := <-uiChan; msg.Action != "CONNECT" {
+			got = append(got, msg)
+		}
+	}
+	want := []UIMsg{
+		checkedIn,
+		{Action: "RESUME", Mode: "CHECKIN", Branch: "hutl"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %+v; want %+v", got, want)
+	}
+}
+
+// Test that a checkout which is refused leaves an ongoing checkin, and its
+// session, as they were.
+func TestRefusedCheckout(t *testing.T) {
+	// Setup: ->
+
+	uiChan := make(chan UIMsg)
+	sipSrv := newSIPTestServer()
+	defer sipSrv.Close()
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	d := newDummyRFIDReader()
+	defer d.Close()
+
+	hub = newHub(config{
+		HTTPPort:          port(srv.URL),
+		SIPServer:         sipSrv.Addr(),
+		TCPPort:           port(d.addr()),
+		NumSIPConnections: 1,
+		SessionExpiry:     duration{time.Minute},
+	})
+	go hub.run()
+	defer hub.Close()
+
+	a := newDummyUIAgent(uiChan, port(srv.URL))
+	defer a.c.Close()
+
+	// <- end setup
+
+	<-d.incoming
+	d.outgoing <- []byte("OK\r")
+	<-uiChan // CONNECT
+
+	err := a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKIN","Branch":"hutl"}`))
+	if err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	<-d.incoming // BEG
+	d.outgoing <- []byte("OK\r")
+
+	for _, test := range []struct {
+		req     string
+		blocked bool
+		want    UIMsg
+	}{
+		{
+			`{"Action":"CHECKOUT","Branch":"hutl"}`,
+			false,
+			UIMsg{Action: "CHECKOUT", UserError: true, ErrorMessage: "Patron not supplied", ErrorCode: msgPatronMissing},
+		},
+		{
+			`{"Action":"CHECKOUT","Patron":"95","Branch":"hutl"}`,
+			true,
+			UIMsg{Action: "CHECKOUT", UserError: true, ErrorMessage: "Patron blocked", ErrorCode: msgPatronBlocked},
+		},
+	} {
+		sipSrv.Respond("64YYYY          00020140303    110236000000050005000000000000AOHUTL|AA95|AEPer Hansen|BLY|CQY|BV250.00|AFPatron has fines|\r")
+		if err := a.c.WriteMessage(websocket.TextMessage, []byte(test.req)); err != nil {
+			t.Fatal("UI failed to send message over websokcet conn")
+		}
+		if test.blocked {
+			if msg := <-uiChan; msg.PatronInfo == nil || !msg.PatronInfo.Blocked {
+				t.Errorf("Got %+v after %s; want blocked patron info", msg, test.req)
+			}
+		}
+		if msg := <-uiChan; !reflect.DeepEqual(msg, test.want) {
+			t.Errorf("Got %+v after %s; want %+v", msg, test.req, test.want)
+		}
+	}
+
+	// The RFID-unit is still checking in
+	sipSrv.Respond("101YNN20140226    161239AO|AB03010824124004|AQhutl|AJHeavy metal in Baghdad|AA2|CS927.8|\r")
+	d.outgoing <- []byte("RDT1003010824124004:NO:02030000|0\r")
+	select {
+	case msg := <-d.incoming:
+		if string(msg) != "OK1\r" {
+			t.Fatalf("RFID-unit got %q; want alarm on", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Tag read not handled after refused checkout")
+	}
+	d.outgoing <- []byte("OK\r")
+	checkedIn := <-uiChan
+	if checkedIn.Action != "CHECKIN" || checkedIn.Item.Barcode != "03010824124004" {
+		t.Fatalf("Got %+v; want CHECKIN", checkedIn)
+	}
+
+	err = a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"RESUME"}`))
+	if err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	got := []UIMsg{<-uiChan, <-uiChan}
+	want := []UIMsg{
+		checkedIn,
+		{Action: "RESUME", Mode: "CHECKIN", Branch: "hutl"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %+v; want %+v", got, want)
+	}
+}
+
+// Test that requests are answered with an error, and the session left as it
+// was, while the RFID-unit is not connected.
+func TestRequestWithoutRFIDUnit(t *testing.T) {
+	// Setup: ->
+
+	uiChan := make(chan UIMsg)
+	sipSrv := newSIPTestServer()
+	defer sipSrv.Close()
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	// No RFID-unit listens on the port:
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+
+	hub = newHub(config{
+		HTTPPort:          port(srv.URL),
+		SIPServer:         sipSrv.Addr(),
+		TCPPort:           port(l.Addr().String()),
+		RFIDReconnectMin:  duration{time.Minute},
+		RFIDReconnectMax:  duration{time.Minute},
+		NumSIPConnections: 1,
+		SessionExpiry:     duration{time.Minute},
+	})
+	go hub.run()
+	defer hub.Close()
+
+	// A session from before the page was reloaded:
+	checkedIn := UIMsg{Action: "CHECKIN", Item: item{Barcode: "03010824124004", Label: "Heavy metal in Baghdad"}}
+	s := hub.sessions.get("127.0.0.1")
+	s.start(UIMsg{Action: "CHECKIN", Branch: "hutl"})
+	s.record(checkedIn)
+
+	a := newDummyUIAgent(uiChan, port(srv.URL))
+	defer a.c.Close()
+
+	// <- end setup
+
+	want := UIMsg{Action: "CONNECT", RFIDError: true, ErrorCode: msgRFIDError}
+	if got := <-uiChan; !reflect.DeepEqual(got, want) {
+		t.Fatalf("Got %+v; want %+v", got, want)
+	}
+
+	err = a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKOUT","Patron":"95","Branch":"hutl"}`))
+	if err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	select {
+	case got := <-uiChan:
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Got %+v after CHECKOUT; want %+v", got, want)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("CHECKOUT without RFID-unit not answered")
+	}
+
+	err = a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"RESUME"}`))
+	if err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	got := []UIMsg{<-uiChan, <-uiChan}
+	wantResumed := []UIMsg{
+		checkedIn,
+		{Action: "RESUME", Mode: "CHECKIN", Branch: "hutl"},
+	}
+	if !reflect.DeepEqual(got, wantResumed) {
+		t.Errorf("Got %+v; want %+v", got, wantResumed)
+	}
+	if reqs := sipSrv.Requests(); len(reqs) != 0 {
+		t.Errorf("SIP-server got %q; want no requests", reqs)
+	}
+}
+
+// Test that items checked out before the page was reloaded are not checked
+// out again when the UI continues the session, and are on the receipt.
+func TestResumeCheckout(t *testing.T) {
+	// Setup: ->
+
+	uiChan := make(chan UIMsg)
+	sipSrv := newSIPTestServer()
+	defer sipSrv.Close()
+
+	srv := httptest.NewServer(nil)
+	defer srv.Close()
+
+	d := newDummyRFIDReader()
+	defer d.Close()
+
+	hub = newHub(config{
+		HTTPPort:          port(srv.URL),
+		SIPServer:         sipSrv.Addr(),
+		TCPPort:           port(d.addr()),
+		NumSIPConnections: 1,
+		SessionExpiry:     duration{time.Minute},
+	})
+	go hub.run()
+	defer hub.Close()
+
+	// The session before the page was reloaded:
+	checkedOut := UIMsg{Action: "CHECKOUT",
+		Item: item{
+			Label:   "Cat's cradle",
+			Barcode: "03011063175001",
+			Date:    "03/03/2014",
+			DueDate: "31/03/2014",
+		}}
+	s := hub.sessions.get("desk1")
+	s.start(UIMsg{Action: "CHECKOUT", Patron: "95", Branch: "hutl"})
+	s.record(checkedOut)
+
+	url := fmt.Sprintf("ws://localhost:%s/ws?workstation=desk1", port(srv.URL))
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &dummyUIAgent{c: ws, msg: uiChan}
+	go a.run()
+	defer a.c.Close()
+
+	// <- end setup
+
+	<-d.incoming
+	d.outgoing <- []byte("OK\r")
+	<-uiChan // CONNECT
+
+	sipSrv.RespondSeq("64              00020140303    110236000000010002000000000000AOHUTL|AA95|AEPer Hansen|BLY|CQY|BV0.00|\r")
+	// A new checkout would be a renewal:
+	sipSrv.Respond("121NNY20140303    110236AOHUTL|AA95|AB03011063175001|AJCat's cradle|AH20140414    235900|\r")
+	err = a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"CHECKOUT", "Patron": "95", "Branch":"hutl"}`))
+	if err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	<-uiChan     // PATRON-INFO
+	<-d.incoming // BEG
+	d.outgoing <- []byte("OK\r")
+
+	// The item still on the RFID-unit only gets its alarm turned off
+	d.outgoing <- []byte("RDT1003011063175001:NO:02030000|0\r")
+	if msg := <-d.incoming; string(msg) != "OK0\r" {
+		t.Errorf("RFID-unit got %q; want OK0", msg)
+	}
+	d.outgoing <- []byte("OK\r")
+	if msg := <-uiChan; !reflect.DeepEqual(msg, checkedOut) {
+		t.Errorf("Got %+v; want %+v", msg, checkedOut)
+	}
+
+	err = a.c.WriteMessage(websocket.TextMessage, []byte(`{"Action":"END"}`))
+	if err != nil {
+		t.Fatal("UI failed to send message over websokcet conn")
+	}
+	msg := <-uiChan
+	if msg.Action != "RECEIPT" || msg.Receipt == nil {
+		t.Fatalf("Got %+v after END; want RECEIPT", msg)
+	}
+	for _, want := range []string{"Cat's cradle", "03011063175001", "Antall lån: 1"} {
+		if !strings.Contains(msg.Receipt.Text, want) {
+			t.Errorf("Receipt text %q doesn't contain %q", msg.Receipt.Text, want)
+		}
+	}
+	<-d.incoming // END
+	d.outgoing <- []byte("OK\r")
+
+	for _, req := range sipSrv.Requests() {
+		if strings.HasPrefix(req, "11") {
+			t.Errorf("SIP-server got checkout %q of item allready checked out", req)
+		}
+	}
+}
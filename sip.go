@@ -1,12 +1,15 @@
 package main
 
 import (
-	"bufio"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
+	"strconv"
 	"strings"
 	"time"
 
@@ -38,6 +41,21 @@ func sipFormMsgCheckin(dept, barcode string) sip.Message {
 	)
 }
 
+// sipFormMsgOfflineCheckin returns a checkin request for an item which was
+// checked in at the given time, while the SIP-server was unavailable.
+func sipFormMsgOfflineCheckin(dept, barcode string, t time.Time) sip.Message {
+	date := t.Format(sip.DateLayout)
+	return sip.NewMessage(sip.MsgReqCheckin).AddField(
+		sip.Field{Type: sip.FieldNoBlock, Value: "Y"},
+		sip.Field{Type: sip.FieldTransactionDate, Value: date},
+		sip.Field{Type: sip.FieldReturnDate, Value: date},
+		sip.Field{Type: sip.FieldCurrentLocation, Value: dept},
+		sip.Field{Type: sip.FieldInstitutionID, Value: dept},
+		sip.Field{Type: sip.FieldItemIdentifier, Value: barcode},
+		sip.Field{Type: sip.FieldTerminalPassword, Value: ""},
+	)
+}
+
 func sipFormMsgCheckout(dept, username, barcode string) sip.Message {
 	now := time.Now().Format(sip.DateLayout)
 	return sip.NewMessage(sip.MsgReqCheckout).AddField(
@@ -52,6 +70,49 @@ func sipFormMsgCheckout(dept, username, barcode string) sip.Message {
 	)
 }
 
+func sipFormMsgRenew(dept, username, barcode string) sip.Message {
+	now := time.Now().Format(sip.DateLayout)
+	return sip.NewMessage(sip.MsgReqRenew).AddField(
+		sip.Field{Type: sip.FieldThirdPartyAllowed, Value: "N"},
+		sip.Field{Type: sip.FieldNoBlock, Value: "N"},
+		sip.Field{Type: sip.FieldTransactionDate, Value: now},
+		sip.Field{Type: sip.FieldNbDueDate, Value: now},
+		sip.Field{Type: sip.FieldInstitutionID, Value: dept},
+		sip.Field{Type: sip.FieldPatronIdentifier, Value: username},
+		sip.Field{Type: sip.FieldItemIdentifier, Value: barcode},
+		sip.Field{Type: sip.FieldTerminalPassword, Value: ""},
+	)
+}
+
+func sipFormMsgRenewAll(dept, username string) sip.Message {
+	return sip.NewMessage(sip.MsgReqRenewAll).AddField(
+		sip.Field{Type: sip.FieldTransactionDate, Value: time.Now().Format(sip.DateLayout)},
+		sip.Field{Type: sip.FieldInstitutionID, Value: dept},
+		sip.Field{Type: sip.FieldPatronIdentifier, Value: username},
+		sip.Field{Type: sip.FieldTerminalPassword, Value: ""},
+	)
+}
+
+func sipFormMsgPatronInfo(dept, username string) sip.Message {
+	return sip.NewMessage(sip.MsgReqPatronInformation).AddField(
+		sip.Field{Type: sip.FieldLanguage, Value: "000"},
+		sip.Field{Type: sip.FieldTransactionDate, Value: time.Now().Format(sip.DateLayout)},
+		sip.Field{Type: sip.FieldSummary, Value: "          "},
+		sip.Field{Type: sip.FieldInstitutionID, Value: dept},
+		sip.Field{Type: sip.FieldPatronIdentifier, Value: username},
+		sip.Field{Type: sip.FieldTerminalPassword, Value: ""},
+		sip.Field{Type: sip.FieldPatronPassword, Value: ""},
+	)
+}
+
+func sipFormMsgSCStatus() sip.Message {
+	return sip.NewMessage(sip.MsgReqStatus).AddField(
+		sip.Field{Type: sip.FieldStatusCode, Value: "0"},
+		sip.Field{Type: sip.FieldMaxPrintWidth, Value: "000"},
+		sip.Field{Type: sip.FieldProtocolVersion, Value: "2.00"},
+	)
+}
+
 func sipFormMsgItemStatus(barcode string) sip.Message {
 	return sip.NewMessage(sip.MsgReqItemInformation).AddField(
 		sip.Field{Type: sip.FieldTransactionDate, Value: time.Now().Format(sip.DateLayout)},
@@ -67,16 +128,50 @@ type parserFunc func(sip.Message) UIMsg
 
 // DoSIPCall performs a SIP request using a SIP TCP-connection from a pool. It
 // takes a SIP message as a string and a parser function to transform the SIP
-// response into a UIMsg.
+// response into a UIMsg. It fails fast with errSIPUnavailable while the
+// circuit breaker is open.
 func DoSIPCall(p pool.Pool, msg sip.Message, parser parserFunc) (UIMsg, error) {
+	if err := breaker.Allow(); err != nil {
+		return UIMsg{}, err
+	}
+	resp, err := sipRequest(p, msg)
+	breaker.Done(err)
+	if err != nil {
+		return UIMsg{}, err
+	}
+
+	// 3. Parse the response
+	respMsg, err := sip.Decode(resp)
+	if err != nil {
+		return UIMsg{}, err
+	}
+
+	res := parser(respMsg)
+
+	return res, nil
+}
+
+// sipRequest sends a SIP request using a SIP TCP-connection from a pool, and
+// returns the raw response.
+func sipRequest(p pool.Pool, msg sip.Message) ([]byte, error) {
+	// Record duration, labeled with the message type (first 2 characters)
+	start := time.Now()
+	defer func() {
+		status.SIPRequests.Observe(msg.String()[:2], time.Since(start))
+	}()
+
 	// 0. Get connection from pool
 	conn, err := p.Get()
 	if err != nil {
-		return UIMsg{}, err
+		return nil, sipConnError{err}
 	}
+	status.SIPConnsInUse.Inc(1)
+	defer status.SIPConnsInUse.Dec(1)
+	touch(conn)
+	seq := nextSeq(conn)
 
 	// 1. Send the SIP request
-	if err = msg.Encode(conn); err != nil {
+	if err = encodeSIP(conn, msg, seq); err != nil {
 		if err == io.EOF {
 			// Koha's SIP server periodically disconnects clients, so we
 			// try to obtain a new connection and retries the send once:
@@ -84,15 +179,17 @@ func DoSIPCall(p pool.Pool, msg sip.Message, parser parserFunc) (UIMsg, error) {
 			conn.Close()
 			conn, err = p.Get()
 			if err != nil {
-				return UIMsg{}, err
+				return nil, sipConnError{err}
 			}
-			if err = msg.Encode(conn); err == nil {
+			touch(conn)
+			seq = nextSeq(conn)
+			if err = encodeSIP(conn, msg, seq); err == nil {
 				goto msgSentOK
 			}
 		}
 		conn.(*pool.PoolConn).MarkUnusable()
 		conn.Close()
-		return UIMsg{}, err
+		return nil, err
 	}
 msgSentOK:
 
@@ -100,37 +197,54 @@ msgSentOK:
 
 	// 2. Read SIP response
 
-	reader := bufio.NewReader(conn)
-	resp, err := reader.ReadBytes('\r')
+	resp, err := readSIP(conn, seq)
 	if err != nil {
 		conn.(*pool.PoolConn).MarkUnusable()
 		conn.Close()
-		return UIMsg{}, err
+		if isTimeout(err) {
+			status.SIPTimeouts.Inc(1)
+			return nil, errSIPTimeout
+		}
+		return nil, err
 	}
 	conn.Close()
 
 	log.Printf("<- %v", strings.TrimSpace(string(resp)))
 
-	// 3. Parse the response
-	respMsg, err := sip.Decode(resp)
+	return resp, nil
+}
+
+// sipProbe checks that the SIP-server is online, using a SC Status request.
+// It bypasses the circuit breaker, and is used by it to decide when to let
+// requests through again.
+func sipProbe(p pool.Pool) error {
+	resp, err := sipRequest(p, sipFormMsgSCStatus())
 	if err != nil {
-		return UIMsg{}, err
+		return err
 	}
-
-	res := parser(respMsg)
-
-	return res, nil
+	msg, err := sip.Decode(resp)
+	if err != nil {
+		return err
+	}
+	if msg.Field(sip.FieldOnlineStatus) != "Y" {
+		return errors.New("SIP-server is offline")
+	}
+	return nil
 }
 
 func checkinParse(msg sip.Message) UIMsg {
 	var (
 		fail       bool
 		status     string
+		code       string
 		unknown    bool
 		date       string
 		hold       bool
 		borrowernr string
 		biblionr   string
+		holdOther  bool
+		holdPatron string
+		transit    bool
 	)
 
 	if msg.Field(sip.FieldOK) == "1" {
@@ -139,6 +253,7 @@ func checkinParse(msg sip.Message) UIMsg {
 	} else {
 		fail = true
 		status = msg.Field(sip.FieldScreenMessage)
+		code = screenMessageCode(status)
 	}
 
 	switch msg.Field(sip.FieldAlertType) {
@@ -146,13 +261,17 @@ func checkinParse(msg sip.Message) UIMsg {
 		hold = true
 		borrowernr = msg.Field(sip.FieldHoldPatronIdentifier)
 		biblionr = msg.Field(sip.FieldSequenceNumber)
+		holdPatron = borrowernr
 	case "02": // reserved (on other branch)
-		// TODO?
+		holdOther = true
+		holdPatron = msg.Field(sip.FieldHoldPatronIdentifier)
+		transit = true
 	case "04": // send to other branch
-		// TODO?
+		transit = true
 	case "99": // other: bad barcode / withdrawn
 		unknown = true
-		status = "eksemplaret finnes ikke i basen"
+		code = msgItemUnknown
+		status = localize(defaultLanguage, code)
 	}
 
 	// Transfer either to holding branch or home branch
@@ -163,10 +282,23 @@ func checkinParse(msg sip.Message) UIMsg {
 		}
 	}
 
+	var pickup, transitTo string
+	if holdOther {
+		pickup = msg.Field(sip.FieldDestinationLocation)
+	}
+	if transit {
+		transitTo = branch
+	}
+
 	return UIMsg{
 		Action: "CHECKIN",
 		Item: item{
 			Hold:              hold,
+			HoldOtherBranch:   holdOther,
+			PickupBranch:      pickup,
+			HoldPatron:        holdPatron,
+			Transit:           transit,
+			TransitTo:         transitTo,
 			Transfer:          branch,
 			Unknown:           unknown,
 			TransactionFailed: fail,
@@ -174,6 +306,7 @@ func checkinParse(msg sip.Message) UIMsg {
 			Date:              date,
 			Label:             msg.Field(sip.FieldTitleIdentifier),
 			Status:            status,
+			StatusCode:        code,
 			Biblionr:          biblionr,
 			Borrowernr:        borrowernr,
 		},
@@ -185,11 +318,13 @@ func checkoutParse(msg sip.Message) UIMsg {
 		fail    bool
 		unknown bool
 		date    string
+		due     string
 	)
 
 	if msg.Field(sip.FieldOK) == "1" {
 		// We only want to display date if checkout was successfull
 		date = formatDate(msg.Field(sip.FieldTransactionDate))
+		due = formatDate(msg.Field(sip.FieldDueDate))
 	} else {
 		fail = true
 	}
@@ -205,21 +340,122 @@ func checkoutParse(msg sip.Message) UIMsg {
 			TransactionFailed: fail,
 			Barcode:           msg.Field(sip.FieldItemIdentifier),
 			Date:              date,
+			DueDate:           due,
 			Status:            msg.Field(sip.FieldScreenMessage),
+			StatusCode:        screenMessageCode(msg.Field(sip.FieldScreenMessage)),
 			Label:             msg.Field(sip.FieldTitleIdentifier),
 		},
 	}
 }
 
+func renewParse(msg sip.Message) UIMsg {
+	var (
+		fail    bool
+		unknown bool
+		date    string
+	)
+
+	if msg.Field(sip.FieldOK) == "1" {
+		date = formatDate(msg.Field(sip.FieldDueDate))
+	} else {
+		fail = true
+	}
+
+	if msg.Field(sip.FieldTitleIdentifier) == "" {
+		unknown = true
+	}
+
+	return UIMsg{
+		Action: "RENEW",
+		Item: item{
+			Unknown:           unknown,
+			TransactionFailed: fail,
+			Barcode:           msg.Field(sip.FieldItemIdentifier),
+			Date:              date,
+			Status:            msg.Field(sip.FieldScreenMessage),
+			StatusCode:        screenMessageCode(msg.Field(sip.FieldScreenMessage)),
+			Label:             msg.Field(sip.FieldTitleIdentifier),
+		},
+	}
+}
+
+// renewAllResult is the outcome of a Renew All request.
+type renewAllResult struct {
+	OK        bool
+	Renewed   []string // barcodes
+	Unrenewed []string // barcodes
+	Status    string   // screen message from the SIP-server
+}
+
+// renewAllParse returns a parserFunc which stores the outcome of a Renew All
+// request in res, as it spans several items and doesn't fit in one UIMsg.
+func renewAllParse(res *renewAllResult) parserFunc {
+	return func(msg sip.Message) UIMsg {
+		res.OK = msg.Field(sip.FieldOK) == "1"
+		res.Renewed = repeatedField(msg, "BM")
+		res.Unrenewed = repeatedField(msg, "BN")
+		res.Status = msg.Field(sip.FieldScreenMessage)
+		return UIMsg{Action: "RENEW-ALL"}
+	}
+}
+
+// dueDateParse parses an Item Information response, to get the due date of
+// an item on loan.
+func dueDateParse(msg sip.Message) UIMsg {
+	return UIMsg{
+		Item: item{
+			Barcode: msg.Field(sip.FieldItemIdentifier),
+			Label:   msg.Field(sip.FieldTitleIdentifier),
+			Date:    formatDate(msg.Field(sip.FieldDueDate)),
+		},
+	}
+}
+
+func patronInfoParse(msg sip.Message) UIMsg {
+	p := patron{
+		Name:       msg.Field(sip.FieldPersonalName),
+		Status:     msg.Field(sip.FieldScreenMessage),
+		StatusCode: screenMessageCode(msg.Field(sip.FieldScreenMessage)),
+		Fines:      msg.Field(sip.FieldFeeAmount),
+		Holds:      atoi(msg.Field(sip.FieldHoldItemsCount)),
+		Overdue:    atoi(msg.Field(sip.FieldOverdueItemsCount)),
+		Charged:    atoi(msg.Field(sip.FieldChargedItemsCount)),
+	}
+
+	switch {
+	case msg.Field(sip.FieldValidPatron) == "N":
+		p.Blocked = true
+		if p.Status == "" {
+			p.StatusCode = msgPatronUnknown
+			p.Status = localize(defaultLanguage, p.StatusCode)
+		}
+	case strings.HasPrefix(msg.Field(sip.FieldPatronStatus), "Y"):
+		// First position of patron status: charge privileges denied
+		p.Blocked = true
+		if p.Status == "" {
+			p.StatusCode = msgPatronBlocked
+			p.Status = localize(defaultLanguage, p.StatusCode)
+		}
+	}
+
+	return UIMsg{
+		Action:     "PATRON-INFO",
+		Patron:     msg.Field(sip.FieldPatronIdentifier),
+		PatronInfo: &p,
+	}
+}
+
 func itemStatusParse(msg sip.Message) UIMsg {
 	var (
 		unknown bool
 		status  string
+		code    string
 	)
 
 	if msg.Field(sip.FieldTitleIdentifier) == "" {
 		unknown = true
-		status = "eksemplaret finnes ikke i basen"
+		code = msgItemUnknown
+		status = localize(defaultLanguage, code)
 	}
 
 	return UIMsg{
@@ -227,47 +463,283 @@ func itemStatusParse(msg sip.Message) UIMsg {
 			TransactionFailed: true,
 			Barcode:           msg.Field(sip.FieldItemIdentifier),
 			Status:            status,
+			StatusCode:        code,
 			Unknown:           unknown,
 			Label:             msg.Field(sip.FieldTitleIdentifier),
 		},
 	}
 }
 
+// errSIPTimeout is returned by DoSIPCall when the SIP-server doesn't respond in
+// time.
+var errSIPTimeout = errors.New("SIP-server didn't respond in time")
+
+// sipConnError is returned by DoSIPCall when it couldn't get a connection to
+// the SIP-server, so that the request was never sent.
+type sipConnError struct {
+	err error
+}
+
+func (e sipConnError) Error() string { return e.err.Error() }
+
+// sipUnreachable returns true if err means that the request never reached the
+// SIP-server, because it is unavailable or couldn't be connected to.
+func sipUnreachable(err error) bool {
+	if err == errSIPUnavailable {
+		return true
+	}
+	_, ok := err.(sipConnError)
+	return ok
+}
+
+// sipErrorMsg returns the message notifying the UI of a failed SIP-call.
+func sipErrorMsg(err error) UIMsg {
+	if err == errSIPUnavailable {
+		return UIMsg{Action: "CONNECT", SIPError: true, SIPUnavailable: true,
+			ErrorMessage: err.Error(), ErrorCode: msgSIPUnavailable}
+	}
+	if isTimeout(err) {
+		return UIMsg{Action: "CONNECT", SIPTimeout: true,
+			ErrorMessage: errSIPTimeout.Error(), ErrorCode: msgSIPTimeout}
+	}
+	return UIMsg{Action: "CONNECT", SIPError: true, ErrorCode: msgSIPError}
+}
+
+// isTimeout returns true if err is caused by a timeout.
+func isTimeout(err error) bool {
+	if err == errSIPTimeout {
+		return true
+	}
+	if ce, ok := err.(sipConnError); ok {
+		err = ce.err
+	}
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+// sipConn is a connection to the SIP-server, where every read and write must
+// complete within the given timeouts.
+type sipConn struct {
+	net.Conn
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	used         time.Time // last time the connection was used for a request
+
+	// Error detection mode, and the sequence number of the next request:
+	errorDetection bool
+	seq            int
+}
+
+// touch records that a pooled SIP-connection is being used for a request.
+func touch(conn net.Conn) {
+	if pc, ok := conn.(*pool.PoolConn); ok {
+		if c, ok := pc.Conn.(*sipConn); ok {
+			c.used = time.Now()
+		}
+	}
+}
+
+// idleSince returns the last time a pooled SIP-connection was used for a
+// request.
+func idleSince(conn net.Conn) time.Time {
+	if pc, ok := conn.(*pool.PoolConn); ok {
+		if c, ok := pc.Conn.(*sipConn); ok {
+			return c.used
+		}
+	}
+	return time.Now()
+}
+
+// sipPing checks that a SIP-connection is alive with a SC Status request.
+func sipPing(conn net.Conn) error {
+	seq := nextSeq(conn)
+	if err := encodeSIP(conn, sipFormMsgSCStatus(), seq); err != nil {
+		return err
+	}
+	resp, err := readSIP(conn, seq)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(string(resp), "98") {
+		return fmt.Errorf("unexpected response to SC Status: %q", strings.TrimSpace(string(resp)))
+	}
+	return nil
+}
+
+// sipHealthCheck probes the idle connections in the pool with SC Status, and
+// evicts the ones which doesn't respond. Connections idle for longer than
+// idleTimeout (if positive) are closed, as long as at least min connections
+// are kept. Finally, the pool is filled up to min connections.
+func sipHealthCheck(p pool.Pool, min int, idleTimeout time.Duration) {
+	for n := p.Len(); n > 0; n-- {
+		conn, err := p.Get()
+		if err != nil {
+			return
+		}
+		if idleTimeout > 0 && p.Len() >= min && time.Since(idleSince(conn)) > idleTimeout {
+			status.SIPConnsEvicted.Inc("idle")
+			conn.(*pool.PoolConn).MarkUnusable()
+			conn.Close()
+			continue
+		}
+		if err := sipPing(conn); err != nil {
+			log.Printf("WARN: closing dead SIP connection: %v", err)
+			status.SIPConnsEvicted.Inc("dead")
+			conn.(*pool.PoolConn).MarkUnusable()
+			conn.Close()
+			continue
+		}
+		conn.Close()
+	}
+
+	if p.Len() >= min {
+		return
+	}
+	conns := make([]net.Conn, 0, min)
+	for len(conns) < min {
+		conn, err := p.Get()
+		if err != nil {
+			log.Printf("WARN: failed to open SIP connection: %v", err)
+			break
+		}
+		conns = append(conns, conn)
+	}
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+func (c *sipConn) Read(b []byte) (int, error) {
+	if c.readTimeout > 0 {
+		c.Conn.SetReadDeadline(time.Now().Add(c.readTimeout))
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *sipConn) Write(b []byte) (int, error) {
+	if c.writeTimeout > 0 {
+		c.Conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	}
+	return c.Conn.Write(b)
+}
+
+// sipTLSConfig returns the TLS configuration for connecting to the
+// SIP-server, or nil if TLS is not enabled.
+func sipTLSConfig(cfg config) (*tls.Config, error) {
+	if !cfg.SIPTLS {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{ServerName: cfg.SIPTLSServerName}
+	if cfg.SIPTLSCA != "" {
+		b, err := ioutil.ReadFile(cfg.SIPTLSCA)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("%v: no certificates found", cfg.SIPTLSCA)
+		}
+	}
+	if cfg.SIPTLSCert != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.SIPTLSCert, cfg.SIPTLSKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
 // initSIPConn is the default factory function for creating a SIP connection.
 func initSIPConn(cfg config) func() (net.Conn, error) {
+	tlsConfig, tlsErr := sipTLSConfig(cfg)
 	return func() (net.Conn, error) {
-		conn, err := net.Dial("tcp", cfg.SIPServer)
+		if tlsErr != nil {
+			return nil, tlsErr
+		}
+		// With TLS, the handshake must complete within the connect timeout:
+		dialer := &net.Dialer{Timeout: cfg.SIPConnectTimeout.Duration}
+		var conn net.Conn
+		var err error
+		if tlsConfig != nil {
+			conn, err = tls.DialWithDialer(dialer, "tcp", cfg.SIPServer, tlsConfig)
+		} else {
+			conn, err = dialer.Dial("tcp", cfg.SIPServer)
+		}
 		if err != nil {
 			return nil, err
 		}
 
+		// The login must complete within the connect timeout:
+		if cfg.SIPConnectTimeout.Duration > 0 {
+			conn.SetDeadline(time.Now().Add(cfg.SIPConnectTimeout.Duration))
+		}
+
 		msg := sipFormMsgLogin(cfg.SIPUser, cfg.SIPPass, cfg.SIPDept)
+		seq := -1
+		if cfg.SIPErrorDetection {
+			seq = 0
+		}
 
-		if err = msg.Encode(conn); err != nil {
+		if err = encodeSIP(conn, msg, seq); err != nil {
 			log.Println("ERROR:", err.Error())
+			conn.Close()
 			return nil, err
 		}
 		log.Printf("-> %v", strings.TrimSpace(msg.String()))
 
-		reader := bufio.NewReader(conn)
-		in, err := reader.ReadString('\r')
+		resp, err := readSIP(conn, seq)
 		if err != nil {
 			log.Println("ERROR:", err.Error())
+			conn.Close()
 			return nil, err
 		}
+		in := string(resp)
 
 		log.Printf("<- %v", strings.TrimSpace(in))
 
 		// fail if response == 940 (success == 941)
 		if in[2] == '0' {
+			conn.Close()
 			return nil, errors.New("SIP login failed")
 		}
 
-		return conn, nil
+		conn.SetDeadline(time.Time{})
+		return &sipConn{
+			Conn:         conn,
+			readTimeout:  cfg.SIPReadTimeout.Duration,
+			writeTimeout: cfg.SIPWriteTimeout.Duration,
+			used:         time.Now(),
+
+			errorDetection: cfg.SIPErrorDetection,
+			seq:            1,
+		}, nil
 	}
 
 }
 
+// repeatedField returns all the values of a field which may be repeated in a
+// SIP message, eg. the renewed items (BM) of a Renew All response.
+func repeatedField(msg sip.Message, code string) []string {
+	var res []string
+	fields := strings.Split(strings.TrimRight(msg.String(), "\r"), "|")
+	// The first field follows the fixed-length fields; it is the institution
+	// id and never a repeatable field.
+	for _, f := range fields[1:] {
+		if strings.HasPrefix(f, code) {
+			res = append(res, f[len(code):])
+		}
+	}
+	return res
+}
+
+// atoi parses a count from a SIP field, eg. "0003". It returns 0 if the field
+// is empty or not a number.
+func atoi(s string) int {
+	n, _ := strconv.Atoi(strings.TrimSpace(s))
+	return n
+}
+
 func formatDate(s string) string {
 	if len(s) < 9 {
 		return s
@@ -2,24 +2,53 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
 	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"gopkg.in/fatih/pool.v2"
 )
 
 type SIPTestServer struct {
 	l       net.Listener
+	mu      sync.Mutex
 	echo    []byte
-	auth    bool
-	failing bool
+	queue   [][]byte // responses to send before echo
+	reqs    [][]byte // requests received
+	failing bool     // closes all connections
+	hanging bool     // never responds after login
 }
 
 func newSIPTestServer() *SIPTestServer {
-	l, err := net.Listen("tcp", ":0")
+	return newTLSSIPTestServer(nil)
+}
+
+// newTLSSIPTestServer returns a SIP test server which accepts TLS
+// connections, or plain TCP connections if tlsConfig is nil.
+func newTLSSIPTestServer(tlsConfig *tls.Config) *SIPTestServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
 		panic(err)
 	}
+	if tlsConfig != nil {
+		l = tls.NewListener(l, tlsConfig)
+	}
 	s := SIPTestServer{l: l}
 	go s.run()
 	return &s
@@ -31,34 +60,95 @@ func (s *SIPTestServer) run() {
 		if err != nil {
 			return
 		}
-		defer conn.Close()
-		if s.failing {
+		s.mu.Lock()
+		failing := s.failing
+		s.mu.Unlock()
+		if failing {
 			conn.Close()
+			continue
+		}
+		go s.serve(conn)
+	}
+}
+
+func (s *SIPTestServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		req, err := r.ReadBytes('\r')
+		if err != nil {
 			return
 		}
-		r := bufio.NewReader(conn)
-		for {
-			_, _ = r.ReadBytes('\r')
-			msg := s.echo
-			if !s.auth {
-				msg = []byte("941\r")
-			}
-			_, err = conn.Write(msg)
-			if err != nil {
-				panic(err)
-			}
-			s.auth = true
+		msg := s.next(req)
+		if msg == nil {
+			continue
+		}
+		if _, err = conn.Write(msg); err != nil {
+			return
 		}
+	}
+}
 
+// next returns the response to send to the given request. Login requests
+// always succeed.
+func (s *SIPTestServer) next(req []byte) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reqs = append(s.reqs, req)
+	if bytes.HasPrefix(req, []byte("93")) {
+		return []byte("941\r")
 	}
+	if s.hanging {
+		return nil
+	}
+	if len(s.queue) > 0 {
+		msg := s.queue[0]
+		s.queue = s.queue[1:]
+		return msg
+	}
+	return s.echo
+}
+
+func (s *SIPTestServer) Respond(msg string) {
+	s.mu.Lock()
+	s.echo = []byte(msg)
+	s.mu.Unlock()
+}
+
+// RespondSeq makes the server answer the following requests with the given
+// messages, in order, before responding as given to Respond.
+func (s *SIPTestServer) RespondSeq(msgs ...string) {
+	s.mu.Lock()
+	for _, msg := range msgs {
+		s.queue = append(s.queue, []byte(msg))
+	}
+	s.mu.Unlock()
+}
 
+// Requests returns the requests received by the server.
+func (s *SIPTestServer) Requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var res []string
+	for _, req := range s.reqs {
+		res = append(res, string(req))
+	}
+	return res
 }
 
-func (s *SIPTestServer) Respond(msg string) { s.echo = []byte(msg) }
-func (s *SIPTestServer) Addr() string       { return s.l.Addr().String() }
-func (s *SIPTestServer) Close()             { s.l.Close() }
+func (s *SIPTestServer) Addr() string { return s.l.Addr().String() }
+func (s *SIPTestServer) Close()       { s.l.Close() }
 func (s *SIPTestServer) Failing() *SIPTestServer {
-	s.failing = true
+	s.SetFailing(true)
+	return s
+}
+func (s *SIPTestServer) SetFailing(failing bool) {
+	s.mu.Lock()
+	s.failing = failing
+	s.mu.Unlock()
+}
+func (s *SIPTestServer) Hanging() *SIPTestServer {
+	s.hanging = true
 	return s
 }
 
@@ -105,6 +195,33 @@ func TestSIPCheckin(t *testing.T) {
 	if want := "froa"; res.Item.Transfer != want {
 		t.Errorf("res.Item.Transfer == %q; want %q", res.Item.Transfer, want)
 	}
+	if !res.Item.HoldOtherBranch || !res.Item.Transit {
+		t.Errorf("res.Item.HoldOtherBranch, Transit == %v, %v; want true, true", res.Item.HoldOtherBranch, res.Item.Transit)
+	}
+	if res.Item.PickupBranch != "froa" || res.Item.TransitTo != "froa" || res.Item.HoldPatron != "11" {
+		t.Errorf("res.Item.PickupBranch, TransitTo, HoldPatron == %q, %q, %q; want \"froa\", \"froa\", \"11\"",
+			res.Item.PickupBranch, res.Item.TransitTo, res.Item.HoldPatron)
+	}
+
+	// Reserved for a patron at the current branch:
+	srv.Respond("101YNN20140511    092216AOhutl|AB03010013753001|AQhutl|AJHeksenes historie|CY11|CV01|\r")
+	res, err = DoSIPCall(p, sipFormMsgCheckin("hutl", "03010013753001"), checkinParse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Item.Hold || res.Item.HoldOtherBranch || res.Item.Transit || res.Item.HoldPatron != "11" {
+		t.Errorf("Hold at current branch => %+v", res.Item)
+	}
+
+	// Sent to another branch, without a hold:
+	srv.Respond("101YNN20140511    092216AOhutl|AB03010013753001|AQfbol|AJHeksenes historie|CTfbol|CV04|\r")
+	res, err = DoSIPCall(p, sipFormMsgCheckin("hutl", "03010013753001"), checkinParse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Item.Transit || res.Item.TransitTo != "fbol" || res.Item.Hold || res.Item.HoldOtherBranch || res.Item.PickupBranch != "" {
+		t.Errorf("Transfer to other branch => %+v", res.Item)
+	}
 }
 
 func TestSIPCheckout(t *testing.T) {
@@ -124,6 +241,9 @@ func TestSIPCheckout(t *testing.T) {
 	if res.Item.TransactionFailed {
 		t.Errorf("res.Item.TransactionFailed == true; want false")
 	}
+	if want := "21/02/2014"; res.Item.DueDate != want {
+		t.Errorf("res.Item.DueDate == %q; want %q", res.Item.DueDate, want)
+	}
 	if want := "Krutt-Kim"; res.Item.Label != want {
 		t.Errorf("res.Item.Label == %q; want %q", res.Item.Label, want)
 	}
@@ -165,3 +285,365 @@ func TestSIPItemStatus(t *testing.T) {
 		t.Errorf("res.Item.Unknown == false; want true")
 	}
 }
+
+func TestSIPRenew(t *testing.T) {
+	srv := newSIPTestServer()
+	defer srv.Close()
+
+	p, err := pool.NewChannelPool(1, 1, initSIPConn(config{SIPServer: srv.Addr()}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv.Respond("301YNN20140301    120000AOHUTL|AA2|AB03011174511003|AJKrutt-Kim|AH20140401    235900|\r")
+	res, err := DoSIPCall(p, sipFormMsgRenew("HUTL", "2", "03011174511003"), renewParse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := UIMsg{Action: "RENEW",
+		Item: item{Label: "Krutt-Kim", Barcode: "03011174511003", Date: "01/04/2014"}}
+	if !reflect.DeepEqual(res, want) {
+		t.Errorf("Got %+v; want %+v", res, want)
+	}
+
+	srv.Respond("300NUN20140301    120000AOHUTL|AA2|AB03011174511003|AJKrutt-Kim|AH|AFItem has holds|\r")
+	res, err = DoSIPCall(p, sipFormMsgRenew("HUTL", "2", "03011174511003"), renewParse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Item.TransactionFailed {
+		t.Errorf("res.Item.TransactionFailed == false; want true")
+	}
+	if want := "Item has holds"; res.Item.Status != want {
+		t.Errorf("res.Item.Status == %q; want %q", res.Item.Status, want)
+	}
+}
+
+func TestSIPRenewAll(t *testing.T) {
+	srv := newSIPTestServer()
+	defer srv.Close()
+
+	p, err := pool.NewChannelPool(1, 1, initSIPConn(config{SIPServer: srv.Addr()}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv.Respond("66100020001" + "20140301    120000AOHUTL|BM03011174511003|BM03011143299001|BN03010824124004|AFItem has holds|\r")
+	var res renewAllResult
+	if _, err := DoSIPCall(p, sipFormMsgRenewAll("HUTL", "2"), renewAllParse(&res)); err != nil {
+		t.Fatal(err)
+	}
+	want := renewAllResult{
+		OK:        true,
+		Renewed:   []string{"03011174511003", "03011143299001"},
+		Unrenewed: []string{"03010824124004"},
+		Status:    "Item has holds",
+	}
+	if !reflect.DeepEqual(res, want) {
+		t.Errorf("Got %+v; want %+v", res, want)
+	}
+}
+
+func TestSIPTimeout(t *testing.T) {
+	srv := newSIPTestServer().Hanging()
+	defer srv.Close()
+
+	cfg := config{
+		SIPServer:         srv.Addr(),
+		SIPConnectTimeout: duration{50 * time.Millisecond},
+		SIPReadTimeout:    duration{50 * time.Millisecond},
+	}
+	p, err := pool.NewChannelPool(1, 1, initSIPConn(cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	_, err = DoSIPCall(p, sipFormMsgItemStatus("1003010856677001"), itemStatusParse)
+	if err != errSIPTimeout {
+		t.Fatalf("DoSIPCall to hanging SIP-server => %v; want %v", err, errSIPTimeout)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("DoSIPCall to hanging SIP-server took %v", elapsed)
+	}
+
+	// The SIP-server doesn't respond to login on a new connection either:
+	_, err = DoSIPCall(p, sipFormMsgItemStatus("1003010856677001"), itemStatusParse)
+	if !isTimeout(err) {
+		t.Fatalf("DoSIPCall with login to hanging SIP-server => %v; want a timeout", err)
+	}
+
+	want := UIMsg{Action: "CONNECT", SIPTimeout: true, ErrorMessage: "SIP-server didn't respond in time",
+		ErrorCode: msgSIPTimeout}
+	if got := sipErrorMsg(err); !reflect.DeepEqual(got, want) {
+		t.Errorf("sipErrorMsg(%v) => %+v; want %+v", err, got, want)
+	}
+	if got := sipErrorMsg(io.EOF); !got.SIPError || got.SIPTimeout {
+		t.Errorf("sipErrorMsg(io.EOF) => %+v; want SIPError", got)
+	}
+}
+
+func TestSIPHealthCheck(t *testing.T) {
+	srv := newSIPTestServer()
+	defer srv.Close()
+
+	p, err := pool.NewChannelPool(0, 3, initSIPConn(config{
+		SIPServer:      srv.Addr(),
+		SIPReadTimeout: duration{50 * time.Millisecond},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Respond("98YYYNYN01000320140226    2031402.00AOHUTL|BXYYYYYYYYYYYYYYYY|\r")
+
+	// The pool is filled up to the minimum:
+	sipHealthCheck(p, 2, time.Minute)
+	if n := p.Len(); n != 2 {
+		t.Fatalf("after health check: pool.Len() => %d; want 2", n)
+	}
+
+	// Idle connections are closed, as long as the minimum is kept:
+	idle := status.SIPConnsEvicted.Count("idle")
+	var conns []net.Conn
+	for i := 0; i < 2; i++ {
+		conn, err := p.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.(*pool.PoolConn).Conn.(*sipConn).used = time.Now().Add(-time.Hour)
+		conns = append(conns, conn)
+	}
+	for _, conn := range conns {
+		conn.Close()
+	}
+	sipHealthCheck(p, 1, time.Minute)
+	if n := p.Len(); n != 1 {
+		t.Errorf("after idle timeout: pool.Len() => %d; want 1", n)
+	}
+	if got := status.SIPConnsEvicted.Count("idle") - idle; got != 1 {
+		t.Errorf("idle connections evicted => %d; want 1", got)
+	}
+
+	// Connections which doesn't respond properly are replaced:
+	dead := status.SIPConnsEvicted.Count("dead")
+	srv.Respond("96\r")
+	sipHealthCheck(p, 1, 0)
+	if n := p.Len(); n != 1 {
+		t.Errorf("after dead connection: pool.Len() => %d; want 1", n)
+	}
+	if got := status.SIPConnsEvicted.Count("dead") - dead; got != 1 {
+		t.Errorf("dead connections evicted => %d; want 1", got)
+	}
+}
+
+func TestSIPChecksum(t *testing.T) {
+	if sipResendRequest != "97AZFEF5\r" {
+		t.Errorf("sipResendRequest => %q; want 97AZFEF5", sipResendRequest)
+	}
+
+	var tests = []struct {
+		resp    string
+		seq     int
+		body    string
+		wantErr error
+	}{
+		{withErrorDetection("941", 3), 3, "941|\r", nil},
+		{"941AY0AZFDFD\r", 0, "941\r", nil},
+		{"941AY0AZfdfd\r", 0, "941\r", nil},
+		{"941|AY0|AZFD05|\r", 0, "941|\r", nil},
+		{"941AY0AZFDFC\r", 0, "", errSIPChecksum},
+		{"941\r", -1, "941\r", nil},
+	}
+	for _, tt := range tests {
+		seq, body, err := checkErrorDetection([]byte(tt.resp))
+		if err != tt.wantErr {
+			t.Errorf("checkErrorDetection(%q) => error %v; want %v", tt.resp, err, tt.wantErr)
+			continue
+		}
+		if err == nil && (seq != tt.seq || string(body) != tt.body) {
+			t.Errorf("checkErrorDetection(%q) => %d, %q; want %d, %q", tt.resp, seq, body, tt.seq, tt.body)
+		}
+	}
+}
+
+func TestSIPErrorDetection(t *testing.T) {
+	srv := newSIPTestServer()
+	defer srv.Close()
+
+	p, err := pool.NewChannelPool(1, 1, initSIPConn(config{
+		SIPServer:         srv.Addr(),
+		SIPErrorDetection: true,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := "101YNN20140124    093621AOHUTL|AB03011143299001|AQhvmu|AJ316 salmer og sanger|AA1|"
+	stale := withErrorDetection("101YNN20140124    093621AOHUTL|AB1234|AQhvmu|AJStale|AA1|", 0)
+	corrupt := strings.Replace(withErrorDetection(resp, 1), "316", "317", 1)
+
+	// The first response is corrupt, and requested resent. The resent
+	// response is preceded by a response to an earlier request, which is
+	// discarded.
+	srv.RespondSeq(corrupt, stale+withErrorDetection(resp, 1))
+	res, err := DoSIPCall(p, sipFormMsgCheckin("HUTL", "03011143299001"), checkinParse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "316 salmer og sanger"; res.Item.Label != want {
+		t.Errorf("res.Item.Label == %q; want %q", res.Item.Label, want)
+	}
+
+	reqs := srv.Requests()
+	if len(reqs) != 3 {
+		t.Fatalf("SIP-server got %q; want login, checkin and resend", reqs)
+	}
+	for i, seq := range []int{0, 1} {
+		if got, _, err := checkErrorDetection([]byte(reqs[i])); err != nil || got != seq {
+			t.Errorf("request %q => sequence number %d, %v; want %d", reqs[i], got, err, seq)
+		}
+	}
+	if reqs[2] != sipResendRequest {
+		t.Errorf("got %q; want resend request", reqs[2])
+	}
+
+	// A response which stays corrupt is an error:
+	srv.RespondSeq(corrupt, corrupt, corrupt)
+	_, err = DoSIPCall(p, sipFormMsgCheckin("HUTL", "03011143299001"), checkinParse)
+	if err != errSIPChecksum {
+		t.Errorf("DoSIPCall with corrupt responses => %v; want %v", err, errSIPChecksum)
+	}
+}
+
+// testCert is a certificate and key for TLS tests, signed by parent, or
+// self-signed if parent is nil.
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newTestCert(t *testing.T, tmpl *x509.Certificate, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl.SerialNumber = big.NewInt(time.Now().UnixNano())
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+	signer, signerKey := tmpl, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+// writePEM writes the certificate and key to cert.pem and key.pem in dir,
+// with the given prefix, and returns the paths.
+func (c *testCert) writePEM(t *testing.T, dir, prefix string) (string, string) {
+	certFile := filepath.Join(dir, prefix+"cert.pem")
+	keyFile := filepath.Join(dir, prefix+"key.pem")
+	b, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0600)
+	if err == nil {
+		err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: b}), 0600)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+func TestSIPTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rfidhub-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}, nil)
+	caFile, _ := ca.writePEM(t, dir, "ca-")
+	serverCert := newTestCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "sip.example.org"},
+		DNSNames:    []string{"sip.example.org"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca)
+	clientCert := newTestCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "rfidhub"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca)
+	certFile, keyFile := clientCert.writePEM(t, dir, "client-")
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+	srv := newTLSSIPTestServer(&tls.Config{
+		Certificates: []tls.Certificate{serverCert.tlsCertificate()},
+		ClientCAs:    clientCAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	defer srv.Close()
+
+	cfg := config{
+		SIPServer:         srv.Addr(),
+		SIPConnectTimeout: duration{time.Second},
+		SIPTLS:            true,
+		SIPTLSCA:          caFile,
+		SIPTLSCert:        certFile,
+		SIPTLSKey:         keyFile,
+		SIPTLSServerName:  "sip.example.org",
+	}
+
+	p, err := pool.NewChannelPool(1, 1, initSIPConn(cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Respond("101YNN20140124    093621AOHUTL|AB03011143299001|AQhvmu|AJ316 salmer og sanger|AA1|\r")
+	res, err := DoSIPCall(p, sipFormMsgCheckin("HUTL", "03011143299001"), checkinParse)
+	p.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "316 salmer og sanger"; res.Item.Label != want {
+		t.Errorf("res.Item.Label == %q; want %q", res.Item.Label, want)
+	}
+
+	// The connection fails if the server certificate cannot be verified,
+	// or the client has no certificate:
+	var failures = []struct {
+		desc string
+		cfg  func(*config)
+	}{
+		{"wrong server name", func(c *config) { c.SIPTLSServerName = "koha.example.org" }},
+		{"unknown CA", func(c *config) { c.SIPTLSCA = "" }},
+		{"no client certificate", func(c *config) { c.SIPTLSCert, c.SIPTLSKey = "", "" }},
+		{"no TLS", func(c *config) { c.SIPTLS = false }},
+	}
+	for _, tt := range failures {
+		c := cfg
+		tt.cfg(&c)
+		if conn, err := initSIPConn(c)(); err == nil {
+			conn.Close()
+			t.Errorf("%s: connected to SIP-server; want error", tt.desc)
+		}
+	}
+}
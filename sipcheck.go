@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"regexp"
+	"strings"
+
+	"github.com/knakk/sip"
+
+	pool "gopkg.in/fatih/pool.v2"
+)
+
+// SIP2 error detection: requests are sent with a sequence number (AY) and a
+// checksum (AZ), and the checksum of responses is verified. A corrupt
+// response is requested resent with a Request SC Resend message (97), and
+// responses with another sequence number than the request are discarded, as
+// they belong to an earlier request.
+
+// sipMaxResends is the number of times a corrupt response is requested resent
+// before giving up.
+const sipMaxResends = 2
+
+// errSIPChecksum is returned when a response from the SIP-server stays corrupt
+// after requesting it resent.
+var errSIPChecksum = errors.New("SIP response checksum mismatch")
+
+// sipResendRequest is the Request SC Resend message, which has a checksum but
+// no sequence number.
+var sipResendRequest = "97AZ" + sipChecksum("97AZ") + "\r"
+
+// sipErrorDetectionSuffix matches the sequence number and checksum at the end
+// of a response. Some SIP-servers delimit them with "|".
+var sipErrorDetectionSuffix = regexp.MustCompile(`AY([0-9])\|?AZ([0-9A-Fa-f]{4})\|?$`)
+
+// sipChecksum returns the checksum of a SIP message up to and including "AZ":
+// the two's complement of the sum of its bytes, as four hexadecimal digits.
+func sipChecksum(s string) string {
+	var sum uint16
+	for i := 0; i < len(s); i++ {
+		sum += uint16(s[i])
+	}
+	return fmt.Sprintf("%04X", -sum)
+}
+
+// withErrorDetection appends the sequence number and checksum to an encoded
+// SIP message.
+func withErrorDetection(msg string, seq int) string {
+	msg = strings.TrimRight(msg, "\r")
+	if !strings.HasSuffix(msg, "|") {
+		msg += "|"
+	}
+	msg += fmt.Sprintf("AY%dAZ", seq)
+	return msg + sipChecksum(msg) + "\r"
+}
+
+// checkErrorDetection verifies the checksum of a SIP response, and returns
+// its sequence number and the response without sequence number and
+// checksum. The sequence number is -1 if the response has none.
+func checkErrorDetection(resp []byte) (int, []byte, error) {
+	s := strings.TrimRight(string(resp), "\r\n")
+	m := sipErrorDetectionSuffix.FindStringSubmatchIndex(s)
+	if m == nil {
+		// Not all SIP-servers support error detection
+		return -1, resp, nil
+	}
+	// The checksum covers the response up to and including "AZ":
+	if !strings.EqualFold(sipChecksum(s[:m[4]]), s[m[4]:m[5]]) {
+		return 0, nil, errSIPChecksum
+	}
+	seq := int(s[m[2]] - '0')
+	return seq, []byte(s[:m[0]] + "\r"), nil
+}
+
+// nextSeq returns the sequence number to use for the next request on a pooled
+// SIP-connection, or -1 if it is not in error detection mode.
+func nextSeq(conn net.Conn) int {
+	if pc, ok := conn.(*pool.PoolConn); ok {
+		conn = pc.Conn
+	}
+	c, ok := conn.(*sipConn)
+	if !ok || !c.errorDetection {
+		return -1
+	}
+	seq := c.seq
+	c.seq = (c.seq + 1) % 10
+	return seq
+}
+
+// encodeSIP writes a SIP message, with the given sequence number and a
+// checksum, unless seq is -1.
+func encodeSIP(w io.Writer, msg sip.Message, seq int) error {
+	if seq < 0 {
+		return msg.Encode(w)
+	}
+	_, err := io.WriteString(w, withErrorDetection(msg.String(), seq))
+	return err
+}
+
+// readSIP reads the response to the request with the given sequence number.
+// Unless seq is -1, corrupt responses are requested resent, and responses to
+// other requests are skipped.
+func readSIP(rw io.ReadWriter, seq int) ([]byte, error) {
+	r := bufio.NewReader(rw)
+	resends := 0
+	for {
+		resp, err := r.ReadBytes('\r')
+		if err != nil || seq < 0 {
+			return resp, err
+		}
+		rseq, body, err := checkErrorDetection(resp)
+		if err == errSIPChecksum {
+			status.SIPChecksumErrors.Inc(1)
+			if resends == sipMaxResends {
+				return nil, err
+			}
+			resends++
+			log.Printf("WARN: corrupt SIP response %q, requesting resend", strings.TrimSpace(string(resp)))
+			if _, err := io.WriteString(rw, sipResendRequest); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if rseq >= 0 && rseq != seq {
+			log.Printf("WARN: discarding SIP response with sequence number %d; want %d: %q",
+				rseq, seq, strings.TrimSpace(string(resp)))
+			continue
+		}
+		return body, nil
+	}
+}
@@ -1,6 +1,10 @@
 package main
 
-import "strings"
+import (
+	"net/http"
+	"strings"
+	"time"
+)
 
 // Strips portnumber from remote address and return only the IP-address
 func addr2IP(addr string) string {
@@ -11,6 +15,28 @@ func addr2IP(addr string) string {
 	return addr[0:i]
 }
 
+// clientIP returns the IP-address of the client making the request. If
+// trustProxy is true, the address added to the X-Forwarded-For header by the
+// (last) reverse proxy is used, if present.
+func clientIP(r *http.Request, trustProxy bool) string {
+	if trustProxy {
+		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+			ips := strings.Split(fwd, ",")
+			return strings.TrimSpace(ips[len(ips)-1])
+		}
+	}
+	return addr2IP(r.RemoteAddr)
+}
+
 func stripLeading10(barcode string) string {
 	return strings.TrimPrefix(barcode, "10")
 }
+
+// nextBackoff doubles the wait duration, without exceeding max.
+func nextBackoff(wait, max time.Duration) time.Duration {
+	wait *= 2
+	if wait > max {
+		return max
+	}
+	return wait
+}
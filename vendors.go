@@ -18,6 +18,10 @@ func newDeichmanVendor() *deichmanVendor {
 	return &deichmanVendor{}
 }
 
+func init() {
+	registerVendor("deichman", func() Vendor { return newDeichmanVendor() })
+}
+
 func (v *deichmanVendor) Reset() {
 	v.WriteMode = false
 }
@@ -66,25 +70,36 @@ func (v *deichmanVendor) GenerateRFIDReq(r RFIDReq) []byte {
 		v.buf.Write([]byte("|0\r"))
 		return v.buf.Bytes()
 	case cmdSLPLBN:
-		return []byte("SLPLBN|02030000\r")
+		return v.slp("LBN", r.Data)
 	case cmdSLPLBC:
-		return []byte("SLPLBC|NO\r")
+		return v.slp("LBC", r.Data)
 	case cmdSLPDTM:
-		return []byte("SLPDTM|DS24\r")
+		return v.slp("DTM", r.Data)
 	case cmdSLPSSB:
-		return []byte("SLPSSB|0\r")
+		return v.slp("SSB", r.Data)
 	case cmdSLPCRD:
-		return []byte("SLPCRD|1\r")
+		return v.slp("CRD", r.Data)
 	case cmdSLPWTM:
-		return []byte("SLPWTM|5000\r")
+		return v.slp("WTM", r.Data)
 	case cmdSLPRSS:
-		return []byte("SLPRSS|1\r")
+		return v.slp("RSS", r.Data)
 	}
 
 	// This can never be reached, given all cases of r.Cmd are covered above:
 	panic("deichmanVendor.GenerateRFIDReq does not handle all commands!")
 }
 
+// slp generates a SLP (Set Library Parameter) command, ex: SLPLBN|02030000
+func (v *deichmanVendor) slp(param string, value []byte) []byte {
+	v.buf.Reset()
+	v.buf.Write([]byte("SLP"))
+	v.buf.WriteString(param)
+	v.buf.WriteByte('|')
+	v.buf.Write(value)
+	v.buf.WriteByte('\r')
+	return v.buf.Bytes()
+}
+
 // ParseRFIDResp parses the RFID response.
 func (v *deichmanVendor) ParseRFIDResp(r []byte) (RFIDResp, error) {
 	s := strings.TrimSuffix(string(r), "\r")
@@ -5,6 +5,20 @@ import (
 	"testing"
 )
 
+func TestVendorRegistry(t *testing.T) {
+	v, err := newVendor("deichman")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := v.(*deichmanVendor); !ok {
+		t.Errorf("newVendor(\"deichman\") => %T; want *deichmanVendor", v)
+	}
+
+	if v, err := newVendor("nosuchvendor"); err == nil {
+		t.Errorf("newVendor(\"nosuchvendor\") => %T; want an error", v)
+	}
+}
+
 func TestDeichmanGenerateRFIDRequest(t *testing.T) {
 	var tests = []struct {
 		in  RFIDReq
@@ -20,13 +34,13 @@ func TestDeichmanGenerateRFIDRequest(t *testing.T) {
 		{RFIDReq{Cmd: cmdAlarmLeave}, "OK \r"},
 		{RFIDReq{Cmd: cmdTagCount}, "TGC\r"},
 		{RFIDReq{Cmd: cmdWrite, Data: []byte("1003010650438004"), TagCount: 2}, "WRT1003010650438004|2|0\r"},
-		{RFIDReq{Cmd: cmdSLPLBN}, "SLPLBN|02030000\r"},
-		{RFIDReq{Cmd: cmdSLPLBC}, "SLPLBC|NO\r"},
-		{RFIDReq{Cmd: cmdSLPDTM}, "SLPDTM|DS24\r"},
-		{RFIDReq{Cmd: cmdSLPSSB}, "SLPSSB|0\r"},
-		{RFIDReq{Cmd: cmdSLPCRD}, "SLPCRD|1\r"},
-		{RFIDReq{Cmd: cmdSLPWTM}, "SLPWTM|5000\r"},
-		{RFIDReq{Cmd: cmdSLPRSS}, "SLPRSS|1\r"},
+		{RFIDReq{Cmd: cmdSLPLBN, Data: []byte("02030000")}, "SLPLBN|02030000\r"},
+		{RFIDReq{Cmd: cmdSLPLBC, Data: []byte("NO")}, "SLPLBC|NO\r"},
+		{RFIDReq{Cmd: cmdSLPDTM, Data: []byte("DS24")}, "SLPDTM|DS24\r"},
+		{RFIDReq{Cmd: cmdSLPSSB, Data: []byte("0")}, "SLPSSB|0\r"},
+		{RFIDReq{Cmd: cmdSLPCRD, Data: []byte("1")}, "SLPCRD|1\r"},
+		{RFIDReq{Cmd: cmdSLPWTM, Data: []byte("5000")}, "SLPWTM|5000\r"},
+		{RFIDReq{Cmd: cmdSLPRSS, Data: []byte("1")}, "SLPRSS|1\r"},
 		{RFIDReq{Cmd: cmdRetryAlarmOn, Data: []byte("1003010824124004:NO:02030000")}, "ACT1003010824124004:NO:02030000\r"},
 	}
 